@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/yvv4git/task-voting/internal/application"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+// archiveCmd represents the archive command
+var archiveCmd = &cobra.Command{
+	Use:   "archive",
+	Short: "Move the votes of old votings to the archive",
+	Long: `Close the votings which ended before --older-than, detach the partitions of their votes concurrently
+and attach them to voting_results_archive. The results of archived votings stay readable from the counters,
+the archive keeps the votes as voting_results_<voting id without dashes> until they're dumped and dropped.
+The partitions of deleted votings are dropped.
+
+Example:
+  go run main.go archive -c config.toml --older-than 720h
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		log := infrastructure.NewDefaultLogger()
+
+		olderThan, err := cmd.Flags().GetDuration("older-than")
+		if err != nil {
+			log.Error("reading older-than flag", slog.Any("error", err))
+			os.Exit(1)
+		}
+
+		var config infrastructure.Config
+		if err = viper.Unmarshal(&config); err != nil {
+			log.Error("unmarshalling config", slog.Any("error", err))
+			os.Exit(1)
+		}
+
+		if _, err = application.Archive(context.Background(), log, config, time.Now().UTC().Add(-olderThan)); err != nil {
+			log.Error("failed to archive", slog.Any("error", err))
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(archiveCmd)
+
+	archiveCmd.Flags().Duration("older-than", 30*24*time.Hour, "Archive the votings which ended this long ago")
+}
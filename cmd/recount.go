@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/yvv4git/task-voting/internal/application"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+// recountCmd represents the recount command
+var recountCmd = &cobra.Command{
+	Use:   "recount",
+	Short: "Rebuild the tally counters from the votes",
+	Long: `Compare the counters of every invariance with its votes, report the drift and rebuild the drifted counters.
+Votes wait while the counters are rebuilt. With --dry-run the drift is only reported.
+The command exits with code 2 when a drift is found.
+
+Example:
+  go run main.go recount -c config.toml --dry-run
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		log := infrastructure.NewDefaultLogger()
+
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			log.Error("reading dry-run flag", slog.Any("error", err))
+			os.Exit(1)
+		}
+
+		var config infrastructure.Config
+		if err = viper.Unmarshal(&config); err != nil {
+			log.Error("unmarshalling config", slog.Any("error", err))
+			os.Exit(1)
+		}
+
+		drifted, err := application.Recount(context.Background(), log, config, dryRun)
+		if err != nil {
+			log.Error("failed to recount", slog.Any("error", err))
+			os.Exit(1)
+		}
+		if drifted > 0 {
+			os.Exit(2)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(recountCmd)
+
+	recountCmd.Flags().Bool("dry-run", false, "Only report the drift")
+}
@@ -4,6 +4,7 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"log"
 	"log/slog"
 
 	"github.com/spf13/cobra"
@@ -38,4 +39,14 @@ var votingCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(votingCmd)
+
+	votingCmd.Flags().String("storage", "", "Storage of votings: postgres, sqlite or memory, overrides voting_service.storage")
+	if err := viper.BindPFlag("voting_service.storage", votingCmd.Flags().Lookup("storage")); err != nil {
+		log.Fatalf("Error binding storage flag: %s", err.Error())
+	}
+
+	votingCmd.Flags().String("sqlite-path", "", "Data file of the sqlite storage, overrides voting_service.sqlite.path")
+	if err := viper.BindPFlag("voting_service.sqlite.path", votingCmd.Flags().Lookup("sqlite-path")); err != nil {
+		log.Fatalf("Error binding sqlite-path flag: %s", err.Error())
+	}
 }
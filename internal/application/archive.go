@@ -0,0 +1,43 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/yvv4git/task-voting/internal/domain/repository"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+// Archive moves the partitions of votes of the votings ended before endedBefore to the archive, their results
+// are kept by the counters. The partitions of deleted votings are dropped. It returns the number of archived votings.
+func Archive(ctx context.Context, log *slog.Logger, cfg infrastructure.Config, endedBefore time.Time) (int, error) {
+	db, err := infrastructure.NewPostgresDB(ctx, cfg.VotingApp.DataBase)
+	if err != nil {
+		return 0, fmt.Errorf("init db connection: %w", err)
+	}
+	defer db.Close()
+
+	repo := repository.NewVoting(db, infrastructure.NewReadRouter(log, db, nil, 0))
+
+	dropped, err := repo.DropDeletedPartitions(ctx)
+	for _, name := range dropped {
+		log.Info("Partition of deleted voting dropped", slog.String("partition", name))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("drop partitions of deleted votings: %w", err)
+	}
+
+	archived, err := repo.Archive(ctx, endedBefore)
+	for _, id := range archived {
+		log.Info("Voting archived", slog.String("voting_id", id.String()))
+	}
+	if err != nil {
+		return len(archived), fmt.Errorf("archive: %w", err)
+	}
+
+	log.Info("Archive finished", slog.Int("archived", len(archived)), slog.Time("ended_before", endedBefore))
+
+	return len(archived), nil
+}
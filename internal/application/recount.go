@@ -0,0 +1,37 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/yvv4git/task-voting/internal/domain/repository"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+// Recount rebuilds the tally counters from the votes and logs every drifted counter,
+// with dryRun the drift is only reported. It returns the number of drifted counters.
+func Recount(ctx context.Context, log *slog.Logger, cfg infrastructure.Config, dryRun bool) (int, error) {
+	db, err := infrastructure.NewPostgresDB(ctx, cfg.VotingApp.DataBase)
+	if err != nil {
+		return 0, fmt.Errorf("init db connection: %w", err)
+	}
+	defer db.Close()
+
+	drifts, err := repository.NewVoting(db, infrastructure.NewReadRouter(log, db, nil, 0)).Recount(ctx, dryRun)
+	if err != nil {
+		return 0, fmt.Errorf("recount: %w", err)
+	}
+
+	for _, drift := range drifts {
+		log.Warn("Counter drift",
+			slog.String("voting_id", drift.VotingID.String()),
+			slog.String("invariance_id", drift.InvarianceID.String()),
+			slog.Int64("counted", drift.Counted),
+			slog.Int64("stored", drift.Stored),
+		)
+	}
+	log.Info("Recount finished", slog.Int("drifted", len(drifts)), slog.Bool("dry_run", dryRun))
+
+	return len(drifts), nil
+}
@@ -3,13 +3,17 @@ package application
 import (
 	"context"
 	"fmt"
+	"io/fs"
 	"log/slog"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
 	"github.com/yvv4git/task-voting/internal/domain/repository"
 	"github.com/yvv4git/task-voting/internal/domain/service"
 	"github.com/yvv4git/task-voting/internal/infrastructure"
 	"github.com/yvv4git/task-voting/internal/interfaces/web"
+	"github.com/yvv4git/task-voting/migrations"
 )
 
 type VotingService interface {
@@ -35,24 +39,181 @@ func (v *Voting) start(ctx context.Context) error {
 	v.log.Info("Starting VotingApplication")
 	defer v.log.Info("Shutting down VotingApplication")
 
-	// Init db
-	db, err := infrastructure.NewPostgresDB(ctx, v.cfg.VotingApp.DataBase)
-	if err != nil {
-		return fmt.Errorf("init db connection: %w", err)
+	// Init storage, stores of Postgres are kept in memory without the database
+	storage := v.cfg.VotingApp.Storage
+	if storage == "" {
+		storage = infrastructure.StorePostgres
+	}
+	if err := checkStores(storage, v.cfg.VotingApp); err != nil {
+		return err
+	}
+	var (
+		db          *pgxpool.Pool
+		votingRepo  service.VotingRepository
+		outboxStore infrastructure.OutboxStore
+		// readWrites is nil without replicas, every read sees the writes
+		readWrites service.ReadYourWrites
+	)
+	switch storage {
+	case infrastructure.StorePostgres:
+		var err error
+		db, err = infrastructure.NewPostgresDB(ctx, v.cfg.VotingApp.DataBase)
+		if err != nil {
+			return fmt.Errorf("init db connection: %w", err)
+		}
+
+		// Init replicas for lists and results, writes stay on the primary
+		replicas, err := infrastructure.NewPostgresReplicas(ctx, v.cfg.VotingApp.DataBase)
+		if err != nil {
+			return fmt.Errorf("init replica connections: %w", err)
+		}
+		replicaQueryers := make([]infrastructure.Queryer, 0, len(replicas))
+		for _, replica := range replicas {
+			defer replica.Close()
+			replicaQueryers = append(replicaQueryers, replica)
+		}
+		reads := infrastructure.NewReadRouter(v.log, db, replicaQueryers, v.cfg.VotingApp.DataBase.ReadYourWrites)
+
+		votingRepo = repository.NewVoting(db, reads)
+		readWrites = reads
+		outboxStore = infrastructure.NewPostgresOutboxStore(db)
+	case infrastructure.StoreSQLite:
+		// The schema is embedded, the data file is all the storage needs
+		sqliteConfig := v.cfg.VotingApp.SQLite.WithDefaults()
+		sqliteMigrations, err := fs.Sub(migrations.SQLite, "sqlite")
+		if err != nil {
+			return fmt.Errorf("sqlite migrations: %w", err)
+		}
+		sqliteDB, err := infrastructure.NewSQLiteDB(ctx, sqliteConfig, sqliteMigrations)
+		if err != nil {
+			return fmt.Errorf("init sqlite storage: %w", err)
+		}
+		defer sqliteDB.Close()
+
+		v.log.Warn("sqlite storage, votings are not shared between instances, webhooks and limits are kept in memory",
+			slog.String("path", sqliteConfig.Path))
+		votingRepo = repository.NewSQLiteVoting(sqliteDB)
+		outboxStore = infrastructure.NewSQLiteOutboxStore(sqliteDB)
+	case infrastructure.StoreMemory:
+		v.log.Warn("memory storage, votings are lost on restart and are not shared between instances")
+		memoryOutbox := infrastructure.NewMemoryOutboxStore()
+		votingRepo = repository.NewMemoryVoting(memoryOutbox)
+		outboxStore = memoryOutbox
+	default:
+		return fmt.Errorf("unknown storage: %s", storage)
 	}
 
 	// Init subscription
-	subscription := infrastructure.NewSubscription(v.log)
+	subscription := infrastructure.NewSubscription(v.log, v.cfg.VotingApp.WebAPI.WebSocket)
+
+	// Init cache of voting reads, events of this and other instances invalidate it
+	cacheConfig := v.cfg.VotingApp.Cache.WithDefaults()
+	localPublishers := infrastructure.EventPublishers{subscription}
+	var resultCache *service.ResultCache
+	if cacheConfig.Enabled {
+		resultCache = service.NewResultCache(cacheConfig.TTL, readWrites)
+		localPublishers = append(localPublishers, resultCache)
+	}
+
+	// Init event distribution between instances
+	eventsConfig := v.cfg.VotingApp.Events.WithDefaults()
+	var eventBus infrastructure.EventBus
+	switch eventsConfig.Bus {
+	case infrastructure.StorePostgres:
+		eventBus = infrastructure.NewPostgresEventBus(db, eventsConfig.Channel)
+	case infrastructure.StoreMemory:
+		eventBus = infrastructure.NewMemoryEventBus()
+	default:
+		return fmt.Errorf("unknown event bus: %s", eventsConfig.Bus)
+	}
+	distributor := infrastructure.NewEventDistributor(v.log, eventBus, localPublishers, eventsConfig)
+	go distributor.Run(ctx)
+
+	// Init webhooks
+	webhooksConfig := v.cfg.VotingApp.Webhooks.WithDefaults()
+	var webhookStore infrastructure.WebhookStore
+	switch webhooksConfig.Store {
+	case infrastructure.StorePostgres:
+		webhookStore = infrastructure.NewPostgresWebhookStore(db)
+	case infrastructure.StoreMemory:
+		webhookStore = infrastructure.NewMemoryWebhookStore()
+	default:
+		return fmt.Errorf("unknown webhook store: %s", webhooksConfig.Store)
+	}
+	webhooks := infrastructure.NewWebhookDispatcher(v.log, webhookStore, webhooksConfig)
+	go webhooks.Run(ctx)
+
+	// Init outbox relay, it delivers events committed together with the changes
+	// Subscribers get votes coalesced into voting.tally unless every vote is asked for
+	var distributorSink infrastructure.OutboxSink = distributor
+	if !eventsConfig.PublishVotes {
+		distributorSink = infrastructure.SkipEvents(distributor, entity.EventVoteCast)
+	}
+	outboxRelay := infrastructure.NewOutboxRelay(v.log, outboxStore, eventsConfig.Outbox, webhooks, distributorSink)
+	go outboxRelay.Run(ctx)
+
+	// Init service, voting.tally is published to subscribers only
+	votingService := service.NewVoting(v.log, votingRepo, distributor, outboxRelay, v.cfg.VotingApp.Ingest, resultCache)
+	go votingService.RunIngest(ctx)
+	go votingService.RunCloser(ctx, eventsConfig.CloserInterval)
+	go votingService.RunTally(ctx, eventsConfig.TallyInterval)
+	authService := infrastructure.NewAuthStub(v.cfg.VotingApp.Auth.Admins)
 
-	// Init repo & service
-	votingRepo := repository.NewVoting(db)
-	votingService := service.NewVoting(v.log, votingRepo, subscription)
-	authService := infrastructure.NewAuthStub()
+	// Init brute-force protection
+	lockoutConfig := v.cfg.VotingApp.Auth.Lockout.WithDefaults()
+	var loginAttemptStore infrastructure.LoginAttemptStore
+	switch lockoutConfig.Store {
+	case infrastructure.StorePostgres:
+		loginAttemptStore = infrastructure.NewPostgresLoginAttemptStore(db)
+	case infrastructure.StoreMemory:
+		loginAttemptStore = infrastructure.NewMemoryLoginAttemptStore()
+	default:
+		return fmt.Errorf("unknown lockout store: %s", lockoutConfig.Store)
+	}
+	loginGuard := infrastructure.NewLoginGuard(v.log, loginAttemptStore, lockoutConfig)
+
+	// Init rate limiter
+	rateLimitConfig := v.cfg.VotingApp.RateLimit.WithDefaults()
+	var rateLimitStore infrastructure.RateLimitStore
+	switch rateLimitConfig.Store {
+	case infrastructure.StorePostgres:
+		rateLimitStore = infrastructure.NewPostgresRateLimitStore(db)
+	case infrastructure.StoreMemory:
+		rateLimitStore = infrastructure.NewMemoryRateLimitStore()
+	default:
+		return fmt.Errorf("unknown rate limit store: %s", rateLimitConfig.Store)
+	}
+	rateLimiter := infrastructure.NewRateLimiter(v.log, rateLimitStore, rateLimitConfig)
 
 	// Init web interface
 	webConfig := v.cfg.VotingApp.WebAPI
-	r := gin.Default()
-	webHandler := web.NewVotingHandler(votingService, authService, subscription)
+	tickets, err := infrastructure.NewSubscribeTickets(webConfig.WebSocket)
+	if err != nil {
+		return fmt.Errorf("init subscribe tickets: %w", err)
+	}
+	if webConfig.WebSocket.TicketSecret == "" {
+		v.log.Warn("websocket ticket_secret is not set, subscribe tickets are valid on this instance only")
+	}
+
+	// Tickets are passed in the query, the access log doesn't keep them
+	r := gin.New()
+	r.Use(gin.LoggerWithFormatter(web.AccessLogFormatter), gin.Recovery())
+	// The client IP keys the lockout and the rate limits, a forwarded IP is believed from trusted proxies only
+	if err = r.SetTrustedProxies(webConfig.TrustedProxies); err != nil {
+		return fmt.Errorf("set trusted proxies: %w", err)
+	}
+	webHandler := web.NewVotingHandler(
+		v.log,
+		votingService,
+		authService,
+		subscription,
+		loginGuard,
+		rateLimiter,
+		tickets,
+		webhooks,
+		webConfig.WebSocket,
+		cacheConfig,
+	)
 	webHandler.RegisterHandlers(r)
 	webSrv := infrastructure.NewWebServer(v.log, r, fmt.Sprintf("%s:%d", webConfig.Host, webConfig.Port))
 	if err = webSrv.Run(ctx); err != nil {
@@ -61,3 +222,28 @@ func (v *Voting) start(ctx context.Context) error {
 
 	return nil
 }
+
+// checkStores refuses the postgres stores of the components without the postgres storage, there is no database
+// for them. The data file of sqlite serves a single instance, so the events need no bus between instances.
+func checkStores(storage string, cfg infrastructure.VotingApplication) error {
+	if storage == infrastructure.StorePostgres {
+		return nil
+	}
+
+	stores := []struct {
+		name  string
+		store string
+	}{
+		{name: "bus of [voting_service.events]", store: cfg.Events.Bus},
+		{name: "store of [voting_service.webhooks]", store: cfg.Webhooks.Store},
+		{name: "store of [voting_service.auth.lockout]", store: cfg.Auth.Lockout.Store},
+		{name: "store of [voting_service.rate_limit]", store: cfg.RateLimit.Store},
+	}
+	for _, s := range stores {
+		if s.store == infrastructure.StorePostgres {
+			return fmt.Errorf("%s is postgres, but the storage is %s: set it to memory", s.name, storage)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package entity
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EventVersion is the version of the Event envelope, bump it on breaking changes.
+const EventVersion = 1
+
+type EventType string
+
+const (
+	EventVoteCast      EventType = "vote.cast"
+	EventVotingCreated EventType = "voting.created"
+	EventVotingUpdated EventType = "voting.updated"
+	EventVotingDeleted EventType = "voting.deleted"
+	EventVotingClosed  EventType = "voting.closed"
+	// EventVotingTally carries the actual scores of a voting, votes are coalesced into it.
+	EventVotingTally EventType = "voting.tally"
+	// EventPresence is sent to the viewers of a voting when their number changes, it's not replayed.
+	EventPresence EventType = "voting.presence"
+	// EventSnapshot carries the full state, clients request it on connect.
+	EventSnapshot EventType = "snapshot"
+)
+
+// Valid reports whether the type is one of the event types webhooks can subscribe to,
+// the frequent and per connection events are for subscribers only.
+func (t EventType) Valid() bool {
+	return slices.Contains([]EventType{
+		EventVoteCast, EventVotingCreated, EventVotingUpdated, EventVotingDeleted, EventVotingClosed,
+	}, t)
+}
+
+// Event is the envelope of every message sent to subscribers.
+// ID is unique across instances, Sequence is assigned on publishing by the
+// local hub, it grows monotonically within the Epoch of the hub.
+type Event struct {
+	ID       uuid.UUID       `json:"id"`
+	Version  int             `json:"version"`
+	Type     EventType       `json:"type"`
+	VotingID uuid.UUID       `json:"voting_id"`
+	Tags     []string        `json:"tags,omitempty"`
+	Epoch    string          `json:"epoch,omitempty"`
+	Sequence uint64          `json:"sequence"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+func NewEvent(eventType EventType, votingID uuid.UUID, tags []string, payload any) (Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, fmt.Errorf("marshal %s payload: %w", eventType, err)
+	}
+
+	return Event{
+		ID:       uuid.New(),
+		Version:  EventVersion,
+		Type:     eventType,
+		VotingID: votingID,
+		Tags:     tags,
+		Payload:  data,
+	}, nil
+}
+
+// VoteCastPayload is the payload of EventVoteCast.
+type VoteCastPayload struct {
+	InvarianceID uuid.UUID `json:"invariance_id"`
+	Score        int64     `json:"score"`
+	// Turnout is the number of votes in the voting including this one
+	Turnout int64 `json:"turnout"`
+}
+
+// PresencePayload is the payload of EventPresence.
+type PresencePayload struct {
+	// Viewers is the number of users subscribed to the voting
+	Viewers int `json:"viewers"`
+}
+
+// VotingPayload is the payload of the voting events, it carries the state of the voting.
+type VotingPayload struct {
+	ID          uuid.UUID                `json:"id"`
+	Name        string                   `json:"name"`
+	Description string                   `json:"description"`
+	Tags        []string                 `json:"tags"`
+	CreatedAt   time.Time                `json:"created_at"`
+	StartAt     time.Time                `json:"startAt"`
+	EndAt       time.Time                `json:"endAt"`
+	Invariance  []InvarianceScorePayload `json:"invariance"`
+	// Turnout is the number of votes, every user votes once
+	Turnout int64 `json:"turnout"`
+}
+
+type InvarianceScorePayload struct {
+	ID    uuid.UUID `json:"id"`
+	Name  string    `json:"name"`
+	Score int64     `json:"score"`
+}
@@ -0,0 +1,11 @@
+package entity
+
+import (
+	"github.com/google/uuid"
+)
+
+// Identity is the authenticated user behind a request or a subscription.
+type Identity struct {
+	UserID   uuid.UUID `json:"uid"`
+	Username string    `json:"name"`
+}
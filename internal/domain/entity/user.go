@@ -8,4 +8,5 @@ type User struct {
 	ID       uuid.UUID
 	Name     string
 	Password string
+	Admin    bool
 }
@@ -0,0 +1,58 @@
+package entity
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhook is an endpoint receiving events, VotingID is nil for a global webhook,
+// no EventTypes means every event type. The webhook of a voting is disabled once it's sent voting.deleted.
+type Webhook struct {
+	ID         uuid.UUID   `db:"id" json:"id"`
+	URL        string      `db:"url" json:"url"`
+	Secret     string      `db:"secret" json:"secret,omitempty"`
+	VotingID   *uuid.UUID  `db:"voting_id" json:"voting_id,omitempty"`
+	EventTypes []EventType `db:"event_types" json:"event_types,omitempty"`
+	CreatedAt  time.Time   `db:"created_at" json:"created_at"`
+	DisabledAt *time.Time  `db:"disabled_at" json:"disabled_at,omitempty"`
+}
+
+// Matches reports whether the webhook is subscribed to the event.
+func (w Webhook) Matches(event Event) bool {
+	if w.DisabledAt != nil {
+		return false
+	}
+	if w.VotingID != nil && *w.VotingID != event.VotingID {
+		return false
+	}
+
+	return len(w.EventTypes) == 0 || slices.Contains(w.EventTypes, event.Type)
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "delivered"
+	// WebhookDeliveryDead is the dead letter, the delivery is not retried until it's redelivered manually.
+	WebhookDeliveryDead WebhookDeliveryStatus = "dead"
+)
+
+// WebhookDelivery is a single event sent to a single webhook.
+type WebhookDelivery struct {
+	ID            uuid.UUID             `db:"id" json:"id"`
+	WebhookID     uuid.UUID             `db:"webhook_id" json:"webhook_id"`
+	EventID       uuid.UUID             `db:"event_id" json:"event_id"`
+	EventType     EventType             `db:"event_type" json:"event_type"`
+	Event         json.RawMessage       `db:"event" json:"-"`
+	Status        WebhookDeliveryStatus `db:"status" json:"status"`
+	Attempts      int                   `db:"attempts" json:"attempts"`
+	NextAttemptAt time.Time             `db:"next_attempt_at" json:"next_attempt_at"`
+	LastError     string                `db:"last_error" json:"last_error,omitempty"`
+	ResponseCode  int                   `db:"response_code" json:"response_code,omitempty"`
+	CreatedAt     time.Time             `db:"created_at" json:"created_at"`
+	DeliveredAt   *time.Time            `db:"delivered_at" json:"delivered_at,omitempty"`
+}
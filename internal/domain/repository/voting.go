@@ -3,12 +3,15 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
 	"github.com/yvv4git/task-voting/internal/infrastructure"
 
 	sq "github.com/Masterminds/squirrel"
@@ -18,15 +21,24 @@ const (
 	tbVoting           = "voting"
 	tbVotingInvariance = "voting_invariance"
 	tbVotingResults    = "voting_results"
+	tbVotingCounters   = "voting_invariance_counters"
+	tbVotingCloser     = "voting_closer"
+
+	// conflictOneVote is the unique (voting_id, user_id) of voting_results, it keeps concurrent votes of a user out.
+	// Votes are inserted into the partition of the voting, so the conflict is matched by columns, not by name.
+	conflictOneVote = "(voting_id, user_id)"
 )
 
 type Voting struct {
 	db *pgxpool.Pool
+	// reads runs the read-only queries of lists and results, writes always use db
+	reads *infrastructure.ReadRouter
 }
 
-func NewVoting(db *pgxpool.Pool) *Voting {
+func NewVoting(db *pgxpool.Pool, reads *infrastructure.ReadRouter) *Voting {
 	return &Voting{
-		db: db,
+		db:    db,
+		reads: reads,
 	}
 }
 
@@ -46,6 +58,7 @@ type (
 		ID          uuid.UUID         `db:"voting_id"`
 		Name        string            `db:"voting_name"`
 		Description string            `db:"voting_desc"`
+		Tags        []string          `db:"voting_tags"`
 		CreatedAt   time.Time         `db:"created_at"`
 		StartAt     time.Time         `db:"started_at"`
 		EndAt       time.Time         `db:"ended_at"`
@@ -58,18 +71,8 @@ type (
 )
 
 func (v *Voting) List(ctx context.Context, r *ListVotingRequest) (*ListVotingResponse, error) {
-	var response ListVotingResponse
-
-	listBuilder := sq.Select(
-		"v.id", "v.name", "v.description", "v.created_at", "v.started_at", "v.ended_at",
-		"i.id", "i.name", "count(r.id)",
-	).
-		From("voting v").
-		LeftJoin("voting_invariance i ON v.id = i.voting_id").
-		LeftJoin("voting_results r ON i.id = r.invariant_id").
-		Where(sq.Eq{"v.deleted_at": nil}).
-		GroupBy("v.id", "i.id").
-		OrderBy("v.name", "i.name")
+	listBuilder := votingSelectBuilder().
+		Where(sq.Eq{"v.deleted_at": nil})
 
 	if r.Limit > 0 {
 		listBuilder = listBuilder.Limit(uint64(r.Limit))
@@ -79,12 +82,149 @@ func (v *Voting) List(ctx context.Context, r *ListVotingRequest) (*ListVotingRes
 		listBuilder = listBuilder.Offset(uint64(r.Offset))
 	}
 
-	stmt, args, err := listBuilder.PlaceholderFormat(sq.Dollar).ToSql()
+	items, err := v.selectVotings(ctx, v.reads, listBuilder)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ListVotingResponse{
+		Items: items,
+	}, nil
+}
+
+type GetVotingRequest struct {
+	ID uuid.UUID
+}
+
+// GetVoting returns the voting with scores of its invariance, deleted votings are not found.
+func (v *Voting) GetVoting(ctx context.Context, r *GetVotingRequest) (*VotingItem, error) {
+	return v.getVoting(ctx, v.reads, r.ID)
+}
+
+// getVoting reads the voting by q, e.g. the transaction of the change which writes its event.
+func (v *Voting) getVoting(ctx context.Context, q infrastructure.Queryer, id uuid.UUID) (*VotingItem, error) {
+	getBuilder := votingSelectBuilder().
+		Where(sq.Eq{"v.id": id, "v.deleted_at": nil})
+
+	items, err := v.selectVotings(ctx, q, getBuilder)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(items) == 0 {
+		return nil, infrastructure.ErrObjectNotFound
+	}
+
+	return &items[0], nil
+}
+
+type ListEndedRequest struct {
+	From time.Time
+	To   time.Time
+}
+
+// ListEnded returns the votings which ended in the (From, To] interval.
+func (v *Voting) ListEnded(ctx context.Context, r *ListEndedRequest) (*ListVotingResponse, error) {
+	items, err := v.selectVotings(ctx, v.reads, endedSelectBuilder(r))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ListVotingResponse{
+		Items: items,
+	}, nil
+}
+
+func endedSelectBuilder(r *ListEndedRequest) sq.SelectBuilder {
+	return votingSelectBuilder().
+		Where(sq.And{
+			sq.Eq{"v.deleted_at": nil},
+			sq.Gt{"v.ended_at": r.From},
+			sq.LtOrEq{"v.ended_at": r.To},
+		})
+}
+
+// CloseEnded writes voting.closed with the final results of the votings which ended in the (From, To] interval
+// to the outbox and keeps To as checked by the closer, in one transaction. It returns the number of the closed
+// votings. Every instance runs the closer, an event written again is kept once by its ID.
+func (v *Voting) CloseEnded(ctx context.Context, r *ListEndedRequest) (int, error) {
+	tx, err := v.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return 0, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	items, err := v.selectVotings(ctx, tx, endedSelectBuilder(r))
+	if err != nil {
+		return 0, err
+	}
+
+	events, err := votingClosedEvents(items)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = infrastructure.InsertOutboxEvents(ctx, tx, events); err != nil {
+		return 0, fmt.Errorf("insert outbox events: %w", err)
+	}
+
+	if err = v.saveCloserCheckedAt(ctx, tx, r.To); err != nil {
+		return 0, fmt.Errorf("save closer checked at: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	return len(items), nil
+}
+
+type closerCheck struct {
+	CheckedAt time.Time `db:"checked_at"`
+}
+
+// CloserCheckedAt returns the end of the last interval checked by the closer,
+// ErrObjectNotFound when the closer never ran.
+func (v *Voting) CloserCheckedAt(ctx context.Context) (time.Time, error) {
+	check, err := infrastructure.FetchRow[closerCheck](ctx, v.db, "SELECT checked_at FROM "+tbVotingCloser)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return check.CheckedAt, nil
+}
+
+// saveCloserCheckedAt keeps the end of the checked interval, an instance lagging behind never moves it back.
+func (v *Voting) saveCloserCheckedAt(ctx context.Context, tx pgx.Tx, checkedAt time.Time) error {
+	_, err := tx.Exec(ctx,
+		"INSERT INTO "+tbVotingCloser+" (checked_at) VALUES ($1) "+
+			"ON CONFLICT (id) DO UPDATE SET checked_at = GREATEST("+tbVotingCloser+".checked_at, EXCLUDED.checked_at)",
+		checkedAt,
+	)
+
+	return err
+}
+
+func votingSelectBuilder() sq.SelectBuilder {
+	return sq.Select(
+		"v.id", "v.name", "v.description", "v.tags", "v.created_at", "v.started_at", "v.ended_at",
+		"i.id", "i.name", "COALESCE(c.score, 0)",
+	).
+		From("voting v").
+		LeftJoin("voting_invariance i ON v.id = i.voting_id").
+		LeftJoin("voting_invariance_counters c ON c.invariance_id = i.id").
+		OrderBy("v.name", "v.id", "i.name")
+}
+
+func (v *Voting) selectVotings(ctx context.Context, q infrastructure.Queryer, builder sq.SelectBuilder) ([]VotingItem, error) {
+	var items []VotingItem
+
+	stmt, args, err := builder.PlaceholderFormat(sq.Dollar).ToSql()
 	if err != nil {
 		return nil, fmt.Errorf("build query: %w", err)
 	}
 
-	rows, err := v.db.Query(ctx, stmt, args...)
+	rows, err := q.Query(ctx, stmt, args...)
 	if err != nil {
 		return nil, fmt.Errorf("query: %w", err)
 	}
@@ -101,6 +241,7 @@ func (v *Voting) List(ctx context.Context, r *ListVotingRequest) (*ListVotingRes
 			&votingItem.ID,
 			&votingItem.Name,
 			&votingItem.Description,
+			&votingItem.Tags,
 			&votingItem.CreatedAt,
 			&votingItem.StartAt,
 			&votingItem.EndAt,
@@ -111,35 +252,31 @@ func (v *Voting) List(ctx context.Context, r *ListVotingRequest) (*ListVotingRes
 			return nil, fmt.Errorf("scan: %w", err)
 		}
 
-		lastItemIDx := len(response.Items) - 1
-		if len(response.Items) > 0 && votingItem.ID == response.Items[lastItemIDx].ID {
-			if !invarianceID.Valid {
-				continue
-			}
-			response.Items[lastItemIDx].Invariance = append(response.Items[lastItemIDx].Invariance, InvarianceScore{
-				ID:    uuid.MustParse(invarianceID.String),
-				Name:  invarianceName.String,
-				Score: invarianceScore.Int64,
-			})
-		} else {
-			votingItem.Invariance = []InvarianceScore{
-				{
-					ID:    uuid.MustParse(invarianceID.String),
-					Name:  invarianceName.String,
-					Score: invarianceScore.Int64,
-				},
-			}
-			response.Items = append(response.Items, votingItem)
+		lastItemIDx := len(items) - 1
+		if len(items) == 0 || votingItem.ID != items[lastItemIDx].ID {
+			items = append(items, votingItem)
+			lastItemIDx++
+		}
+
+		if !invarianceID.Valid {
+			continue
 		}
+
+		items[lastItemIDx].Invariance = append(items[lastItemIDx].Invariance, InvarianceScore{
+			ID:    uuid.MustParse(invarianceID.String),
+			Name:  invarianceName.String,
+			Score: invarianceScore.Int64,
+		})
 	}
 
-	return &response, nil
+	return items, rows.Err()
 }
 
 type (
 	CreateVotingParams struct {
 		Name        string
 		Description string
+		Tags        []string
 		StartAt     time.Time
 		EndAt       time.Time
 		Invariance  []string
@@ -180,6 +317,10 @@ func (v *Voting) CreateVoting(ctx context.Context, p *CreateVotingParams) (*Crea
 		return nil, fmt.Errorf("create voting: %w", err)
 	}
 
+	if err = v.createResultsPartition(ctx, tx, resultID.ID); err != nil {
+		return nil, fmt.Errorf("create results partition: %w", err)
+	}
+
 	if err = v.addInvariance(ctx, tx, addInvarianceParams{
 		votingID:       resultID.ID,
 		invarianceItem: p.Invariance,
@@ -187,10 +328,16 @@ func (v *Voting) CreateVoting(ctx context.Context, p *CreateVotingParams) (*Crea
 		return nil, fmt.Errorf("add invarianceItem: %w", err)
 	}
 
+	// The events of the voting are committed together with the change, the outbox relay publishes them
+	if err = v.insertVotingEvent(ctx, tx, entity.EventVotingCreated, resultID.ID, nil); err != nil {
+		return nil, err
+	}
+
 	err = tx.Commit(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("commit transaction: %w", err)
 	}
+	v.wroteInContext(ctx)
 
 	return &CreateVotingResult{
 		ID: resultID.ID,
@@ -199,8 +346,8 @@ func (v *Voting) CreateVoting(ctx context.Context, p *CreateVotingParams) (*Crea
 
 func (v *Voting) createVoting(ctx context.Context, tx pgx.Tx, p *CreateVotingParams) (*ResultID, error) {
 	updateBuilder := sq.Insert(tbVoting).
-		Columns("name", "description", "started_at", "ended_at").
-		Values(p.Name, p.Description, p.StartAt, p.EndAt).
+		Columns("name", "description", "tags", "started_at", "ended_at").
+		Values(p.Name, p.Description, nonNilTags(p.Tags), p.StartAt, p.EndAt).
 		Suffix("RETURNING id")
 
 	stmt, args, err := updateBuilder.PlaceholderFormat(sq.Dollar).ToSql()
@@ -216,6 +363,15 @@ func (v *Voting) createVoting(ctx context.Context, tx pgx.Tx, p *CreateVotingPar
 	return resultIDPtr, nil
 }
 
+// nonNilTags keeps the column not null, pgx encodes a nil slice as NULL.
+func nonNilTags(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+
+	return tags
+}
+
 type addInvarianceParams struct {
 	votingID       uuid.UUID
 	invarianceItem []string
@@ -245,6 +401,7 @@ type UpdateVotingParams struct {
 	ID          uuid.UUID
 	Name        *string
 	Description *string
+	Tags        []string
 	StartAt     *time.Time
 	EndAt       *time.Time
 	Invariance  []string
@@ -261,6 +418,12 @@ func (v *Voting) UpdateVoting(ctx context.Context, p *UpdateVotingParams) error
 		return fmt.Errorf("validate update voting: %w", err)
 	}
 
+	// Subscribers of the previous tags have to know the voting left them
+	previous, err := v.getVoting(ctx, tx, p.ID)
+	if err != nil {
+		return fmt.Errorf("get voting: %w", err)
+	}
+
 	if err = v.updateVoting(ctx, tx, p); err != nil {
 		return fmt.Errorf("update voting: %w", err)
 	}
@@ -269,7 +432,17 @@ func (v *Voting) UpdateVoting(ctx context.Context, p *UpdateVotingParams) error
 		return fmt.Errorf("update invarianceItem: %w", err)
 	}
 
-	return tx.Commit(ctx)
+	// Edited invariance are a part of the voting state, so it's voting.updated as well
+	if err = v.insertVotingEvent(ctx, tx, entity.EventVotingUpdated, p.ID, previous.Tags); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	v.wroteInContext(ctx)
+
+	return nil
 }
 
 func (v *Voting) validateUpdate(ctx context.Context, tx pgx.Tx, p *UpdateVotingParams) error {
@@ -288,6 +461,10 @@ func (v *Voting) updateVoting(ctx context.Context, tx pgx.Tx, p *UpdateVotingPar
 		updateBuilder = updateBuilder.Set("description", p.Description)
 	}
 
+	if p.Tags != nil {
+		updateBuilder = updateBuilder.Set("tags", p.Tags)
+	}
+
 	if p.StartAt != nil && !p.StartAt.IsZero() {
 		updateBuilder = updateBuilder.Set("started_at", p.StartAt)
 	}
@@ -373,11 +550,37 @@ func (v *Voting) DeleteVoting(ctx context.Context, params *DeleteVotingParams) e
 		return err
 	}
 
+	item, err := v.getVoting(ctx, tx, params.ID)
+	if err != nil {
+		return fmt.Errorf("get voting: %w", err)
+	}
+
 	if err = v.deleteVoting(ctx, tx, params.ID); err != nil {
 		return err
 	}
 
-	return tx.Commit(ctx)
+	event, err := votingDeletedEvent(item)
+	if err != nil {
+		return err
+	}
+
+	if err = infrastructure.InsertOutboxEvent(ctx, tx, event); err != nil {
+		return fmt.Errorf("insert outbox event: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	v.wroteInContext(ctx)
+
+	return nil
+}
+
+// wroteInContext records the write of the user of the context for read-your-writes.
+func (v *Voting) wroteInContext(ctx context.Context) {
+	if userID, ok := infrastructure.ReadUserFromContext(ctx); ok {
+		v.reads.Wrote(userID)
+	}
 }
 
 func (v *Voting) deleteVoting(ctx context.Context, tx pgx.Tx, id uuid.UUID) error {
@@ -393,7 +596,8 @@ func (v *Voting) deleteVoting(ctx context.Context, tx pgx.Tx, id uuid.UUID) erro
 		return err
 	}
 
-	// Voting invarianceItem are deleted cascadingly at the database level.
+	// Voting invarianceItem and votes, archived or not, are deleted cascadingly at the database level,
+	// the empty partition is dropped by the archive command.
 	return nil
 }
 
@@ -402,30 +606,191 @@ type MakeChoiceParams struct {
 	UserID       uuid.UUID
 }
 
-func (v *Voting) MakeChoice(ctx context.Context, p *MakeChoiceParams) error {
+type MakeChoiceResult struct {
+	VotingID uuid.UUID `db:"voting_id"`
+	Tags     []string  `db:"tags"`
+	// Score of the chosen invariance including this choice
+	Score int64 `db:"score"`
+	// Turnout of the voting including this choice
+	Turnout int64 `db:"turnout"`
+}
+
+func (v *Voting) MakeChoice(ctx context.Context, p *MakeChoiceParams) (*MakeChoiceResult, error) {
 	tx, err := v.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
 	if err != nil {
-		return fmt.Errorf("beginning transaction: %w", err)
+		return nil, fmt.Errorf("beginning transaction: %w", err)
 	}
 	defer tx.Rollback(ctx)
 
-	if err := v.validateBeforeMakeChoice(ctx, tx, p); err != nil {
-		return err
+	result, err := v.votingByInvariance(ctx, tx, p.InvarianceID)
+	if err != nil {
+		return nil, err
 	}
 
-	if err = v.makeChoice(ctx, tx, p); err != nil {
-		return err
+	if err := v.isFinished(ctx, tx, p); err != nil {
+		return nil, err
+	}
+
+	// A second vote of the user is rejected by the unique constraint, a check before
+	// the insert would let concurrent votes through
+	if err = v.makeChoice(ctx, tx, result.VotingID, p); err != nil {
+		return nil, err
+	}
+
+	if result.Score, err = v.incrementScore(ctx, tx, result.VotingID, p.InvarianceID); err != nil {
+		return nil, err
+	}
+
+	if result.Turnout, err = v.votingTurnout(ctx, tx, result.VotingID); err != nil {
+		return nil, err
+	}
+
+	// The event is committed together with the choice, the outbox relay publishes it
+	event, err := voteCastEvent(p, result)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = infrastructure.InsertOutboxEvent(ctx, tx, event); err != nil {
+		return nil, fmt.Errorf("insert outbox event: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
 	}
+	v.reads.Wrote(p.UserID)
 
-	return tx.Commit(ctx)
+	return result, nil
 }
 
-func (v *Voting) validateBeforeMakeChoice(ctx context.Context, tx pgx.Tx, p *MakeChoiceParams) error {
-	if err := v.isFinished(ctx, tx, p); err != nil {
+// insertVotingEvent writes the event with the state of the voting just written by tx to the outbox,
+// it's routed to the tags of the voting and extraTags.
+func (v *Voting) insertVotingEvent(ctx context.Context, tx pgx.Tx, eventType entity.EventType, id uuid.UUID, extraTags []string) error {
+	item, err := v.getVoting(ctx, tx, id)
+	if err != nil {
+		return fmt.Errorf("get voting for event: %w", err)
+	}
+
+	event, err := votingEvent(eventType, item, extraTags)
+	if err != nil {
 		return err
 	}
 
-	return v.isUserVoted(ctx, tx, p)
+	if err = infrastructure.InsertOutboxEvent(ctx, tx, event); err != nil {
+		return fmt.Errorf("insert outbox event: %w", err)
+	}
+
+	return nil
+}
+
+// VotingPayload is the state of the voting carried by its events.
+func VotingPayload(item VotingItem) entity.VotingPayload {
+	payload := entity.VotingPayload{
+		ID:          item.ID,
+		Name:        item.Name,
+		Description: item.Description,
+		Tags:        item.Tags,
+		CreatedAt:   item.CreatedAt,
+		StartAt:     item.StartAt,
+		EndAt:       item.EndAt,
+	}
+	for _, invariance := range item.Invariance {
+		payload.Invariance = append(payload.Invariance, entity.InvarianceScorePayload{
+			ID:    invariance.ID,
+			Name:  invariance.Name,
+			Score: invariance.Score,
+		})
+		payload.Turnout += invariance.Score
+	}
+
+	return payload
+}
+
+// votingEvent is the event of the change of the voting with its state, it's routed to the tags of the voting
+// and extraTags, e.g. the previous tags of an updated voting.
+func votingEvent(eventType entity.EventType, item *VotingItem, extraTags []string) (entity.Event, error) {
+	tags := slices.Clone(item.Tags)
+	for _, tag := range extraTags {
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return entity.NewEvent(eventType, item.ID, tags, VotingPayload(*item))
+}
+
+// votingDeletedEvent is the event of the deleted voting, it carries no state.
+func votingDeletedEvent(item *VotingItem) (entity.Event, error) {
+	return entity.NewEvent(entity.EventVotingDeleted, item.ID, item.Tags, nil)
+}
+
+// votingClosedEvents are the events with the final results of the ended votings. The ID of the event
+// is derived from the voting, so the closed voting is announced once however many closers see it.
+func votingClosedEvents(items []VotingItem) ([]entity.Event, error) {
+	events := make([]entity.Event, 0, len(items))
+	for _, item := range items {
+		event, err := votingEvent(entity.EventVotingClosed, &item, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		event.ID = uuid.NewSHA1(uuid.NameSpaceOID, []byte(string(entity.EventVotingClosed)+":"+item.ID.String()))
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// voteCastEvent is the event of the counted choice.
+func voteCastEvent(p *MakeChoiceParams, result *MakeChoiceResult) (entity.Event, error) {
+	return entity.NewEvent(entity.EventVoteCast, result.VotingID, result.Tags, entity.VoteCastPayload{
+		InvarianceID: p.InvarianceID,
+		Score:        result.Score,
+		Turnout:      result.Turnout,
+	})
+}
+
+// InvarianceVoting returns the voting of the invariance, invariance of deleted votings are not found.
+// An invariance never moves to another voting, so a lagging replica may only miss a new one.
+func (v *Voting) InvarianceVoting(ctx context.Context, invarianceID uuid.UUID) (uuid.UUID, error) {
+	stmt, args, err := sq.Select("i.voting_id").
+		From("voting_invariance i").
+		Join("voting v ON v.id = i.voting_id").
+		Where(sq.Eq{"i.id": invarianceID, "v.deleted_at": nil}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("build statement: %w", err)
+	}
+
+	result, err := infrastructure.FetchRow[MakeChoiceResult](ctx, v.reads, stmt, args...)
+	if errors.Is(err, infrastructure.ErrObjectNotFound) {
+		return uuid.Nil, infrastructure.ErrInvarianceNotFound
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	return result.VotingID, nil
+}
+
+func (v *Voting) votingByInvariance(ctx context.Context, tx pgx.Tx, invarianceID uuid.UUID) (*MakeChoiceResult, error) {
+	stmt, args, err := sq.Select("i.voting_id", "v.tags").
+		From("voting_invariance i").
+		Join("voting v ON v.id = i.voting_id").
+		Where(sq.Eq{"i.id": invarianceID, "v.deleted_at": nil}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("build statement: %w", err)
+	}
+
+	result, err := infrastructure.FetchRow[MakeChoiceResult](ctx, tx, stmt, args...)
+	if errors.Is(err, infrastructure.ErrObjectNotFound) {
+		return nil, infrastructure.ErrInvarianceNotFound
+	}
+
+	return result, err
 }
 
 func (v *Voting) isFinished(ctx context.Context, tx pgx.Tx, p *MakeChoiceParams) error {
@@ -435,7 +800,8 @@ func (v *Voting) isFinished(ctx context.Context, tx pgx.Tx, p *MakeChoiceParams)
 		Where(
 			sq.And{
 				sq.Eq{"i.id": p.InvarianceID},
-				sq.Expr("v.ended_at <= current_timestamp"),
+				// Votes of archived votings have no partition to go to
+				sq.Expr("(v.ended_at <= current_timestamp OR v.archived_at IS NOT NULL)"),
 			},
 		)
 
@@ -451,57 +817,152 @@ func (v *Voting) isFinished(ctx context.Context, tx pgx.Tx, p *MakeChoiceParams)
 		return err
 	}
 	if status.Status {
-		return fmt.Errorf("voting is finished")
+		return infrastructure.ErrVotingFinished
 	}
 
 	return nil
 }
 
-func (v *Voting) isUserVoted(ctx context.Context, tx pgx.Tx, p *MakeChoiceParams) error {
-	cteBlock := sq.Select("i2.id").
-		From("voting_invariance i").
-		Join("voting_invariance i2 ON i.voting_id = i2.voting_id").
-		Where(sq.Eq{"i.id": p.InvarianceID})
-
-	cteBlock = cteBlock.Prefix("WITH invariances AS (").Suffix(")")
-
-	innerSelect := sq.Select("1").
-		From("voting_results r").
-		Join("invariances i on i.id = r.invariant_id").
-		Where(sq.Eq{"r.user_id": p.UserID}).
-		PrefixExpr(cteBlock)
-
-	mainQuery := innerSelect.Prefix("SELECT EXISTS(").Suffix(") AS status")
+func (v *Voting) makeChoice(ctx context.Context, tx pgx.Tx, votingID uuid.UUID, p *MakeChoiceParams) error {
+	insertBuilder := sq.Insert(tbVotingResults).
+		Columns("voting_id", "invariant_id", "user_id").
+		Values(votingID, p.InvarianceID, p.UserID).
+		Suffix("ON CONFLICT " + conflictOneVote + " DO NOTHING")
 
-	stmt, args, err := mainQuery.PlaceholderFormat(sq.Dollar).ToSql()
+	stmt, args, err := insertBuilder.PlaceholderFormat(sq.Dollar).ToSql()
 	if err != nil {
 		return fmt.Errorf("build statement: %w", err)
 	}
 
-	status, err := infrastructure.FetchRow[СheckExistsReult](ctx, tx, stmt, args...)
+	// Exec reports the errors, the rows of Query would hide them
+	tag, err := tx.Exec(ctx, stmt, args...)
 	if err != nil {
 		return err
 	}
-	if status.Status {
-		return fmt.Errorf("user already voted")
+	if tag.RowsAffected() == 0 {
+		return infrastructure.ErrAlreadyVoted
 	}
 
 	return nil
 }
 
-func (v *Voting) makeChoice(ctx context.Context, tx pgx.Tx, p *MakeChoiceParams) error {
-	insertBuilder := sq.Insert(tbVotingResults).
-		Columns("invariant_id", "user_id").
-		Values(p.InvarianceID, p.UserID)
+type invarianceScoreResult struct {
+	Score int64 `db:"score"`
+}
 
-	stmt, args, err := insertBuilder.PlaceholderFormat(sq.Dollar).ToSql()
+// incrementScore counts the vote in the counter of the invariance, it returns the score including the vote.
+func (v *Voting) incrementScore(ctx context.Context, tx pgx.Tx, votingID, invarianceID uuid.UUID) (int64, error) {
+	stmt, args, err := sq.Insert(tbVotingCounters).
+		Columns("invariance_id", "voting_id", "score").
+		Values(invarianceID, votingID, 1).
+		Suffix("ON CONFLICT (invariance_id) DO UPDATE SET score = " + tbVotingCounters + ".score + 1 RETURNING score").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
 	if err != nil {
-		return fmt.Errorf("build statement: %w", err)
+		return 0, fmt.Errorf("build statement: %w", err)
 	}
 
-	if err = infrastructure.Execute(ctx, tx, stmt, args...); err != nil {
-		return err
+	result, err := infrastructure.FetchRow[invarianceScoreResult](ctx, tx, stmt, args...)
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
+	return result.Score, nil
+}
+
+func (v *Voting) votingTurnout(ctx context.Context, tx pgx.Tx, votingID uuid.UUID) (int64, error) {
+	stmt, args, err := sq.Select("COALESCE(sum(score), 0)::BIGINT AS score").
+		From(tbVotingCounters).
+		Where(sq.Eq{"voting_id": votingID}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("build statement: %w", err)
+	}
+
+	result, err := infrastructure.FetchRow[invarianceScoreResult](ctx, tx, stmt, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.Score, nil
+}
+
+// CounterDrift is a counter which didn't match the votes.
+type CounterDrift struct {
+	InvarianceID uuid.UUID `db:"invariance_id"`
+	VotingID     uuid.UUID `db:"voting_id"`
+	// Counted is the number of votes
+	Counted int64 `db:"counted"`
+	// Stored is the value of the counter
+	Stored int64 `db:"stored"`
+}
+
+// Recount compares the counters of invariance with their votes, the drifted counters are rebuilt unless dryRun.
+// Votes wait for the recount, the counters are locked against them.
+func (v *Voting) Recount(ctx context.Context, dryRun bool) ([]*CounterDrift, error) {
+	tx, err := v.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, "LOCK TABLE "+tbVotingCounters+" IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return nil, fmt.Errorf("lock counters: %w", err)
+	}
+
+	// The votes of archived votings leave voting_results, their counters are the results and the recount
+	// leaves them alone. A voting is closed before its votes are moved, so a voting with votes in the archive
+	// is skipped even when the archive was interrupted; a vote in the archive is never taken for a drift.
+	counted := sq.Select("i.id AS invariance_id", "i.voting_id", "count(r.id) AS counted").
+		From(tbVotingInvariance + " i").
+		Join(tbVoting + " v ON v.id = i.voting_id").
+		LeftJoin(tbVotingResults + " r ON r.voting_id = i.voting_id AND r.invariant_id = i.id").
+		Where(sq.And{
+			sq.Eq{"v.archived_at": nil},
+			sq.Expr("NOT EXISTS (SELECT FROM " + tbVotingResultsArchive + " a WHERE a.voting_id = v.id)"),
+		}).
+		GroupBy("i.id")
+
+	stmt, args, err := sq.Select("n.invariance_id", "n.voting_id", "n.counted", "COALESCE(c.score, 0) AS stored").
+		FromSelect(counted, "n").
+		LeftJoin(tbVotingCounters+" c ON c.invariance_id = n.invariance_id").
+		Where("n.counted <> COALESCE(c.score, 0)").
+		OrderBy("n.voting_id", "n.invariance_id").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("build statement: %w", err)
+	}
+
+	drifts, err := infrastructure.FetchRows[CounterDrift](ctx, tx, stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("count votes: %w", err)
+	}
+
+	if dryRun || len(drifts) == 0 {
+		return drifts, nil
+	}
+
+	upsertBuilder := sq.Insert(tbVotingCounters).
+		Columns("invariance_id", "voting_id", "score").
+		Suffix("ON CONFLICT (invariance_id) DO UPDATE SET score = EXCLUDED.score")
+	for _, drift := range drifts {
+		upsertBuilder = upsertBuilder.Values(drift.InvarianceID, drift.VotingID, drift.Counted)
+	}
+
+	stmt, args, err = upsertBuilder.PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("build statement: %w", err)
+	}
+
+	if _, err = tx.Exec(ctx, stmt, args...); err != nil {
+		return nil, fmt.Errorf("rebuild counters: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return drifts, nil
 }
@@ -0,0 +1,294 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// MakeChoiceOutcome is the result of a single choice of the batch, Err is set when the choice is rejected.
+type MakeChoiceOutcome struct {
+	Result *MakeChoiceResult
+	Err    error
+}
+
+type batchInvariance struct {
+	InvarianceID uuid.UUID `db:"invariance_id"`
+	VotingID     uuid.UUID `db:"voting_id"`
+	Tags         []string  `db:"tags"`
+	Finished     bool      `db:"finished"`
+}
+
+type batchVoter struct {
+	VotingID uuid.UUID `db:"voting_id"`
+	UserID   uuid.UUID `db:"user_id"`
+}
+
+type batchScore struct {
+	InvarianceID uuid.UUID `db:"invariance_id"`
+	Score        int64     `db:"score"`
+}
+
+type batchTurnout struct {
+	VotingID uuid.UUID `db:"voting_id"`
+	Turnout  int64     `db:"turnout"`
+}
+
+const (
+	// insertBatchVotesSQL skips the votes of users who already voted, the returned voters are counted.
+	insertBatchVotesSQL = `INSERT INTO ` + tbVotingResults + ` (voting_id, invariant_id, user_id)
+SELECT * FROM unnest($1::uuid[], $2::uuid[], $3::uuid[])
+ON CONFLICT ` + conflictOneVote + ` DO NOTHING
+RETURNING voting_id, user_id`
+
+	incrementBatchScoresSQL = `INSERT INTO ` + tbVotingCounters + ` (invariance_id, voting_id, score)
+SELECT * FROM unnest($1::uuid[], $2::uuid[], $3::bigint[])
+ON CONFLICT (invariance_id) DO UPDATE SET score = ` + tbVotingCounters + `.score + EXCLUDED.score
+RETURNING invariance_id, score`
+)
+
+// MakeChoices makes the choices by one transaction with a constant number of statements, whatever the size
+// of the batch. Every choice gets its own outcome with the same errors as MakeChoice, the error is returned
+// when the whole batch failed. The first choice of a user in the batch wins, the rest are already voted.
+func (v *Voting) MakeChoices(ctx context.Context, params []*MakeChoiceParams) ([]MakeChoiceOutcome, error) {
+	outcomes := make([]MakeChoiceOutcome, len(params))
+	if len(params) == 0 {
+		return outcomes, nil
+	}
+
+	tx, err := v.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	invariances, err := v.batchInvariances(ctx, tx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Choices which may be counted, in the order of the batch
+	var accepted []int
+	seen := make(map[batchVoter]struct{}, len(params))
+	for i, p := range params {
+		invariance, ok := invariances[p.InvarianceID]
+		switch {
+		case !ok:
+			outcomes[i].Err = infrastructure.ErrInvarianceNotFound
+		case invariance.Finished:
+			outcomes[i].Err = infrastructure.ErrVotingFinished
+		default:
+			voter := batchVoter{VotingID: invariance.VotingID, UserID: p.UserID}
+			if _, ok = seen[voter]; ok {
+				outcomes[i].Err = infrastructure.ErrAlreadyVoted
+				continue
+			}
+			seen[voter] = struct{}{}
+			accepted = append(accepted, i)
+		}
+	}
+
+	counted, err := v.insertBatchVotes(ctx, tx, params, invariances, accepted)
+	if err != nil {
+		return nil, err
+	}
+
+	accepted = slices.DeleteFunc(accepted, func(i int) bool {
+		voter := batchVoter{VotingID: invariances[params[i].InvarianceID].VotingID, UserID: params[i].UserID}
+		if _, ok := counted[voter]; ok {
+			return false
+		}
+		outcomes[i].Err = infrastructure.ErrAlreadyVoted
+		return true
+	})
+	if len(accepted) == 0 {
+		return outcomes, tx.Commit(ctx)
+	}
+
+	if err = v.countBatchVotes(ctx, tx, params, invariances, accepted, outcomes); err != nil {
+		return nil, err
+	}
+
+	// The events are committed together with the choices, the outbox relay publishes them
+	events := make([]entity.Event, 0, len(accepted))
+	for _, i := range accepted {
+		event, err := voteCastEvent(params[i], outcomes[i].Result)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	if err = infrastructure.InsertOutboxEvents(ctx, tx, events); err != nil {
+		return nil, fmt.Errorf("insert outbox events: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	for _, i := range accepted {
+		v.reads.Wrote(params[i].UserID)
+	}
+
+	return outcomes, nil
+}
+
+// batchInvariances returns the invariances of not deleted votings by their ids.
+func (v *Voting) batchInvariances(ctx context.Context, tx pgx.Tx, params []*MakeChoiceParams) (map[uuid.UUID]*batchInvariance, error) {
+	ids := make([]string, 0, len(params))
+	for _, p := range params {
+		ids = append(ids, p.InvarianceID.String())
+	}
+
+	stmt, args, err := sq.Select(
+		"i.id AS invariance_id", "i.voting_id", "v.tags",
+		"(v.ended_at <= current_timestamp OR v.archived_at IS NOT NULL) AS finished",
+	).
+		From(tbVotingInvariance+" i").
+		Join(tbVoting+" v ON v.id = i.voting_id").
+		Where("i.id = ANY(?::uuid[])", ids).
+		Where(sq.Eq{"v.deleted_at": nil}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("build statement: %w", err)
+	}
+
+	rows, err := infrastructure.FetchRows[batchInvariance](ctx, tx, stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("fetch invariances: %w", err)
+	}
+
+	invariances := make(map[uuid.UUID]*batchInvariance, len(rows))
+	for _, row := range rows {
+		invariances[row.InvarianceID] = row
+	}
+
+	return invariances, nil
+}
+
+// insertBatchVotes inserts the accepted choices, it returns the voters whose votes are counted.
+// Rows are inserted in the order of the unique key, concurrent batches lock them in the same order.
+func (v *Voting) insertBatchVotes(
+	ctx context.Context, tx pgx.Tx, params []*MakeChoiceParams, invariances map[uuid.UUID]*batchInvariance, accepted []int,
+) (map[batchVoter]struct{}, error) {
+	ordered := slices.Clone(accepted)
+	slices.SortFunc(ordered, func(a, b int) int {
+		votingA, votingB := invariances[params[a].InvarianceID].VotingID, invariances[params[b].InvarianceID].VotingID
+		if c := bytes.Compare(votingA[:], votingB[:]); c != 0 {
+			return c
+		}
+		return bytes.Compare(params[a].UserID[:], params[b].UserID[:])
+	})
+
+	votingIDs := make([]string, 0, len(ordered))
+	invarianceIDs := make([]string, 0, len(ordered))
+	userIDs := make([]string, 0, len(ordered))
+	for _, i := range ordered {
+		votingIDs = append(votingIDs, invariances[params[i].InvarianceID].VotingID.String())
+		invarianceIDs = append(invarianceIDs, params[i].InvarianceID.String())
+		userIDs = append(userIDs, params[i].UserID.String())
+	}
+
+	rows, err := infrastructure.FetchRows[batchVoter](ctx, tx, insertBatchVotesSQL, votingIDs, invarianceIDs, userIDs)
+	if err != nil {
+		return nil, fmt.Errorf("insert votes: %w", err)
+	}
+
+	counted := make(map[batchVoter]struct{}, len(rows))
+	for _, row := range rows {
+		counted[*row] = struct{}{}
+	}
+
+	return counted, nil
+}
+
+// countBatchVotes increments the counters by the counted choices and sets their results. Every choice gets
+// the score and the turnout including the choices before it in the batch, as if they were made one by one.
+func (v *Voting) countBatchVotes(
+	ctx context.Context, tx pgx.Tx, params []*MakeChoiceParams, invariances map[uuid.UUID]*batchInvariance,
+	accepted []int, outcomes []MakeChoiceOutcome,
+) error {
+	increments := make(map[uuid.UUID]int64)
+	votes := make(map[uuid.UUID]int64)
+	for _, i := range accepted {
+		increments[params[i].InvarianceID]++
+		votes[invariances[params[i].InvarianceID].VotingID]++
+	}
+
+	// Counters are locked in the order of their key, concurrent batches don't deadlock
+	ids := make([]uuid.UUID, 0, len(increments))
+	for id := range increments {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b uuid.UUID) int {
+		return bytes.Compare(a[:], b[:])
+	})
+
+	invarianceIDs := make([]string, 0, len(ids))
+	votingIDs := make([]string, 0, len(ids))
+	counts := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		invarianceIDs = append(invarianceIDs, id.String())
+		votingIDs = append(votingIDs, invariances[id].VotingID.String())
+		counts = append(counts, increments[id])
+	}
+
+	scoreRows, err := infrastructure.FetchRows[batchScore](ctx, tx, incrementBatchScoresSQL, invarianceIDs, votingIDs, counts)
+	if err != nil {
+		return fmt.Errorf("increment counters: %w", err)
+	}
+
+	batchVotingIDs := make([]string, 0, len(votes))
+	for id := range votes {
+		batchVotingIDs = append(batchVotingIDs, id.String())
+	}
+
+	stmt, args, err := sq.Select("voting_id", "COALESCE(sum(score), 0)::BIGINT AS turnout").
+		From(tbVotingCounters).
+		Where("voting_id = ANY(?::uuid[])", batchVotingIDs).
+		GroupBy("voting_id").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("build statement: %w", err)
+	}
+
+	turnoutRows, err := infrastructure.FetchRows[batchTurnout](ctx, tx, stmt, args...)
+	if err != nil {
+		return fmt.Errorf("fetch turnout: %w", err)
+	}
+
+	// The scores before the batch, every choice adds one
+	scores := make(map[uuid.UUID]int64, len(scoreRows))
+	for _, row := range scoreRows {
+		scores[row.InvarianceID] = row.Score - increments[row.InvarianceID]
+	}
+	turnouts := make(map[uuid.UUID]int64, len(turnoutRows))
+	for _, row := range turnoutRows {
+		turnouts[row.VotingID] = row.Turnout - votes[row.VotingID]
+	}
+
+	for _, i := range accepted {
+		invariance := invariances[params[i].InvarianceID]
+		scores[invariance.InvarianceID]++
+		turnouts[invariance.VotingID]++
+
+		outcomes[i].Result = &MakeChoiceResult{
+			VotingID: invariance.VotingID,
+			Tags:     invariance.Tags,
+			Score:    scores[invariance.InvarianceID],
+			Turnout:  turnouts[invariance.VotingID],
+		}
+	}
+
+	return nil
+}
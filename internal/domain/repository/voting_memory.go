@@ -0,0 +1,426 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+// memoryVoting is a voting without its scores, DeleteVoting removes it for good as Voting does.
+type memoryVoting struct {
+	item VotingItem
+}
+
+type memoryInvariance struct {
+	id       uuid.UUID
+	votingID uuid.UUID
+	name     string
+	score    int64
+}
+
+type memoryVoter struct {
+	votingID uuid.UUID
+	userID   uuid.UUID
+}
+
+// MemoryVoting keeps votings of a single instance with the semantics of Voting, the data is lost on restart.
+// The events are written to the outbox with the change like Voting does. Recount and Archive are left to Voting,
+// the counters can't drift in memory.
+type MemoryVoting struct {
+	outbox *infrastructure.MemoryOutboxStore
+	now    func() time.Time
+
+	mu          sync.Mutex
+	votings     map[uuid.UUID]*memoryVoting
+	invariances map[uuid.UUID]*memoryInvariance
+	// votes are the chosen invariance of every voter
+	votes map[memoryVoter]uuid.UUID
+	// closerCheckedAt is zero until the closer runs
+	closerCheckedAt time.Time
+}
+
+func NewMemoryVoting(outbox *infrastructure.MemoryOutboxStore) *MemoryVoting {
+	return &MemoryVoting{
+		outbox:      outbox,
+		now:         time.Now,
+		votings:     make(map[uuid.UUID]*memoryVoting),
+		invariances: make(map[uuid.UUID]*memoryInvariance),
+		votes:       make(map[memoryVoter]uuid.UUID),
+	}
+}
+
+// errVotingNotFound is the error of Voting for updates and deletes of a missing voting.
+var errVotingNotFound = errors.New("voting not found")
+
+func (m *MemoryVoting) List(_ context.Context, r *ListVotingRequest) (*ListVotingResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	items := m.selectVotings(func(*memoryVoting) bool {
+		return true
+	})
+
+	// Like Voting, the limit and the offset count the rows of invariance, a voting without invariance is a row too
+	return &ListVotingResponse{
+		Items: pageVotingRows(items, r.Limit, r.Offset),
+	}, nil
+}
+
+func (m *MemoryVoting) GetVoting(_ context.Context, r *GetVotingRequest) (*VotingItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	items := m.selectVotings(func(voting *memoryVoting) bool {
+		return voting.item.ID == r.ID
+	})
+	if len(items) == 0 {
+		return nil, infrastructure.ErrObjectNotFound
+	}
+
+	return &items[0], nil
+}
+
+func (m *MemoryVoting) ListEnded(_ context.Context, r *ListEndedRequest) (*ListVotingResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return &ListVotingResponse{
+		Items: m.selectEnded(r),
+	}, nil
+}
+
+func (m *MemoryVoting) selectEnded(r *ListEndedRequest) []VotingItem {
+	return m.selectVotings(func(voting *memoryVoting) bool {
+		return voting.item.EndAt.After(r.From) && !voting.item.EndAt.After(r.To)
+	})
+}
+
+func (m *MemoryVoting) CloseEnded(_ context.Context, r *ListEndedRequest) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	items := m.selectEnded(r)
+	events, err := votingClosedEvents(items)
+	if err != nil {
+		return 0, err
+	}
+	m.outbox.Add(events...)
+
+	if r.To.After(m.closerCheckedAt) {
+		m.closerCheckedAt = r.To
+	}
+
+	return len(items), nil
+}
+
+// votingItem returns a copy of the voting with its scores, the voting must exist.
+func (m *MemoryVoting) votingItem(id uuid.UUID) *VotingItem {
+	items := m.selectVotings(func(voting *memoryVoting) bool {
+		return voting.item.ID == id
+	})
+
+	return &items[0]
+}
+
+// addVotingEvent writes the event with the state of the voting to the outbox.
+func (m *MemoryVoting) addVotingEvent(eventType entity.EventType, id uuid.UUID, extraTags []string) error {
+	event, err := votingEvent(eventType, m.votingItem(id), extraTags)
+	if err != nil {
+		return err
+	}
+	m.outbox.Add(event)
+
+	return nil
+}
+
+// selectVotings returns copies of the matching votings with their scores, ordered by name and id,
+// their invariance ordered by name.
+func (m *MemoryVoting) selectVotings(match func(voting *memoryVoting) bool) []VotingItem {
+	var items []VotingItem
+	for _, voting := range m.votings {
+		if !match(voting) {
+			continue
+		}
+
+		item := voting.item
+		item.Tags = slices.Clone(item.Tags)
+		item.Invariance = nil
+		for _, invariance := range m.invariances {
+			if invariance.votingID == item.ID {
+				item.Invariance = append(item.Invariance, InvarianceScore{
+					ID:    invariance.id,
+					Name:  invariance.name,
+					Score: invariance.score,
+				})
+			}
+		}
+		slices.SortFunc(item.Invariance, func(a, b InvarianceScore) int {
+			if c := strings.Compare(a.Name, b.Name); c != 0 {
+				return c
+			}
+			return strings.Compare(a.ID.String(), b.ID.String())
+		})
+
+		items = append(items, item)
+	}
+
+	slices.SortFunc(items, func(a, b VotingItem) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID.String(), b.ID.String())
+	})
+
+	return items
+}
+
+// pageVotingRows skips offset rows and keeps up to limit rows, zero values don't limit.
+func pageVotingRows(items []VotingItem, limit, offset int64) []VotingItem {
+	var (
+		paged []VotingItem
+		row   int64
+	)
+	for _, item := range items {
+		rows := item.Invariance
+		if len(rows) == 0 {
+			rows = []InvarianceScore{{}}
+		}
+
+		kept := item
+		kept.Invariance = nil
+		var keep bool
+		for _, invariance := range rows {
+			if row >= offset && (limit <= 0 || row < offset+limit) {
+				keep = true
+				if invariance.ID != uuid.Nil {
+					kept.Invariance = append(kept.Invariance, invariance)
+				}
+			}
+			row++
+		}
+		if keep {
+			paged = append(paged, kept)
+		}
+	}
+
+	return paged
+}
+
+func (m *MemoryVoting) CloserCheckedAt(_ context.Context) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closerCheckedAt.IsZero() {
+		return time.Time{}, infrastructure.ErrObjectNotFound
+	}
+
+	return m.closerCheckedAt, nil
+}
+
+func (m *MemoryVoting) InvarianceVoting(_ context.Context, invarianceID uuid.UUID) (uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invariance, ok := m.invariances[invarianceID]
+	if !ok {
+		return uuid.Nil, infrastructure.ErrInvarianceNotFound
+	}
+
+	return invariance.votingID, nil
+}
+
+func (m *MemoryVoting) CreateVoting(_ context.Context, p *CreateVotingParams) (*CreateVotingResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := uuid.New()
+	m.votings[id] = &memoryVoting{
+		item: VotingItem{
+			ID:          id,
+			Name:        p.Name,
+			Description: p.Description,
+			Tags:        slices.Clone(nonNilTags(p.Tags)),
+			CreatedAt:   m.now().UTC(),
+			StartAt:     p.StartAt,
+			EndAt:       p.EndAt,
+		},
+	}
+	m.addInvariance(id, p.Invariance)
+
+	if err := m.addVotingEvent(entity.EventVotingCreated, id, nil); err != nil {
+		return nil, err
+	}
+
+	return &CreateVotingResult{
+		ID: id,
+	}, nil
+}
+
+func (m *MemoryVoting) addInvariance(votingID uuid.UUID, names []string) {
+	for _, name := range names {
+		id := uuid.New()
+		m.invariances[id] = &memoryInvariance{
+			id:       id,
+			votingID: votingID,
+			name:     name,
+		}
+	}
+}
+
+// deleteInvariance deletes the invariance of the voting with their votes.
+func (m *MemoryVoting) deleteInvariance(votingID uuid.UUID) {
+	for id, invariance := range m.invariances {
+		if invariance.votingID == votingID {
+			delete(m.invariances, id)
+		}
+	}
+	for voter := range m.votes {
+		if voter.votingID == votingID {
+			delete(m.votes, voter)
+		}
+	}
+}
+
+func (m *MemoryVoting) UpdateVoting(_ context.Context, p *UpdateVotingParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	voting, ok := m.votings[p.ID]
+	if !ok {
+		return fmt.Errorf("validate update voting: %w", errVotingNotFound)
+	}
+	previousTags := voting.item.Tags
+
+	if p.Name != nil && *p.Name != "" {
+		voting.item.Name = *p.Name
+	}
+
+	if p.Description != nil && *p.Description != "" {
+		voting.item.Description = *p.Description
+	}
+
+	if p.Tags != nil {
+		voting.item.Tags = slices.Clone(p.Tags)
+	}
+
+	if p.StartAt != nil && !p.StartAt.IsZero() {
+		voting.item.StartAt = *p.StartAt
+	}
+
+	if p.EndAt != nil && !p.EndAt.IsZero() {
+		voting.item.EndAt = *p.EndAt
+	}
+
+	// New invariance replace the old ones, their votes are deleted
+	if len(p.Invariance) > 0 {
+		m.deleteInvariance(p.ID)
+		m.addInvariance(p.ID, p.Invariance)
+	}
+
+	return m.addVotingEvent(entity.EventVotingUpdated, p.ID, previousTags)
+}
+
+func (m *MemoryVoting) DeleteVoting(_ context.Context, p *DeleteVotingParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.votings[p.ID]; !ok {
+		return errVotingNotFound
+	}
+
+	event, err := votingDeletedEvent(m.votingItem(p.ID))
+	if err != nil {
+		return err
+	}
+
+	m.deleteInvariance(p.ID)
+	delete(m.votings, p.ID)
+	m.outbox.Add(event)
+
+	return nil
+}
+
+func (m *MemoryVoting) MakeChoice(_ context.Context, p *MakeChoiceParams) (*MakeChoiceResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result, err := m.makeChoice(p)
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := voteCastEvent(p, result)
+	if err != nil {
+		return nil, err
+	}
+	m.outbox.Add(event)
+
+	return result, nil
+}
+
+func (m *MemoryVoting) MakeChoices(_ context.Context, params []*MakeChoiceParams) ([]MakeChoiceOutcome, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	outcomes := make([]MakeChoiceOutcome, len(params))
+	events := make([]entity.Event, 0, len(params))
+	for i, p := range params {
+		result, err := m.makeChoice(p)
+		if err != nil {
+			outcomes[i].Err = err
+			continue
+		}
+
+		event, err := voteCastEvent(p, result)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+		outcomes[i].Result = result
+	}
+	m.outbox.Add(events...)
+
+	return outcomes, nil
+}
+
+func (m *MemoryVoting) makeChoice(p *MakeChoiceParams) (*MakeChoiceResult, error) {
+	invariance, ok := m.invariances[p.InvarianceID]
+	if !ok {
+		return nil, infrastructure.ErrInvarianceNotFound
+	}
+	voting := m.votings[invariance.votingID]
+
+	// A zero end is finished, as 0001-01-01 stored by Voting and SQLiteVoting
+	if !voting.item.EndAt.After(m.now()) {
+		return nil, infrastructure.ErrVotingFinished
+	}
+
+	voter := memoryVoter{votingID: voting.item.ID, userID: p.UserID}
+	if _, ok = m.votes[voter]; ok {
+		return nil, infrastructure.ErrAlreadyVoted
+	}
+	m.votes[voter] = invariance.id
+	invariance.score++
+
+	var turnout int64
+	for _, other := range m.invariances {
+		if other.votingID == voting.item.ID {
+			turnout += other.score
+		}
+	}
+
+	return &MakeChoiceResult{
+		VotingID: voting.item.ID,
+		Tags:     slices.Clone(voting.item.Tags),
+		Score:    invariance.score,
+		Turnout:  turnout,
+	}, nil
+}
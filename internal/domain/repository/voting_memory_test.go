@@ -0,0 +1,214 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+func createMemoryVoting(t *testing.T, repo *MemoryVoting, name string, endAt time.Time, invariance ...string) *VotingItem {
+	t.Helper()
+	ctx := context.Background()
+
+	created, err := repo.CreateVoting(ctx, &CreateVotingParams{
+		Name:       name,
+		StartAt:    time.Now().Add(-time.Hour),
+		EndAt:      endAt,
+		Invariance: invariance,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	item, err := repo.GetVoting(ctx, &GetVotingRequest{ID: created.ID})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	return item
+}
+
+// claimEvents claims the pending events of the outbox of the given type.
+func claimEvents(t *testing.T, outbox infrastructure.OutboxStore, eventType entity.EventType) []entity.Event {
+	t.Helper()
+
+	var claimed []entity.Event
+	if _, err := outbox.Claim(context.Background(), 100, func(_ context.Context, events []entity.Event) error {
+		for _, event := range events {
+			if event.Type == eventType {
+				claimed = append(claimed, event)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	return claimed
+}
+
+func TestMemoryVotingMakeChoice(t *testing.T) {
+	outbox := infrastructure.NewMemoryOutboxStore()
+	repo := NewMemoryVoting(outbox)
+	ctx := context.Background()
+
+	open := createMemoryVoting(t, repo, "open", time.Now().Add(time.Hour), "yes", "no")
+	finished := createMemoryVoting(t, repo, "finished", time.Now().Add(-time.Minute), "yes")
+	noEnd := createMemoryVoting(t, repo, "no end", time.Time{}, "yes")
+	user := uuid.New()
+
+	result, err := repo.MakeChoice(ctx, &MakeChoiceParams{InvarianceID: open.Invariance[1].ID, UserID: user})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.VotingID != open.ID || result.Score != 1 || result.Turnout != 1 {
+		t.Errorf("Expected the score 1 and turnout 1 of the open voting, got %+v", result)
+	}
+
+	tests := []struct {
+		name   string
+		params *MakeChoiceParams
+		err    error
+	}{
+		{name: "already voted", params: &MakeChoiceParams{InvarianceID: open.Invariance[0].ID, UserID: user}, err: infrastructure.ErrAlreadyVoted},
+		{name: "finished", params: &MakeChoiceParams{InvarianceID: finished.Invariance[0].ID, UserID: user}, err: infrastructure.ErrVotingFinished},
+		{name: "zero end", params: &MakeChoiceParams{InvarianceID: noEnd.Invariance[0].ID, UserID: user}, err: infrastructure.ErrVotingFinished},
+		{name: "unknown invariance", params: &MakeChoiceParams{InvarianceID: uuid.New(), UserID: user}, err: infrastructure.ErrInvarianceNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := repo.MakeChoice(ctx, tt.params); !errors.Is(err, tt.err) {
+				t.Errorf("Expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	if cast := claimEvents(t, outbox, entity.EventVoteCast); len(cast) != 1 {
+		t.Errorf("Expected one vote.cast in the outbox, got %d", len(cast))
+	}
+}
+
+func TestMemoryVotingListOrderAndPaging(t *testing.T) {
+	repo := NewMemoryVoting(infrastructure.NewMemoryOutboxStore())
+	end := time.Now().Add(time.Hour)
+
+	b := createMemoryVoting(t, repo, "b", end, "z", "a")
+	a := createMemoryVoting(t, repo, "a", end)
+	c := createMemoryVoting(t, repo, "c", end, "one")
+
+	list, err := repo.List(context.Background(), &ListVotingRequest{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(list.Items) != 3 || list.Items[0].ID != a.ID || list.Items[1].ID != b.ID || list.Items[2].ID != c.ID {
+		t.Fatalf("Expected the votings ordered by name, got %+v", list.Items)
+	}
+	if names := list.Items[1].Invariance; names[0].Name != "a" || names[1].Name != "z" {
+		t.Errorf("Expected the invariance ordered by name, got %+v", names)
+	}
+
+	// As with Voting, the limit counts the rows of invariance: a, b/a, b/z, c/one
+	paged, err := repo.List(context.Background(), &ListVotingRequest{Limit: 2, Offset: 1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(paged.Items) != 1 || paged.Items[0].ID != b.ID || len(paged.Items[0].Invariance) != 2 {
+		t.Errorf("Expected the rows of b only, got %+v", paged.Items)
+	}
+}
+
+func TestMemoryVotingUpdateAndDelete(t *testing.T) {
+	repo := NewMemoryVoting(infrastructure.NewMemoryOutboxStore())
+	ctx := context.Background()
+
+	voting := createMemoryVoting(t, repo, "voting", time.Now().Add(time.Hour), "yes", "no")
+	user := uuid.New()
+	if _, err := repo.MakeChoice(ctx, &MakeChoiceParams{InvarianceID: voting.Invariance[0].ID, UserID: user}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// New invariance replace the old ones with their votes, the user votes again
+	name := "renamed"
+	if err := repo.UpdateVoting(ctx, &UpdateVotingParams{ID: voting.ID, Name: &name, Invariance: []string{"maybe"}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	updated, err := repo.GetVoting(ctx, &GetVotingRequest{ID: voting.ID})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if updated.Name != name || len(updated.Invariance) != 1 || updated.Invariance[0].Score != 0 {
+		t.Fatalf("Expected the renamed voting with a new invariance, got %+v", updated)
+	}
+	if _, err = repo.MakeChoice(ctx, &MakeChoiceParams{InvarianceID: updated.Invariance[0].ID, UserID: user}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err = repo.DeleteVoting(ctx, &DeleteVotingParams{ID: voting.ID}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err = repo.GetVoting(ctx, &GetVotingRequest{ID: voting.ID}); !errors.Is(err, infrastructure.ErrObjectNotFound) {
+		t.Errorf("Expected %v, got %v", infrastructure.ErrObjectNotFound, err)
+	}
+	if err = repo.DeleteVoting(ctx, &DeleteVotingParams{ID: voting.ID}); err == nil {
+		t.Errorf("Expected an error for the deleted voting")
+	}
+}
+
+func TestMemoryVotingMakeChoicesOutcomes(t *testing.T) {
+	repo := NewMemoryVoting(infrastructure.NewMemoryOutboxStore())
+	voting := createMemoryVoting(t, repo, "voting", time.Now().Add(time.Hour), "yes", "no")
+	first, second := uuid.New(), uuid.New()
+
+	outcomes, err := repo.MakeChoices(context.Background(), []*MakeChoiceParams{
+		{InvarianceID: voting.Invariance[0].ID, UserID: first},
+		{InvarianceID: voting.Invariance[1].ID, UserID: first},
+		{InvarianceID: uuid.New(), UserID: second},
+		{InvarianceID: voting.Invariance[0].ID, UserID: second},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if outcomes[0].Err != nil || !errors.Is(outcomes[1].Err, infrastructure.ErrAlreadyVoted) ||
+		!errors.Is(outcomes[2].Err, infrastructure.ErrInvarianceNotFound) || outcomes[3].Err != nil {
+		t.Fatalf("Unexpected outcomes: %+v", outcomes)
+	}
+	if outcomes[3].Result.Score != 2 || outcomes[3].Result.Turnout != 2 {
+		t.Errorf("Expected the score 2 and turnout 2, got %+v", outcomes[3].Result)
+	}
+}
+
+func TestMemoryVotingWritesVotingEvents(t *testing.T) {
+	outbox := infrastructure.NewMemoryOutboxStore()
+	repo := NewMemoryVoting(outbox)
+	ctx := context.Background()
+
+	created, err := repo.CreateVoting(ctx, &CreateVotingParams{Name: "voting", Tags: []string{"old"}, EndAt: time.Now().Add(time.Hour), Invariance: []string{"yes"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if events := claimEvents(t, outbox, entity.EventVotingCreated); len(events) != 1 || events[0].VotingID != created.ID {
+		t.Errorf("Expected voting.created of the voting, got %+v", events)
+	}
+
+	// Subscribers of the previous tags get voting.updated too
+	if err = repo.UpdateVoting(ctx, &UpdateVotingParams{ID: created.ID, Tags: []string{"new"}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	updated := claimEvents(t, outbox, entity.EventVotingUpdated)
+	if len(updated) != 1 || len(updated[0].Tags) != 2 || updated[0].Tags[0] != "new" || updated[0].Tags[1] != "old" {
+		t.Errorf("Expected voting.updated routed to the new and the old tags, got %+v", updated)
+	}
+
+	if err = repo.DeleteVoting(ctx, &DeleteVotingParams{ID: created.ID}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if deleted := claimEvents(t, outbox, entity.EventVotingDeleted); len(deleted) != 1 || deleted[0].Tags[0] != "new" {
+		t.Errorf("Expected voting.deleted routed to the tags of the voting, got %+v", deleted)
+	}
+}
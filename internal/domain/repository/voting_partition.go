@@ -0,0 +1,212 @@
+package repository
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+const tbVotingResultsArchive = "voting_results_archive"
+
+// resultsPartition is the partition of voting_results holding the votes of the voting.
+func resultsPartition(votingID uuid.UUID) string {
+	return tbVotingResults + "_" + hex.EncodeToString(votingID[:])
+}
+
+// partitionName is resultsPartition in SQL, col is the column of the voting id.
+func partitionName(col string) string {
+	return "'" + tbVotingResults + "_' || replace(" + col + "::text, '-', '')"
+}
+
+// createResultsPartition creates the partition of the votes of the new voting. The empty table is attached,
+// so votes of other votings keep going, creating it as a partition would lock voting_results exclusively.
+// The foreign key of the partition holds off the writes of invariance of other votings until the commit.
+func (v *Voting) createResultsPartition(ctx context.Context, tx pgx.Tx, votingID uuid.UUID) error {
+	partition := pgx.Identifier{resultsPartition(votingID)}.Sanitize()
+
+	if _, err := tx.Exec(ctx, "CREATE TABLE "+partition+" (LIKE "+tbVotingResults+" INCLUDING DEFAULTS)"); err != nil {
+		return fmt.Errorf("create partition: %w", err)
+	}
+
+	// DDL takes no parameters, the value is the canonical form of the UUID
+	stmt := "ALTER TABLE " + tbVotingResults + " ATTACH PARTITION " + partition + " FOR VALUES IN ('" + votingID.String() + "')"
+	if _, err := tx.Exec(ctx, stmt); err != nil {
+		return fmt.Errorf("attach partition: %w", err)
+	}
+
+	return nil
+}
+
+type archiveCandidate struct {
+	ID uuid.UUID `db:"id"`
+}
+
+// Archive closes the votings ended before endedBefore and moves the partitions of their votes to
+// voting_results_archive. Their results stay readable from the counters, the archive keeps the votes
+// until they're dumped and dropped. The votings of an interrupted run are finished by the next one,
+// the archived votings are returned with the first error.
+func (v *Voting) Archive(ctx context.Context, endedBefore time.Time) ([]uuid.UUID, error) {
+	stmt, args, err := sq.Select("id").
+		From(tbVoting).
+		Where(sq.And{
+			sq.Lt{"ended_at": endedBefore},
+			sq.Or{
+				sq.Eq{"archived_at": nil},
+				// Closed by an interrupted run, the partition isn't in the archive yet
+				sq.Expr("to_regclass(" + partitionName("id") + ") IS NOT NULL AND " +
+					"NOT EXISTS (SELECT FROM pg_inherits WHERE inhrelid = to_regclass(" + partitionName("id") + ") " +
+					"AND inhparent = to_regclass('" + tbVotingResultsArchive + "'))"),
+			},
+		}).
+		OrderBy("ended_at", "id").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("build statement: %w", err)
+	}
+
+	candidates, err := infrastructure.FetchRows[archiveCandidate](ctx, v.db, stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("fetch votings to archive: %w", err)
+	}
+
+	archived := make([]uuid.UUID, 0, len(candidates))
+	for _, candidate := range candidates {
+		if err = v.archiveVoting(ctx, candidate.ID); err != nil {
+			return archived, fmt.Errorf("archive voting %s: %w", candidate.ID, err)
+		}
+		archived = append(archived, candidate.ID)
+	}
+
+	return archived, nil
+}
+
+// archiveVoting closes the voting first, so no vote goes to the partition while it's moved.
+func (v *Voting) archiveVoting(ctx context.Context, votingID uuid.UUID) error {
+	stmt, args, err := sq.Update(tbVoting).
+		Set("archived_at", sq.Expr("current_timestamp")).
+		Where(sq.Eq{"id": votingID, "archived_at": nil}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("build statement: %w", err)
+	}
+
+	if _, err = v.db.Exec(ctx, stmt, args...); err != nil {
+		return fmt.Errorf("mark archived: %w", err)
+	}
+
+	parent, err := v.detachResultsPartition(ctx, votingID)
+	if err != nil {
+		return err
+	}
+
+	// A voting may have no partition, e.g. when it was dropped by hand
+	switch parent {
+	case partitionMissing, tbVotingResultsArchive:
+		return nil
+	}
+
+	// Detaching concurrently left the partition constraint as a check, attaching doesn't scan the votes
+	partition := pgx.Identifier{resultsPartition(votingID)}.Sanitize()
+	stmt = "ALTER TABLE " + tbVotingResultsArchive + " ATTACH PARTITION " + partition + " FOR VALUES IN ('" + votingID.String() + "')"
+	if _, err = v.db.Exec(ctx, stmt); err != nil {
+		return fmt.Errorf("attach partition to archive: %w", err)
+	}
+
+	return nil
+}
+
+const (
+	// partitionMissing is the parent of a partition which doesn't exist
+	partitionMissing = "missing"
+	// partitionDetached is the parent of a detached partition
+	partitionDetached = "detached"
+)
+
+type partitionParent struct {
+	Parent  string `db:"parent"`
+	Pending bool   `db:"pending"`
+}
+
+// detachResultsPartition detaches the partition of the votes of the voting from voting_results concurrently,
+// votes of other votings keep going. A detach interrupted before is finalized. It returns the parent
+// the partition was left with: partitionDetached, voting_results_archive or partitionMissing.
+func (v *Voting) detachResultsPartition(ctx context.Context, votingID uuid.UUID) (string, error) {
+	status, err := infrastructure.FetchRow[partitionParent](ctx, v.db,
+		"SELECT CASE WHEN to_regclass($1) IS NULL THEN '"+partitionMissing+"' "+
+			"ELSE COALESCE((SELECT inhparent::regclass::text FROM pg_inherits WHERE inhrelid = to_regclass($1)), '"+partitionDetached+"') END AS parent, "+
+			"COALESCE((SELECT inhdetachpending FROM pg_inherits WHERE inhrelid = to_regclass($1)), FALSE) AS pending",
+		resultsPartition(votingID),
+	)
+	if err != nil {
+		return "", fmt.Errorf("check partition: %w", err)
+	}
+
+	if status.Parent != tbVotingResults {
+		return status.Parent, nil
+	}
+
+	// Detaching concurrently can't run in a transaction, it waits for the running votes instead of blocking them
+	partition := pgx.Identifier{resultsPartition(votingID)}.Sanitize()
+	mode := " CONCURRENTLY"
+	if status.Pending {
+		mode = " FINALIZE"
+	}
+	if _, err = v.db.Exec(ctx, "ALTER TABLE "+tbVotingResults+" DETACH PARTITION "+partition+mode); err != nil {
+		return "", fmt.Errorf("detach partition: %w", err)
+	}
+
+	return partitionDetached, nil
+}
+
+type orphanPartition struct {
+	Name    string `db:"name"`
+	Parent  string `db:"parent"`
+	Pending bool   `db:"pending"`
+}
+
+// DropDeletedPartitions drops the partitions of votes of the deleted votings, their votes are already deleted
+// with the voting. A partition of voting_results is detached concurrently before, dropping it attached would lock
+// voting_results exclusively. The archive isn't read by the service, its partitions are dropped at once. The dropped partitions are returned with the first error.
+func (v *Voting) DropDeletedPartitions(ctx context.Context) ([]string, error) {
+	orphans, err := infrastructure.FetchRows[orphanPartition](ctx, v.db,
+		"SELECT c.relname AS name, i.inhparent::regclass::text AS parent, i.inhdetachpending AS pending "+
+			"FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid "+
+			"WHERE i.inhparent IN (to_regclass($1), to_regclass($2)) "+
+			"AND NOT EXISTS (SELECT FROM "+tbVoting+" v WHERE "+partitionName("v.id")+" = c.relname) "+
+			"ORDER BY c.relname",
+		tbVotingResults, tbVotingResultsArchive,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("fetch partitions of deleted votings: %w", err)
+	}
+
+	dropped := make([]string, 0, len(orphans))
+	for _, orphan := range orphans {
+		partition := pgx.Identifier{orphan.Name}.Sanitize()
+		if orphan.Parent == tbVotingResults {
+			mode := " CONCURRENTLY"
+			if orphan.Pending {
+				mode = " FINALIZE"
+			}
+			if _, err = v.db.Exec(ctx, "ALTER TABLE "+tbVotingResults+" DETACH PARTITION "+partition+mode); err != nil {
+				return dropped, fmt.Errorf("detach partition %s: %w", orphan.Name, err)
+			}
+		}
+
+		if _, err = v.db.Exec(ctx, "DROP TABLE "+partition); err != nil {
+			return dropped, fmt.Errorf("drop partition %s: %w", orphan.Name, err)
+		}
+		dropped = append(dropped, orphan.Name)
+	}
+
+	return dropped, nil
+}
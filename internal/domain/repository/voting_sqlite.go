@@ -0,0 +1,585 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// SQLiteVoting keeps votings in the data file of a single instance with the semantics of Voting.
+// The schema is the one of Postgres without partitions, so Recount and Archive are left to Voting.
+// Events are written to the outbox of the data file in the transaction of the change, like Voting does.
+// sqliteQueryer is the connection of the data file or its transaction.
+type sqliteQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+type SQLiteVoting struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+func NewSQLiteVoting(db *sql.DB) *SQLiteVoting {
+	return &SQLiteVoting{
+		db:  db,
+		now: time.Now,
+	}
+}
+
+func (s *SQLiteVoting) List(ctx context.Context, r *ListVotingRequest) (*ListVotingResponse, error) {
+	listBuilder := votingSelectBuilder().
+		Where(sq.Eq{"v.deleted_at": nil})
+
+	if r.Limit > 0 {
+		listBuilder = listBuilder.Limit(uint64(r.Limit))
+	}
+
+	if r.Offset > 0 {
+		// SQLite takes no OFFSET without LIMIT
+		if r.Limit <= 0 {
+			listBuilder = listBuilder.Limit(math.MaxInt64)
+		}
+		listBuilder = listBuilder.Offset(uint64(r.Offset))
+	}
+
+	items, err := s.selectVotings(ctx, s.db, listBuilder)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ListVotingResponse{
+		Items: items,
+	}, nil
+}
+
+func (s *SQLiteVoting) GetVoting(ctx context.Context, r *GetVotingRequest) (*VotingItem, error) {
+	return s.getVoting(ctx, s.db, r.ID)
+}
+
+func (s *SQLiteVoting) getVoting(ctx context.Context, q sqliteQueryer, id uuid.UUID) (*VotingItem, error) {
+	getBuilder := votingSelectBuilder().
+		Where(sq.Eq{"v.id": id, "v.deleted_at": nil})
+
+	items, err := s.selectVotings(ctx, q, getBuilder)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(items) == 0 {
+		return nil, infrastructure.ErrObjectNotFound
+	}
+
+	return &items[0], nil
+}
+
+func (s *SQLiteVoting) ListEnded(ctx context.Context, r *ListEndedRequest) (*ListVotingResponse, error) {
+	items, err := s.selectVotings(ctx, s.db, endedSelectBuilder(&ListEndedRequest{From: r.From.UTC(), To: r.To.UTC()}))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ListVotingResponse{
+		Items: items,
+	}, nil
+}
+
+func (s *SQLiteVoting) CloseEnded(ctx context.Context, r *ListEndedRequest) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	items, err := s.selectVotings(ctx, tx, endedSelectBuilder(&ListEndedRequest{From: r.From.UTC(), To: r.To.UTC()}))
+	if err != nil {
+		return 0, err
+	}
+
+	events, err := votingClosedEvents(items)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = infrastructure.InsertSQLiteOutboxEvents(ctx, tx, events); err != nil {
+		return 0, fmt.Errorf("insert outbox events: %w", err)
+	}
+
+	if _, err = tx.ExecContext(ctx,
+		"INSERT INTO "+tbVotingCloser+" (checked_at) VALUES (?) "+
+			"ON CONFLICT (id) DO UPDATE SET checked_at = MAX(checked_at, excluded.checked_at)",
+		r.To.UTC(),
+	); err != nil {
+		return 0, fmt.Errorf("save closer checked at: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(items), nil
+}
+
+func (s *SQLiteVoting) CloserCheckedAt(ctx context.Context) (time.Time, error) {
+	var checkedAt time.Time
+	err := s.db.QueryRowContext(ctx, "SELECT checked_at FROM "+tbVotingCloser).Scan(&checkedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, infrastructure.ErrObjectNotFound
+	}
+
+	return checkedAt, err
+}
+
+func (s *SQLiteVoting) InvarianceVoting(ctx context.Context, invarianceID uuid.UUID) (uuid.UUID, error) {
+	var votingID uuid.UUID
+	err := s.db.QueryRowContext(ctx,
+		"SELECT i.voting_id FROM "+tbVotingInvariance+" i JOIN "+tbVoting+" v ON v.id = i.voting_id "+
+			"WHERE i.id = ? AND v.deleted_at IS NULL",
+		invarianceID,
+	).Scan(&votingID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return uuid.Nil, infrastructure.ErrInvarianceNotFound
+	}
+
+	return votingID, err
+}
+
+func (s *SQLiteVoting) selectVotings(ctx context.Context, q sqliteQueryer, builder sq.SelectBuilder) ([]VotingItem, error) {
+	var items []VotingItem
+
+	stmt, args, err := builder.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("build query: %w", err)
+	}
+
+	rows, err := q.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			votingItem      VotingItem
+			description     sql.NullString
+			tags            string
+			invarianceID    sql.NullString
+			invarianceName  sql.NullString
+			invarianceScore sql.NullInt64
+		)
+		if err = rows.Scan(
+			&votingItem.ID,
+			&votingItem.Name,
+			&description,
+			&tags,
+			&votingItem.CreatedAt,
+			&votingItem.StartAt,
+			&votingItem.EndAt,
+			&invarianceID,
+			&invarianceName,
+			&invarianceScore,
+		); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		votingItem.Description = description.String
+		if err = json.Unmarshal([]byte(tags), &votingItem.Tags); err != nil {
+			return nil, fmt.Errorf("decode tags: %w", err)
+		}
+
+		lastItemIDx := len(items) - 1
+		if len(items) == 0 || votingItem.ID != items[lastItemIDx].ID {
+			items = append(items, votingItem)
+			lastItemIDx++
+		}
+
+		if !invarianceID.Valid {
+			continue
+		}
+
+		items[lastItemIDx].Invariance = append(items[lastItemIDx].Invariance, InvarianceScore{
+			ID:    uuid.MustParse(invarianceID.String),
+			Name:  invarianceName.String,
+			Score: invarianceScore.Int64,
+		})
+	}
+
+	return items, rows.Err()
+}
+
+// encodeTags is the JSON array of the tags column.
+func encodeTags(tags []string) (string, error) {
+	encoded, err := json.Marshal(nonNilTags(tags))
+	if err != nil {
+		return "", fmt.Errorf("encode tags: %w", err)
+	}
+
+	return string(encoded), nil
+}
+
+func (s *SQLiteVoting) CreateVoting(ctx context.Context, p *CreateVotingParams) (*CreateVotingResult, error) {
+	tags, err := encodeTags(p.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// SQLite generates no UUID, the ids are made here
+	id := uuid.New()
+	stmt, args, err := sq.Insert(tbVoting).
+		Columns("id", "name", "description", "tags", "created_at", "started_at", "ended_at").
+		Values(id, p.Name, p.Description, tags, s.now().UTC(), p.StartAt.UTC(), p.EndAt.UTC()).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("build statement: %w", err)
+	}
+
+	if _, err = tx.ExecContext(ctx, stmt, args...); err != nil {
+		return nil, fmt.Errorf("create voting: %w", err)
+	}
+
+	if err = s.addInvariance(ctx, tx, id, p.Invariance); err != nil {
+		return nil, fmt.Errorf("add invarianceItem: %w", err)
+	}
+
+	if err = s.insertVotingEvent(ctx, tx, entity.EventVotingCreated, id, nil); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return &CreateVotingResult{
+		ID: id,
+	}, nil
+}
+
+func (s *SQLiteVoting) addInvariance(ctx context.Context, tx *sql.Tx, votingID uuid.UUID, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	insertBuilder := sq.Insert(tbVotingInvariance).
+		Columns("id", "voting_id", "name")
+
+	for _, name := range names {
+		insertBuilder = insertBuilder.Values(uuid.New(), votingID, name)
+	}
+
+	stmt, args, err := insertBuilder.ToSql()
+	if err != nil {
+		return fmt.Errorf("build statement: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, stmt, args...)
+
+	return err
+}
+
+func (s *SQLiteVoting) UpdateVoting(ctx context.Context, p *UpdateVotingParams) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err = s.checkVotingExists(ctx, tx, p.ID); err != nil {
+		return fmt.Errorf("validate update voting: %w", err)
+	}
+
+	previous, err := s.getVoting(ctx, tx, p.ID)
+	if err != nil {
+		return fmt.Errorf("get voting: %w", err)
+	}
+
+	if err = s.updateVoting(ctx, tx, p); err != nil {
+		return fmt.Errorf("update voting: %w", err)
+	}
+
+	// New invariance replace the old ones, their votes and counters are deleted by the cascade
+	if len(p.Invariance) > 0 {
+		stmt, args, err := sq.Delete(tbVotingInvariance).
+			Where(sq.Eq{"voting_id": p.ID}).
+			ToSql()
+		if err != nil {
+			return fmt.Errorf("build statement: %w", err)
+		}
+
+		if _, err = tx.ExecContext(ctx, stmt, args...); err != nil {
+			return fmt.Errorf("update invarianceItem: %w", err)
+		}
+
+		if err = s.addInvariance(ctx, tx, p.ID, p.Invariance); err != nil {
+			return fmt.Errorf("update invarianceItem: %w", err)
+		}
+	}
+
+	if err = s.insertVotingEvent(ctx, tx, entity.EventVotingUpdated, p.ID, previous.Tags); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteVoting) updateVoting(ctx context.Context, tx *sql.Tx, p *UpdateVotingParams) error {
+	updateBuilder := sq.Update(tbVoting).
+		Set("updated_at", s.now().UTC()).
+		Where(sq.Eq{"id": p.ID})
+
+	if p.Name != nil && *p.Name != "" {
+		updateBuilder = updateBuilder.Set("name", *p.Name)
+	}
+
+	if p.Description != nil && *p.Description != "" {
+		updateBuilder = updateBuilder.Set("description", *p.Description)
+	}
+
+	if p.Tags != nil {
+		tags, err := encodeTags(p.Tags)
+		if err != nil {
+			return err
+		}
+		updateBuilder = updateBuilder.Set("tags", tags)
+	}
+
+	if p.StartAt != nil && !p.StartAt.IsZero() {
+		updateBuilder = updateBuilder.Set("started_at", p.StartAt.UTC())
+	}
+
+	if p.EndAt != nil && !p.EndAt.IsZero() {
+		updateBuilder = updateBuilder.Set("ended_at", p.EndAt.UTC())
+	}
+
+	stmt, args, err := updateBuilder.ToSql()
+	if err != nil {
+		return fmt.Errorf("build statement: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, stmt, args...)
+
+	return err
+}
+
+func (s *SQLiteVoting) checkVotingExists(ctx context.Context, tx *sql.Tx, id uuid.UUID) error {
+	var exists bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM "+tbVoting+" WHERE id = ?)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errVotingNotFound
+	}
+
+	return nil
+}
+
+func (s *SQLiteVoting) DeleteVoting(ctx context.Context, p *DeleteVotingParams) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err = s.checkVotingExists(ctx, tx, p.ID); err != nil {
+		return err
+	}
+
+	item, err := s.getVoting(ctx, tx, p.ID)
+	if err != nil {
+		return fmt.Errorf("get voting: %w", err)
+	}
+
+	// Voting invarianceItem, their votes and counters are deleted cascadingly at the database level
+	stmt, args, err := sq.Delete(tbVoting).
+		Where(sq.Eq{"id": p.ID}).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("build delete statement: %w", err)
+	}
+
+	if _, err = tx.ExecContext(ctx, stmt, args...); err != nil {
+		return err
+	}
+
+	event, err := votingDeletedEvent(item)
+	if err != nil {
+		return err
+	}
+
+	if err = infrastructure.InsertSQLiteOutboxEvents(ctx, tx, []entity.Event{event}); err != nil {
+		return fmt.Errorf("insert outbox event: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// insertVotingEvent writes the event with the state of the voting just written by tx to the outbox.
+func (s *SQLiteVoting) insertVotingEvent(ctx context.Context, tx *sql.Tx, eventType entity.EventType, id uuid.UUID, extraTags []string) error {
+	item, err := s.getVoting(ctx, tx, id)
+	if err != nil {
+		return fmt.Errorf("get voting for event: %w", err)
+	}
+
+	event, err := votingEvent(eventType, item, extraTags)
+	if err != nil {
+		return err
+	}
+
+	if err = infrastructure.InsertSQLiteOutboxEvents(ctx, tx, []entity.Event{event}); err != nil {
+		return fmt.Errorf("insert outbox event: %w", err)
+	}
+
+	return nil
+}
+
+func (s *SQLiteVoting) MakeChoice(ctx context.Context, p *MakeChoiceParams) (*MakeChoiceResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := s.makeChoice(ctx, tx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := voteCastEvent(p, result)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = infrastructure.InsertSQLiteOutboxEvents(ctx, tx, []entity.Event{event}); err != nil {
+		return nil, fmt.Errorf("insert outbox event: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// MakeChoices makes the choices by one transaction, every choice gets its own outcome with the same errors
+// as MakeChoice. The writes of the data file are serial anyway, the transaction saves the commits.
+func (s *SQLiteVoting) MakeChoices(ctx context.Context, params []*MakeChoiceParams) ([]MakeChoiceOutcome, error) {
+	outcomes := make([]MakeChoiceOutcome, len(params))
+	if len(params) == 0 {
+		return outcomes, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	events := make([]entity.Event, 0, len(params))
+	for i, p := range params {
+		result, err := s.makeChoice(ctx, tx, p)
+		if isRejectedChoice(err) {
+			outcomes[i].Err = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		event, err := voteCastEvent(p, result)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+		outcomes[i].Result = result
+	}
+
+	if err = infrastructure.InsertSQLiteOutboxEvents(ctx, tx, events); err != nil {
+		return nil, fmt.Errorf("insert outbox events: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return outcomes, nil
+}
+
+// isRejectedChoice tells the errors of the choice from the failures of the transaction.
+func isRejectedChoice(err error) bool {
+	return errors.Is(err, infrastructure.ErrInvarianceNotFound) ||
+		errors.Is(err, infrastructure.ErrVotingFinished) ||
+		errors.Is(err, infrastructure.ErrAlreadyVoted)
+}
+
+func (s *SQLiteVoting) makeChoice(ctx context.Context, tx *sql.Tx, p *MakeChoiceParams) (*MakeChoiceResult, error) {
+	var (
+		result   MakeChoiceResult
+		tags     string
+		finished bool
+	)
+	err := tx.QueryRowContext(ctx,
+		"SELECT i.voting_id, v.tags, COALESCE(v.ended_at <= ?, FALSE) AS finished FROM "+tbVotingInvariance+" i "+
+			"JOIN "+tbVoting+" v ON v.id = i.voting_id WHERE i.id = ? AND v.deleted_at IS NULL",
+		s.now().UTC(), p.InvarianceID,
+	).Scan(&result.VotingID, &tags, &finished)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, infrastructure.ErrInvarianceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if finished {
+		return nil, infrastructure.ErrVotingFinished
+	}
+	if err = json.Unmarshal([]byte(tags), &result.Tags); err != nil {
+		return nil, fmt.Errorf("decode tags: %w", err)
+	}
+
+	stmt, args, err := sq.Insert(tbVotingResults).
+		Columns("id", "voting_id", "invariant_id", "user_id", "created_at").
+		Values(uuid.New(), result.VotingID, p.InvarianceID, p.UserID, s.now().UTC()).
+		Suffix("ON CONFLICT " + conflictOneVote + " DO NOTHING").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("build statement: %w", err)
+	}
+
+	inserted, err := tx.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	if affected, err := inserted.RowsAffected(); err != nil {
+		return nil, err
+	} else if affected == 0 {
+		return nil, infrastructure.ErrAlreadyVoted
+	}
+
+	if err = tx.QueryRowContext(ctx,
+		"INSERT INTO "+tbVotingCounters+" (invariance_id, voting_id, score) VALUES (?, ?, 1) "+
+			"ON CONFLICT (invariance_id) DO UPDATE SET score = score + 1 RETURNING score",
+		p.InvarianceID, result.VotingID,
+	).Scan(&result.Score); err != nil {
+		return nil, fmt.Errorf("increment score: %w", err)
+	}
+
+	if err = tx.QueryRowContext(ctx,
+		"SELECT COALESCE(sum(score), 0) FROM "+tbVotingCounters+" WHERE voting_id = ?", result.VotingID,
+	).Scan(&result.Turnout); err != nil {
+		return nil, fmt.Errorf("voting turnout: %w", err)
+	}
+
+	return &result, nil
+}
@@ -0,0 +1,286 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+	"github.com/yvv4git/task-voting/migrations"
+)
+
+// newTestSQLiteVoting opens a migrated data file of the test, the file is removed with the temp dir.
+func newTestSQLiteVoting(t *testing.T) (*SQLiteVoting, *infrastructure.SQLiteOutboxStore) {
+	t.Helper()
+
+	sqliteMigrations, err := fs.Sub(migrations.SQLite, "sqlite")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	db, err := infrastructure.NewSQLiteDB(context.Background(), infrastructure.SQLite{
+		Path: filepath.Join(t.TempDir(), "voting.db"),
+	}, sqliteMigrations)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewSQLiteVoting(db), infrastructure.NewSQLiteOutboxStore(db)
+}
+
+func createSQLiteVoting(t *testing.T, repo *SQLiteVoting, name string, endAt time.Time, invariance ...string) *VotingItem {
+	t.Helper()
+	ctx := context.Background()
+
+	created, err := repo.CreateVoting(ctx, &CreateVotingParams{
+		Name:       name,
+		Tags:       []string{"team"},
+		StartAt:    time.Now().Add(-time.Hour),
+		EndAt:      endAt,
+		Invariance: invariance,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	item, err := repo.GetVoting(ctx, &GetVotingRequest{ID: created.ID})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	return item
+}
+
+func TestSQLiteVotingMakeChoice(t *testing.T) {
+	repo, outbox := newTestSQLiteVoting(t)
+	ctx := context.Background()
+
+	open := createSQLiteVoting(t, repo, "open", time.Now().Add(time.Hour), "yes", "no")
+	finished := createSQLiteVoting(t, repo, "finished", time.Now().Add(-time.Minute), "yes")
+	user := uuid.New()
+
+	result, err := repo.MakeChoice(ctx, &MakeChoiceParams{InvarianceID: open.Invariance[0].ID, UserID: user})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.VotingID != open.ID || result.Score != 1 || result.Turnout != 1 || len(result.Tags) != 1 {
+		t.Errorf("Expected the score 1 and turnout 1 of the open voting, got %+v", result)
+	}
+
+	tests := []struct {
+		name   string
+		params *MakeChoiceParams
+		err    error
+	}{
+		{name: "already voted", params: &MakeChoiceParams{InvarianceID: open.Invariance[1].ID, UserID: user}, err: infrastructure.ErrAlreadyVoted},
+		{name: "finished", params: &MakeChoiceParams{InvarianceID: finished.Invariance[0].ID, UserID: user}, err: infrastructure.ErrVotingFinished},
+		{name: "unknown invariance", params: &MakeChoiceParams{InvarianceID: uuid.New(), UserID: user}, err: infrastructure.ErrInvarianceNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := repo.MakeChoice(ctx, tt.params); !errors.Is(err, tt.err) {
+				t.Errorf("Expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	voting, err := repo.GetVoting(ctx, &GetVotingRequest{ID: open.ID})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if voting.Invariance[0].Score != 1 || voting.Invariance[1].Score != 0 {
+		t.Errorf("Expected the score of the first vote only, got %+v", voting.Invariance)
+	}
+
+	if cast := claimEvents(t, outbox, entity.EventVoteCast); len(cast) != 1 {
+		t.Errorf("Expected one vote.cast in the outbox, got %d", len(cast))
+	}
+}
+
+func TestSQLiteVotingListAndEnded(t *testing.T) {
+	repo, _ := newTestSQLiteVoting(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	b := createSQLiteVoting(t, repo, "b", now.Add(time.Hour), "z", "a")
+	a := createSQLiteVoting(t, repo, "a", now.Add(-time.Minute))
+	c := createSQLiteVoting(t, repo, "c", now.Add(time.Hour), "one")
+
+	list, err := repo.List(ctx, &ListVotingRequest{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(list.Items) != 3 || list.Items[0].ID != a.ID || list.Items[1].ID != b.ID || list.Items[2].ID != c.ID {
+		t.Fatalf("Expected the votings ordered by name, got %+v", list.Items)
+	}
+	if names := list.Items[1].Invariance; names[0].Name != "a" || names[1].Name != "z" {
+		t.Errorf("Expected the invariance ordered by name, got %+v", names)
+	}
+	if tags := list.Items[0].Tags; len(tags) != 1 || tags[0] != "team" {
+		t.Errorf("Expected the tags of the voting, got %v", tags)
+	}
+
+	// The limit counts the rows of invariance: a, b/a, b/z, c/one
+	paged, err := repo.List(ctx, &ListVotingRequest{Offset: 3})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(paged.Items) != 1 || paged.Items[0].ID != c.ID {
+		t.Errorf("Expected the row of c only, got %+v", paged.Items)
+	}
+
+	ended, err := repo.ListEnded(ctx, &ListEndedRequest{From: now.Add(-time.Hour), To: now})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(ended.Items) != 1 || ended.Items[0].ID != a.ID {
+		t.Errorf("Expected the ended voting only, got %+v", ended.Items)
+	}
+}
+
+func TestSQLiteVotingUpdateAndDelete(t *testing.T) {
+	repo, _ := newTestSQLiteVoting(t)
+	ctx := context.Background()
+
+	voting := createSQLiteVoting(t, repo, "voting", time.Now().Add(time.Hour), "yes", "no")
+	user := uuid.New()
+	if _, err := repo.MakeChoice(ctx, &MakeChoiceParams{InvarianceID: voting.Invariance[0].ID, UserID: user}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// New invariance replace the old ones with their votes, the user votes again
+	name := "renamed"
+	if err := repo.UpdateVoting(ctx, &UpdateVotingParams{ID: voting.ID, Name: &name, Tags: []string{}, Invariance: []string{"maybe"}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	updated, err := repo.GetVoting(ctx, &GetVotingRequest{ID: voting.ID})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if updated.Name != name || len(updated.Tags) != 0 || len(updated.Invariance) != 1 || updated.Invariance[0].Score != 0 {
+		t.Fatalf("Expected the renamed voting with a new invariance, got %+v", updated)
+	}
+	if _, err = repo.MakeChoice(ctx, &MakeChoiceParams{InvarianceID: updated.Invariance[0].ID, UserID: user}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err = repo.UpdateVoting(ctx, &UpdateVotingParams{ID: uuid.New(), Name: &name}); err == nil {
+		t.Errorf("Expected an error for the missing voting")
+	}
+
+	if err = repo.DeleteVoting(ctx, &DeleteVotingParams{ID: voting.ID}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err = repo.GetVoting(ctx, &GetVotingRequest{ID: voting.ID}); !errors.Is(err, infrastructure.ErrObjectNotFound) {
+		t.Errorf("Expected %v, got %v", infrastructure.ErrObjectNotFound, err)
+	}
+	if err = repo.DeleteVoting(ctx, &DeleteVotingParams{ID: voting.ID}); err == nil {
+		t.Errorf("Expected an error for the deleted voting")
+	}
+}
+
+func TestSQLiteVotingMakeChoicesOutcomes(t *testing.T) {
+	repo, outbox := newTestSQLiteVoting(t)
+	voting := createSQLiteVoting(t, repo, "voting", time.Now().Add(time.Hour), "yes", "no")
+	first, second := uuid.New(), uuid.New()
+
+	outcomes, err := repo.MakeChoices(context.Background(), []*MakeChoiceParams{
+		{InvarianceID: voting.Invariance[0].ID, UserID: first},
+		{InvarianceID: voting.Invariance[1].ID, UserID: first},
+		{InvarianceID: uuid.New(), UserID: second},
+		{InvarianceID: voting.Invariance[0].ID, UserID: second},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if outcomes[0].Err != nil || !errors.Is(outcomes[1].Err, infrastructure.ErrAlreadyVoted) ||
+		!errors.Is(outcomes[2].Err, infrastructure.ErrInvarianceNotFound) || outcomes[3].Err != nil {
+		t.Fatalf("Unexpected outcomes: %+v", outcomes)
+	}
+	if outcomes[3].Result.Score != 2 || outcomes[3].Result.Turnout != 2 {
+		t.Errorf("Expected the score 2 and turnout 2, got %+v", outcomes[3].Result)
+	}
+	if cast := claimEvents(t, outbox, entity.EventVoteCast); len(cast) != 2 {
+		t.Errorf("Expected two vote.cast in the outbox, got %d", len(cast))
+	}
+}
+
+func TestSQLiteVotingCloseEnded(t *testing.T) {
+	repo, outbox := newTestSQLiteVoting(t)
+	ctx := context.Background()
+
+	if _, err := repo.CloserCheckedAt(ctx); !errors.Is(err, infrastructure.ErrObjectNotFound) {
+		t.Fatalf("Expected %v before the closer runs, got %v", infrastructure.ErrObjectNotFound, err)
+	}
+
+	checkedAt := time.Now().UTC()
+	ended := createSQLiteVoting(t, repo, "ended", checkedAt.Add(-time.Minute), "yes")
+	createSQLiteVoting(t, repo, "open", checkedAt.Add(time.Hour), "yes")
+
+	// A lagging instance closes the voting again and doesn't move the checked time back
+	for _, at := range []time.Time{checkedAt, checkedAt.Add(-time.Second)} {
+		closed, err := repo.CloseEnded(ctx, &ListEndedRequest{From: checkedAt.Add(-time.Hour), To: at})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if closed != 1 {
+			t.Errorf("Expected the ended voting closed, got %d", closed)
+		}
+	}
+
+	got, err := repo.CloserCheckedAt(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !got.Equal(checkedAt) {
+		t.Errorf("Expected %v, got %v", checkedAt, got)
+	}
+
+	closedEvents := claimEvents(t, outbox, entity.EventVotingClosed)
+	if len(closedEvents) != 1 || closedEvents[0].VotingID != ended.ID {
+		t.Errorf("Expected voting.closed of the ended voting once, got %+v", closedEvents)
+	}
+}
+
+func TestSQLiteVotingOutboxKeepsEventsUntilDelivered(t *testing.T) {
+	repo, outbox := newTestSQLiteVoting(t)
+	ctx := context.Background()
+
+	voting := createSQLiteVoting(t, repo, "voting", time.Now().Add(time.Hour), "yes")
+	if _, err := repo.MakeChoice(ctx, &MakeChoiceParams{InvarianceID: voting.Invariance[0].ID, UserID: uuid.New()}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// A failed delivery leaves the event in the data file, a restarted relay finds it
+	failure := errors.New("sink is down")
+	if _, err := outbox.Claim(ctx, 10, func(context.Context, []entity.Event) error { return failure }); !errors.Is(err, failure) {
+		t.Fatalf("Expected %v, got %v", failure, err)
+	}
+
+	restarted := infrastructure.NewSQLiteOutboxStore(repo.db)
+	var delivered []entity.Event
+	claimed, err := restarted.Claim(ctx, 10, func(_ context.Context, events []entity.Event) error {
+		delivered = events
+		return nil
+	})
+	if err != nil || claimed != 2 || delivered[0].Type != entity.EventVotingCreated || delivered[1].Type != entity.EventVoteCast ||
+		delivered[1].VotingID != voting.ID {
+		t.Fatalf("Expected voting.created and the vote.cast of the voting, got %d %+v, %v", claimed, delivered, err)
+	}
+
+	if claimed, err = restarted.Claim(ctx, 10, func(context.Context, []entity.Event) error { return nil }); err != nil || claimed != 0 {
+		t.Errorf("Expected no pending events, got %d, %v", claimed, err)
+	}
+
+	deleted, err := restarted.DeleteDelivered(ctx, time.Now().Add(time.Minute))
+	if err != nil || deleted != 2 {
+		t.Errorf("Expected the delivered events deleted, got %d, %v", deleted, err)
+	}
+}
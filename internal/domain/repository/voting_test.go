@@ -0,0 +1,291 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+// newTestDB connects to the migrated database of VOTING_TEST_PG_DSN, the test is skipped without it.
+func newTestDB(t testing.TB) *pgxpool.Pool {
+	t.Helper()
+
+	dsn := os.Getenv("VOTING_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("VOTING_TEST_PG_DSN is not set")
+	}
+
+	db, err := pgxpool.New(context.Background(), dsn)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	return db
+}
+
+// newTestVoting reads from the primary, the test database has no replicas.
+func newTestVoting(db *pgxpool.Pool) *Voting {
+	return NewVoting(db, infrastructure.NewReadRouter(infrastructure.NewDefaultLogger(), db, nil, 0))
+}
+
+// createTestVoting creates an open voting, it's removed with its votes after the test.
+func createTestVoting(t testing.TB, repo *Voting) *VotingItem {
+	t.Helper()
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	created, err := repo.CreateVoting(ctx, &CreateVotingParams{
+		Name:       "concurrency",
+		StartAt:    now.Add(-time.Hour),
+		EndAt:      now.Add(time.Hour),
+		Invariance: []string{"yes", "no"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = repo.DeleteVoting(context.Background(), &DeleteVotingParams{ID: created.ID})
+	})
+
+	item, err := repo.GetVoting(ctx, &GetVotingRequest{ID: created.ID})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	return item
+}
+
+func TestMakeChoiceConcurrentVotesOfUser(t *testing.T) {
+	db := newTestDB(t)
+	repo := newTestVoting(db)
+	voting := createTestVoting(t, repo)
+
+	const attempts = 20
+	var (
+		userID    = uuid.New()
+		start     = make(chan struct{})
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded int
+		unusual   []error
+	)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(invarianceID uuid.UUID) {
+			defer wg.Done()
+			<-start
+
+			_, err := repo.MakeChoice(context.Background(), &MakeChoiceParams{
+				InvarianceID: invarianceID,
+				UserID:       userID,
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				succeeded++
+			case !errors.Is(err, infrastructure.ErrAlreadyVoted):
+				unusual = append(unusual, err)
+			}
+		}(voting.Invariance[i%len(voting.Invariance)].ID)
+	}
+	close(start)
+	wg.Wait()
+
+	if succeeded != 1 {
+		t.Errorf("Expected exactly one vote of the user, got %d", succeeded)
+	}
+	if len(unusual) > 0 {
+		t.Errorf("Expected the rest to be rejected as already voted, got %v", unusual)
+	}
+
+	item, err := repo.GetVoting(context.Background(), &GetVotingRequest{ID: voting.ID})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var turnout int64
+	for _, invariance := range item.Invariance {
+		turnout += invariance.Score
+	}
+	if turnout != 1 {
+		t.Errorf("Expected turnout 1, got %d", turnout)
+	}
+}
+
+func TestRecountRebuildsDriftedCounters(t *testing.T) {
+	db := newTestDB(t)
+	repo := newTestVoting(db)
+	voting := createTestVoting(t, repo)
+	ctx := context.Background()
+
+	invarianceID := voting.Invariance[0].ID
+	for i := 0; i < 3; i++ {
+		if _, err := repo.MakeChoice(ctx, &MakeChoiceParams{InvarianceID: invarianceID, UserID: uuid.New()}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if _, err := db.Exec(ctx, "UPDATE voting_invariance_counters SET score = 10 WHERE invariance_id = $1", invarianceID); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	findDrift := func(drifts []*CounterDrift) *CounterDrift {
+		for _, drift := range drifts {
+			if drift.InvarianceID == invarianceID {
+				return drift
+			}
+		}
+		return nil
+	}
+
+	drifts, err := repo.Recount(ctx, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	drift := findDrift(drifts)
+	if drift == nil || drift.Counted != 3 || drift.Stored != 10 {
+		t.Fatalf("Expected drift of 3 counted and 10 stored, got %+v", drift)
+	}
+
+	if _, err = repo.Recount(ctx, false); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if drifts, err = repo.Recount(ctx, true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if drift = findDrift(drifts); drift != nil {
+		t.Errorf("Expected no drift after the recount, got %+v", drift)
+	}
+}
+
+func TestMakeChoicesOutcomes(t *testing.T) {
+	db := newTestDB(t)
+	repo := newTestVoting(db)
+	voting := createTestVoting(t, repo)
+	ctx := context.Background()
+
+	invarianceID := voting.Invariance[0].ID
+	voted, twice := uuid.New(), uuid.New()
+	if _, err := repo.MakeChoice(ctx, &MakeChoiceParams{InvarianceID: invarianceID, UserID: voted}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	outcomes, err := repo.MakeChoices(ctx, []*MakeChoiceParams{
+		{InvarianceID: invarianceID, UserID: uuid.New()},
+		{InvarianceID: invarianceID, UserID: voted},
+		{InvarianceID: uuid.New(), UserID: uuid.New()},
+		{InvarianceID: invarianceID, UserID: twice},
+		{InvarianceID: voting.Invariance[1].ID, UserID: twice},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []error{nil, infrastructure.ErrAlreadyVoted, infrastructure.ErrInvarianceNotFound, nil, infrastructure.ErrAlreadyVoted}
+	for i, outcome := range outcomes {
+		if !errors.Is(outcome.Err, expected[i]) {
+			t.Errorf("Expected choice %d to fail with %v, got %v", i, expected[i], outcome.Err)
+		}
+	}
+
+	// Scores and turnout count the choices one by one
+	if outcomes[0].Result.Score != 2 || outcomes[3].Result.Score != 3 || outcomes[3].Result.Turnout != 3 {
+		t.Errorf("Expected scores 2 and 3 and turnout 3, got %+v and %+v", outcomes[0].Result, outcomes[3].Result)
+	}
+}
+
+func TestArchiveDetachesPartition(t *testing.T) {
+	db := newTestDB(t)
+	repo := newTestVoting(db)
+	voting := createTestVoting(t, repo)
+	ctx := context.Background()
+
+	if _, err := repo.MakeChoice(ctx, &MakeChoiceParams{InvarianceID: voting.Invariance[0].ID, UserID: uuid.New()}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The voting ended long ago
+	if _, err := db.Exec(ctx, "UPDATE voting SET ended_at = now() - interval '1 year' WHERE id = $1", voting.ID); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	archived, err := repo.Archive(ctx, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !slices.Contains(archived, voting.ID) {
+		t.Fatalf("Expected the voting archived, got %v", archived)
+	}
+
+	var parent string
+	var votes, archivedVotes int
+	if err = db.QueryRow(ctx,
+		"SELECT inhparent::regclass::text, (SELECT count(*) FROM voting_results WHERE voting_id = $2), "+
+			"(SELECT count(*) FROM voting_results_archive WHERE voting_id = $2) FROM pg_inherits WHERE inhrelid = to_regclass($1)",
+		resultsPartition(voting.ID), voting.ID,
+	).Scan(&parent, &votes, &archivedVotes); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if parent != tbVotingResultsArchive || votes != 0 || archivedVotes != 1 {
+		t.Errorf("Expected the partition with the vote in the archive, got %s with %d votes and %d archived", parent, votes, archivedVotes)
+	}
+
+	// The results are kept by the counters, the recount leaves them alone
+	item, err := repo.GetVoting(ctx, &GetVotingRequest{ID: voting.ID})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if item.Invariance[0].Score != 1 {
+		t.Errorf("Expected the score 1 of the archived voting, got %d", item.Invariance[0].Score)
+	}
+
+	drifts, err := repo.Recount(ctx, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, drift := range drifts {
+		if drift.VotingID == voting.ID {
+			t.Errorf("Expected no drift of the archived voting, got %+v", drift)
+		}
+	}
+
+	if _, err = repo.MakeChoice(ctx, &MakeChoiceParams{InvarianceID: voting.Invariance[0].ID, UserID: uuid.New()}); !errors.Is(err, infrastructure.ErrVotingFinished) {
+		t.Errorf("Expected %v, got %v", infrastructure.ErrVotingFinished, err)
+	}
+}
+
+func TestDropDeletedPartitions(t *testing.T) {
+	db := newTestDB(t)
+	repo := newTestVoting(db)
+	voting := createTestVoting(t, repo)
+	ctx := context.Background()
+
+	if err := repo.DeleteVoting(ctx, &DeleteVotingParams{ID: voting.ID}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	dropped, err := repo.DropDeletedPartitions(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !slices.Contains(dropped, resultsPartition(voting.ID)) {
+		t.Errorf("Expected the partition of the deleted voting dropped, got %v", dropped)
+	}
+
+	var exists bool
+	if err = db.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", resultsPartition(voting.ID)).Scan(&exists); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if exists {
+		t.Errorf("Expected the partition gone")
+	}
+}
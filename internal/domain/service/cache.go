@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"github.com/yvv4git/task-voting/internal/interfaces/web"
+)
+
+type listKey struct {
+	limit  int64
+	offset int64
+}
+
+// ReadYourWrites tells whether the user of the context is within the read-your-writes window of their write.
+type ReadYourWrites interface {
+	InReadYourWrites(ctx context.Context) bool
+}
+
+type cacheEntry[T any] struct {
+	value     T
+	expiresAt time.Time
+}
+
+// ResultCache keeps the votings and their lists read by the service. It's an event publisher: votes are coalesced
+// into voting.tally, which drops the voting and the lists showing it, a created, updated or deleted voting
+// drops every list. The cached values are shared, they must not be changed.
+// Values are filled from the replicas like any read, users within their read-your-writes window miss the cache,
+// so they never get a value older than their write.
+type ResultCache struct {
+	ttl time.Duration
+	now func() time.Time
+	// writes is nil when the reads have no replicas
+	writes ReadYourWrites
+
+	mu      sync.Mutex
+	lists   map[listKey]cacheEntry[*web.ListVotingResponse]
+	votings map[uuid.UUID]cacheEntry[*web.VotingItem]
+	// generation grows with every invalidation, a value read before it is not stored
+	generation uint64
+}
+
+func NewResultCache(ttl time.Duration, writes ReadYourWrites) *ResultCache {
+	return &ResultCache{
+		ttl:     ttl,
+		now:     time.Now,
+		writes:  writes,
+		lists:   make(map[listKey]cacheEntry[*web.ListVotingResponse]),
+		votings: make(map[uuid.UUID]cacheEntry[*web.VotingItem]),
+	}
+}
+
+// PublishEvent drops the entries changed by the event, vote.cast is followed by voting.tally.
+func (c *ResultCache) PublishEvent(event entity.Event) {
+	switch event.Type {
+	case entity.EventVotingTally:
+		c.invalidateScores(event.VotingID)
+	case entity.EventVotingCreated, entity.EventVotingUpdated, entity.EventVotingDeleted:
+		c.invalidate(event.VotingID)
+	}
+}
+
+// invalidate drops the voting and every list, the changed voting may enter, leave or move within any page.
+func (c *ResultCache) invalidate(votingID uuid.UUID) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	delete(c.votings, votingID)
+	clear(c.lists)
+}
+
+// invalidateScores drops the voting and the lists showing it, the scores don't move the voting within the pages.
+func (c *ResultCache) invalidateScores(votingID uuid.UUID) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	delete(c.votings, votingID)
+	for key, entry := range c.lists {
+		if slices.ContainsFunc(entry.value.Items, func(item web.VotingItem) bool { return item.ID == votingID }) {
+			delete(c.lists, key)
+		}
+	}
+}
+
+// bypassed tells whether the user of the context must not read the cache, the cached value may be older than their write.
+func (c *ResultCache) bypassed(ctx context.Context) bool {
+	return c.writes != nil && c.writes.InReadYourWrites(ctx)
+}
+
+// list returns the cached list, or the generation to store the list read from the repository.
+func (c *ResultCache) list(ctx context.Context, key listKey) (*web.ListVotingResponse, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	bypassed := c.bypassed(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.lists[key]
+	if !ok || bypassed || !c.now().Before(entry.expiresAt) {
+		return nil, c.generation, false
+	}
+
+	return entry.value, c.generation, true
+}
+
+func (c *ResultCache) storeList(key listKey, generation uint64, value *web.ListVotingResponse) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation == c.generation {
+		c.lists[key] = cacheEntry[*web.ListVotingResponse]{value: value, expiresAt: c.now().Add(c.ttl)}
+	}
+}
+
+// voting returns the cached voting, or the generation to store the voting read from the repository.
+func (c *ResultCache) voting(ctx context.Context, id uuid.UUID) (*web.VotingItem, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	bypassed := c.bypassed(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.votings[id]
+	if !ok || bypassed || !c.now().Before(entry.expiresAt) {
+		return nil, c.generation, false
+	}
+
+	return entry.value, c.generation, true
+}
+
+func (c *ResultCache) storeVoting(id uuid.UUID, generation uint64, value *web.VotingItem) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation == c.generation {
+		c.votings[id] = cacheEntry[*web.VotingItem]{value: value, expiresAt: c.now().Add(c.ttl)}
+	}
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"github.com/yvv4git/task-voting/internal/domain/repository"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+	"github.com/yvv4git/task-voting/internal/interfaces/web"
+)
+
+// List returns the votings which got a score.
+func (r *tallyRepository) List(_ context.Context, _ *repository.ListVotingRequest) (*repository.ListVotingResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reads++
+	var items []repository.VotingItem
+	for id, score := range r.score {
+		items = append(items, repository.VotingItem{ID: id, Invariance: []repository.InvarianceScore{{ID: id, Score: score}}})
+	}
+	return &repository.ListVotingResponse{Items: items}, nil
+}
+
+func TestResultCacheInvalidatedByEvents(t *testing.T) {
+	votingID, otherID := uuid.New(), uuid.New()
+	repo := &tallyRepository{score: map[uuid.UUID]int64{votingID: 0}}
+	cache := NewResultCache(time.Minute, nil)
+	svc := NewVoting(infrastructure.NewDefaultLogger(), repo, &recordingPublisher{}, nopOutbox{}, infrastructure.Ingest{}, cache)
+
+	ctx := context.Background()
+	read := func() int64 {
+		t.Helper()
+		if _, err := svc.List(ctx, &web.ListVotingRequest{Limit: 10}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		item, err := svc.GetVoting(ctx, &web.GetVotingRequest{ID: votingID})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return item.Turnout
+	}
+	publish := func(eventType entity.EventType, votingID uuid.UUID) {
+		t.Helper()
+		event, err := entity.NewEvent(eventType, votingID, nil, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		cache.PublishEvent(event)
+	}
+
+	read()
+	read()
+	if repo.reads != 2 {
+		t.Errorf("Expected the second read from the cache, got %d reads", repo.reads)
+	}
+
+	// A vote waits for its tally, vote.cast and presence don't change the cache
+	if err := svc.MakeChoice(ctx, &web.MakeChoiceRequest{InvarianceID: votingID}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	publish(entity.EventVoteCast, votingID)
+	publish(entity.EventPresence, votingID)
+	if turnout := read(); turnout != 0 || repo.reads != 2 {
+		t.Errorf("Expected the cached turnout 0, got %d after %d reads", turnout, repo.reads)
+	}
+
+	// The tally of a voting which isn't listed keeps the list
+	publish(entity.EventVotingTally, otherID)
+	read()
+	if repo.reads != 2 {
+		t.Errorf("Expected no reads after the tally of another voting, got %d reads", repo.reads)
+	}
+
+	publish(entity.EventVotingTally, votingID)
+	if turnout := read(); turnout != 1 || repo.reads != 4 {
+		t.Errorf("Expected the turnout 1 read with the list from the repository, got %d after %d reads", turnout, repo.reads)
+	}
+
+	// A new voting may enter any page, the lists are dropped
+	publish(entity.EventVotingCreated, otherID)
+	read()
+	if repo.reads != 5 {
+		t.Errorf("Expected the list read again, got %d reads", repo.reads)
+	}
+}
+
+func TestResultCacheSkipsStaleFill(t *testing.T) {
+	cache := NewResultCache(time.Minute, nil)
+	votingID := uuid.New()
+
+	// The voting changed while it was read
+	_, generation, _ := cache.voting(context.Background(), votingID)
+	cache.invalidate(votingID)
+	cache.storeVoting(votingID, generation, &web.VotingItem{ID: votingID})
+
+	if _, _, ok := cache.voting(context.Background(), votingID); ok {
+		t.Errorf("Expected the stale voting not to be cached")
+	}
+}
+
+func TestResultCacheExpires(t *testing.T) {
+	cache := NewResultCache(time.Minute, nil)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	key := listKey{limit: 10}
+	_, generation, _ := cache.list(context.Background(), key)
+	cache.storeList(key, generation, &web.ListVotingResponse{})
+
+	now = now.Add(time.Minute)
+	if _, _, ok := cache.list(context.Background(), key); ok {
+		t.Errorf("Expected the list to expire after TTL")
+	}
+}
+
+// recentWriters are the users within their read-your-writes window.
+type recentWriters map[uuid.UUID]bool
+
+func (w recentWriters) InReadYourWrites(ctx context.Context) bool {
+	userID, ok := infrastructure.ReadUserFromContext(ctx)
+	return ok && w[userID]
+}
+
+// replicaRepository answers the reads with the turnout and records whether they were forced to the primary.
+type replicaRepository struct {
+	VotingRepository
+	turnout      int64
+	primaryReads int
+}
+
+func (r *replicaRepository) GetVoting(ctx context.Context, req *repository.GetVotingRequest) (*repository.VotingItem, error) {
+	if infrastructure.PrimaryReadsFromContext(ctx) {
+		r.primaryReads++
+	}
+	return &repository.VotingItem{ID: req.ID, Invariance: []repository.InvarianceScore{{ID: req.ID, Score: r.turnout}}}, nil
+}
+
+func TestResultCacheFillsFromReplicasAndBypassesRecentWriters(t *testing.T) {
+	repo := &replicaRepository{turnout: 1}
+	writer, reader := uuid.New(), uuid.New()
+	cache := NewResultCache(time.Minute, recentWriters{writer: true})
+	svc := NewVoting(infrastructure.NewDefaultLogger(), repo, &recordingPublisher{}, nopOutbox{}, infrastructure.Ingest{}, cache)
+
+	votingID := uuid.New()
+	read := func(userID uuid.UUID) int64 {
+		t.Helper()
+		item, err := svc.GetVoting(infrastructure.WithReadUser(context.Background(), userID), &web.GetVotingRequest{ID: votingID})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return item.Turnout
+	}
+
+	if turnout := read(reader); turnout != 1 {
+		t.Errorf("Expected the turnout 1 cached, got %d", turnout)
+	}
+	if repo.primaryReads != 0 {
+		t.Errorf("Expected the cache filled without forcing the primary, got %d primary reads", repo.primaryReads)
+	}
+
+	// The write of the user isn't invalidated here yet, e.g. it's made on another instance
+	repo.turnout = 2
+	if turnout := read(reader); turnout != 1 {
+		t.Errorf("Expected the cached turnout 1, got %d", turnout)
+	}
+	if turnout := read(writer); turnout != 2 {
+		t.Errorf("Expected the writer to miss the cache and read the turnout 2, got %d", turnout)
+	}
+}
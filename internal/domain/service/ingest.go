@@ -0,0 +1,167 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/yvv4git/task-voting/internal/domain/repository"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+// choiceBatcher groups concurrent choices, a batch is written by one transaction
+// and every caller gets the outcome of its own choice.
+type choiceBatcher struct {
+	cfg      infrastructure.Ingest
+	requests chan *choiceRequest
+	// stopped is closed when the workers are gone, the choices left in requests are never written
+	stopped chan struct{}
+}
+
+type choiceRequest struct {
+	params *repository.MakeChoiceParams
+	done   chan repository.MakeChoiceOutcome
+}
+
+func newChoiceBatcher(cfg infrastructure.Ingest) *choiceBatcher {
+	cfg = cfg.WithDefaults()
+	return &choiceBatcher{
+		cfg:      cfg,
+		requests: make(chan *choiceRequest, cfg.MaxBatch*cfg.Workers),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// makeChoice waits for the batch of the choice to be written. The choice may still be counted
+// when ctx is done after it was queued, it fails with ErrIngestStopped when the workers stopped before writing it.
+func (b *choiceBatcher) makeChoice(ctx context.Context, params *repository.MakeChoiceParams) (*repository.MakeChoiceResult, error) {
+	request := &choiceRequest{
+		params: params,
+		done:   make(chan repository.MakeChoiceOutcome, 1),
+	}
+
+	select {
+	case b.requests <- request:
+	case <-b.stopped:
+		return nil, infrastructure.ErrIngestStopped
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case outcome := <-request.done:
+		return outcome.Result, outcome.Err
+	case <-b.stopped:
+		// The outcome of the last batches is sent before the workers are gone
+		select {
+		case outcome := <-request.done:
+			return outcome.Result, outcome.Err
+		default:
+			return nil, infrastructure.ErrIngestStopped
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stop fails the queued choices, it's called once the workers are gone.
+func (b *choiceBatcher) stop() {
+	close(b.stopped)
+
+	for {
+		select {
+		case request := <-b.requests:
+			request.done <- repository.MakeChoiceOutcome{Err: infrastructure.ErrIngestStopped}
+		default:
+			return
+		}
+	}
+}
+
+// collect adds the queued choices to the batch until it's full or MaxWait passed.
+func (b *choiceBatcher) collect(first *choiceRequest) []*choiceRequest {
+	batch := []*choiceRequest{first}
+
+	timer := time.NewTimer(b.cfg.MaxWait)
+	defer timer.Stop()
+
+	for len(batch) < b.cfg.MaxBatch {
+		select {
+		case request := <-b.requests:
+			batch = append(batch, request)
+		case <-timer.C:
+			return batch
+		}
+	}
+
+	return batch
+}
+
+// RunIngest writes the batches of choices until ctx is done, it returns at once when batching is disabled.
+// The choices which aren't written by then fail with ErrIngestStopped, as do the later ones.
+func (v *Voting) RunIngest(ctx context.Context) {
+	if v.batcher == nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < v.batcher.cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v.ingest(ctx)
+		}()
+	}
+	wg.Wait()
+
+	v.batcher.stop()
+}
+
+func (v *Voting) ingest(ctx context.Context) {
+	for {
+		// A stopped worker takes no more choices, even when they're queued
+		if ctx.Err() != nil {
+			return
+		}
+
+		var first *choiceRequest
+		select {
+		case <-ctx.Done():
+			return
+		case first = <-v.batcher.requests:
+		}
+
+		v.writeBatch(ctx, v.batcher.collect(first))
+	}
+}
+
+func (v *Voting) writeBatch(ctx context.Context, batch []*choiceRequest) {
+	params := make([]*repository.MakeChoiceParams, 0, len(batch))
+	for _, request := range batch {
+		params = append(params, request.params)
+	}
+
+	outcomes, err := v.repo.MakeChoices(ctx, params)
+	if err != nil && ctx.Err() != nil {
+		// Stopping, the choices one by one would fail the same way
+		v.logger.Error("make choices", slog.Int("batch", len(batch)), slog.Any("error", err))
+		for _, request := range batch {
+			request.done <- repository.MakeChoiceOutcome{Err: infrastructure.ErrIngestStopped}
+		}
+		return
+	}
+	if err != nil {
+		// The choices are made one by one, so a single bad choice fails only its caller
+		v.logger.Error("make choices", slog.Int("batch", len(batch)), slog.Any("error", err))
+		for _, request := range batch {
+			result, err := v.repo.MakeChoice(ctx, request.params)
+			request.done <- repository.MakeChoiceOutcome{Result: result, Err: err}
+		}
+		return
+	}
+
+	for i, request := range batch {
+		request.done <- outcomes[i]
+	}
+}
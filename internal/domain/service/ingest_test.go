@@ -0,0 +1,288 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/yvv4git/task-voting/internal/domain/repository"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+	"github.com/yvv4git/task-voting/internal/interfaces/web"
+)
+
+// batchRepository takes latency for every transaction, whatever the number of choices in it,
+// transactions hold one of the connections of the pool. A user votes once.
+type batchRepository struct {
+	VotingRepository
+
+	latency   time.Duration
+	conns     chan struct{}
+	failBatch bool
+
+	mu      sync.Mutex
+	voted   map[uuid.UUID]struct{}
+	batches []int
+}
+
+func newBatchRepository(latency time.Duration) *batchRepository {
+	return &batchRepository{
+		latency: latency,
+		conns:   make(chan struct{}, 4),
+		voted:   make(map[uuid.UUID]struct{}),
+	}
+}
+
+func (r *batchRepository) transaction() {
+	r.conns <- struct{}{}
+	time.Sleep(r.latency)
+	<-r.conns
+}
+
+func (r *batchRepository) choice(p *repository.MakeChoiceParams) repository.MakeChoiceOutcome {
+	if _, ok := r.voted[p.UserID]; ok {
+		return repository.MakeChoiceOutcome{Err: infrastructure.ErrAlreadyVoted}
+	}
+	r.voted[p.UserID] = struct{}{}
+	return repository.MakeChoiceOutcome{Result: &repository.MakeChoiceResult{VotingID: p.InvarianceID}}
+}
+
+func (r *batchRepository) MakeChoice(_ context.Context, p *repository.MakeChoiceParams) (*repository.MakeChoiceResult, error) {
+	r.transaction()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	outcome := r.choice(p)
+	return outcome.Result, outcome.Err
+}
+
+func (r *batchRepository) MakeChoices(_ context.Context, params []*repository.MakeChoiceParams) ([]repository.MakeChoiceOutcome, error) {
+	r.transaction()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, len(params))
+	if r.failBatch {
+		return nil, errors.New("connection reset")
+	}
+
+	outcomes := make([]repository.MakeChoiceOutcome, 0, len(params))
+	for _, p := range params {
+		outcomes = append(outcomes, r.choice(p))
+	}
+	return outcomes, nil
+}
+
+func newBatchingService(t testing.TB, repo *batchRepository, ingest infrastructure.Ingest) *Voting {
+	t.Helper()
+
+	ingest.Batching = true
+	svc := NewVoting(infrastructure.NewDefaultLogger(), repo, &recordingPublisher{}, nopOutbox{}, ingest, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go svc.RunIngest(ctx)
+
+	return svc
+}
+
+// voteConcurrently makes a choice for every user at once, it returns the error of every choice.
+func voteConcurrently(svc *Voting, users []uuid.UUID) []error {
+	errs := make([]error, len(users))
+	var wg sync.WaitGroup
+	for i, user := range users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = svc.MakeChoice(context.Background(), &web.MakeChoiceRequest{InvarianceID: uuid.Nil, UserID: user})
+		}()
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func TestIngestBatchesConcurrentChoices(t *testing.T) {
+	repo := newBatchRepository(time.Millisecond)
+	svc := newBatchingService(t, repo, infrastructure.Ingest{MaxBatch: 50, MaxWait: 20 * time.Millisecond, Workers: 1})
+
+	// Every second user votes twice
+	users := make([]uuid.UUID, 0, 150)
+	for i := 0; i < 100; i++ {
+		user := uuid.New()
+		users = append(users, user)
+		if i%2 == 0 {
+			users = append(users, user)
+		}
+	}
+
+	errs := voteConcurrently(svc, users)
+
+	var succeeded, alreadyVoted int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case errors.Is(err, infrastructure.ErrAlreadyVoted):
+			alreadyVoted++
+		default:
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+	if succeeded != 100 || alreadyVoted != 50 {
+		t.Errorf("Expected 100 counted and 50 already voted choices, got %d and %d", succeeded, alreadyVoted)
+	}
+	if len(repo.batches) > 10 {
+		t.Errorf("Expected the choices in a few batches of at most 50, got %v", repo.batches)
+	}
+	for _, size := range repo.batches {
+		if size > 50 {
+			t.Errorf("Expected batches of at most 50 choices, got %d", size)
+		}
+	}
+}
+
+func TestIngestFailedBatchFallsBackToSingleChoices(t *testing.T) {
+	repo := newBatchRepository(0)
+	repo.failBatch = true
+	svc := newBatchingService(t, repo, infrastructure.Ingest{Workers: 1})
+
+	user := uuid.New()
+	errs := voteConcurrently(svc, []uuid.UUID{user, uuid.New(), user})
+
+	var alreadyVoted int
+	for _, err := range errs {
+		if errors.Is(err, infrastructure.ErrAlreadyVoted) {
+			alreadyVoted++
+		} else if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+	if alreadyVoted != 1 {
+		t.Errorf("Expected one already voted choice, got %d", alreadyVoted)
+	}
+}
+
+func TestIngestFailsPendingChoicesOnStop(t *testing.T) {
+	repo := newBatchRepository(0)
+	svc := NewVoting(infrastructure.NewDefaultLogger(), repo, &recordingPublisher{}, nopOutbox{},
+		infrastructure.Ingest{Batching: true, Workers: 1}, nil)
+
+	pending := make(chan error, 1)
+	go func() {
+		pending <- svc.MakeChoice(context.Background(), &web.MakeChoiceRequest{UserID: uuid.New()})
+	}()
+	for len(svc.batcher.requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The workers stop before taking the queued choice
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	svc.RunIngest(ctx)
+
+	select {
+	case err := <-pending:
+		if !errors.Is(err, infrastructure.ErrIngestStopped) {
+			t.Errorf("Expected %v for the queued choice, got %v", infrastructure.ErrIngestStopped, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the queued choice to fail on stop")
+	}
+
+	err := svc.MakeChoice(context.Background(), &web.MakeChoiceRequest{UserID: uuid.New()})
+	if !errors.Is(err, infrastructure.ErrIngestStopped) {
+		t.Errorf("Expected %v after stop, got %v", infrastructure.ErrIngestStopped, err)
+	}
+	if len(repo.batches) != 0 {
+		t.Errorf("Expected no batches written, got %v", repo.batches)
+	}
+}
+
+// BenchmarkMakeChoice compares choices made one by one with batches of the choiceBatcher, both go through
+// the service with 64 concurrent callers per CPU. The fake repository takes 1ms for a transaction
+// and its pool has 4 connections, the postgres one runs against the database of VOTING_TEST_PG_DSN.
+// Run with -cpu to vary the number of concurrent callers.
+func BenchmarkMakeChoice(b *testing.B) {
+	b.Run("fake", func(b *testing.B) {
+		benchmarkBatching(b, newBatchRepository(time.Millisecond), uuid.Nil)
+	})
+	b.Run("postgres", func(b *testing.B) {
+		repo, invarianceID := newBenchPostgres(b)
+		benchmarkBatching(b, repo, invarianceID)
+	})
+}
+
+func benchmarkBatching(b *testing.B, repo VotingRepository, invarianceID uuid.UUID) {
+	for _, batching := range []bool{false, true} {
+		name := "single"
+		if batching {
+			name = "batched"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			svc := NewVoting(infrastructure.NewDefaultLogger(), repo, &recordingPublisher{}, nopOutbox{},
+				infrastructure.Ingest{Batching: batching}, nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go svc.RunIngest(ctx)
+
+			b.SetParallelism(64)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					err := svc.MakeChoice(context.Background(), &web.MakeChoiceRequest{InvarianceID: invarianceID, UserID: uuid.New()})
+					if err != nil {
+						b.Errorf("Unexpected error: %v", err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// newBenchPostgres creates an open voting in the migrated database of VOTING_TEST_PG_DSN, it's removed
+// with its votes after the benchmark. The benchmark is skipped without the database.
+func newBenchPostgres(b *testing.B) (*repository.Voting, uuid.UUID) {
+	b.Helper()
+	ctx := context.Background()
+
+	dsn := os.Getenv("VOTING_TEST_PG_DSN")
+	if dsn == "" {
+		b.Skip("VOTING_TEST_PG_DSN is not set")
+	}
+
+	db, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		b.Fatalf("Unexpected error: %v", err)
+	}
+	b.Cleanup(db.Close)
+
+	repo := repository.NewVoting(db, infrastructure.NewReadRouter(infrastructure.NewDefaultLogger(), db, nil, 0))
+
+	now := time.Now().UTC()
+	created, err := repo.CreateVoting(ctx, &repository.CreateVotingParams{
+		Name:       "ingest",
+		StartAt:    now.Add(-time.Hour),
+		EndAt:      now.Add(time.Hour),
+		Invariance: []string{"yes"},
+	})
+	if err != nil {
+		b.Fatalf("Unexpected error: %v", err)
+	}
+	b.Cleanup(func() {
+		_ = repo.DeleteVoting(context.Background(), &repository.DeleteVotingParams{ID: created.ID})
+	})
+
+	item, err := repo.GetVoting(ctx, &repository.GetVotingRequest{ID: created.ID})
+	if err != nil {
+		b.Fatalf("Unexpected error: %v", err)
+	}
+
+	return repo, item.Invariance[0].ID
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"github.com/yvv4git/task-voting/internal/domain/repository"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+// tallyAggregator coalesces the votes of a voting, subscribers get its actual scores
+// once per flush instead of an event for every vote.
+type tallyAggregator struct {
+	mu      sync.Mutex
+	changed map[uuid.UUID]struct{}
+}
+
+func newTallyAggregator() *tallyAggregator {
+	return &tallyAggregator{
+		changed: make(map[uuid.UUID]struct{}),
+	}
+}
+
+// add marks the tally of the voting as changed, it must be called after the vote is committed.
+func (a *tallyAggregator) add(votingID uuid.UUID) {
+	a.mu.Lock()
+	a.changed[votingID] = struct{}{}
+	a.mu.Unlock()
+}
+
+// take returns the votings changed since the previous take.
+func (a *tallyAggregator) take() []uuid.UUID {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.changed) == 0 {
+		return nil
+	}
+
+	ids := make([]uuid.UUID, 0, len(a.changed))
+	for id := range a.changed {
+		ids = append(ids, id)
+	}
+	clear(a.changed)
+
+	return ids
+}
+
+// RunTally publishes voting.tally for every voting that got votes, at most once per interval, until ctx is done.
+// The tally is read after the votings are taken, so a vote committed during the flush is either
+// in this tally or marks the voting for the next one, the last state is never lost.
+func (v *Voting) RunTally(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Votes accepted before the shutdown are delivered as well
+			v.flushTally(context.WithoutCancel(ctx))
+			return
+		case <-ticker.C:
+			v.flushTally(ctx)
+		}
+	}
+}
+
+func (v *Voting) flushTally(ctx context.Context) {
+	// A replica may lag behind the votes, the tally must not go back
+	ctx = infrastructure.WithPrimaryReads(ctx)
+	for _, votingID := range v.tally.take() {
+		item, err := v.repo.GetVoting(ctx, &repository.GetVotingRequest{
+			ID: votingID,
+		})
+		if errors.Is(err, infrastructure.ErrObjectNotFound) {
+			// The voting is deleted, voting.deleted is published instead
+			continue
+		}
+		if err != nil {
+			v.logger.Error("get voting for tally", slog.String("voting_id", votingID.String()), slog.Any("error", err))
+			// Retried by the next flush
+			v.tally.add(votingID)
+			continue
+		}
+
+		v.publish(entity.EventVotingTally, votingID, item.Tags, repository.VotingPayload(*item))
+	}
+}
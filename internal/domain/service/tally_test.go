@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"github.com/yvv4git/task-voting/internal/domain/repository"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+	"github.com/yvv4git/task-voting/internal/interfaces/web"
+)
+
+type tallyRepository struct {
+	VotingRepository
+
+	mu    sync.Mutex
+	score map[uuid.UUID]int64
+	reads int
+}
+
+func (r *tallyRepository) MakeChoice(_ context.Context, p *repository.MakeChoiceParams) (*repository.MakeChoiceResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The invariance ID stands for the voting ID in the test
+	r.score[p.InvarianceID]++
+	return &repository.MakeChoiceResult{VotingID: p.InvarianceID}, nil
+}
+
+func (r *tallyRepository) GetVoting(_ context.Context, req *repository.GetVotingRequest) (*repository.VotingItem, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reads++
+	return &repository.VotingItem{
+		ID:         req.ID,
+		Invariance: []repository.InvarianceScore{{ID: req.ID, Score: r.score[req.ID]}},
+	}, nil
+}
+
+type recordingPublisher struct {
+	mu     sync.Mutex
+	events []entity.Event
+}
+
+func (p *recordingPublisher) PublishEvent(event entity.Event) {
+	p.mu.Lock()
+	p.events = append(p.events, event)
+	p.mu.Unlock()
+}
+
+func (p *recordingPublisher) tallies(t *testing.T) map[uuid.UUID]int64 {
+	t.Helper()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result := make(map[uuid.UUID]int64)
+	for _, event := range p.events {
+		if event.Type != entity.EventVotingTally {
+			t.Fatalf("Expected only %s events, got %s", entity.EventVotingTally, event.Type)
+		}
+		var item web.VotingItem
+		if err := json.Unmarshal(event.Payload, &item); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		result[item.ID] = item.Turnout
+	}
+	return result
+}
+
+type nopOutbox struct{}
+
+func (nopOutbox) Wake() {}
+
+func TestTallyCoalescesVotes(t *testing.T) {
+	repo := &tallyRepository{score: make(map[uuid.UUID]int64)}
+	publisher := &recordingPublisher{}
+	svc := NewVoting(infrastructure.NewDefaultLogger(), repo, publisher, nopOutbox{}, infrastructure.Ingest{}, nil)
+
+	first, second := uuid.New(), uuid.New()
+	for i := 0; i < 100; i++ {
+		if err := svc.MakeChoice(context.Background(), &web.MakeChoiceRequest{InvarianceID: first}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := svc.MakeChoice(context.Background(), &web.MakeChoiceRequest{InvarianceID: second}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	svc.flushTally(context.Background())
+
+	if repo.reads != 2 {
+		t.Errorf("Expected 2 reads for 101 votes, got %d", repo.reads)
+	}
+	tallies := publisher.tallies(t)
+	if len(publisher.events) != 2 || tallies[first] != 100 || tallies[second] != 1 {
+		t.Errorf("Expected one tally per voting with 100 and 1 votes, got %v", tallies)
+	}
+
+	// Nothing changed, nothing is published
+	svc.flushTally(context.Background())
+	if len(publisher.events) != 2 {
+		t.Errorf("Expected no tally without votes, got %d events", len(publisher.events))
+	}
+}
+
+func TestTallyFlushesOnShutdown(t *testing.T) {
+	repo := &tallyRepository{score: make(map[uuid.UUID]int64)}
+	publisher := &recordingPublisher{}
+	svc := NewVoting(infrastructure.NewDefaultLogger(), repo, publisher, nopOutbox{}, infrastructure.Ingest{}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		svc.RunTally(ctx, time.Hour)
+		close(done)
+	}()
+
+	votingID := uuid.New()
+	if err := svc.MakeChoice(context.Background(), &web.MakeChoiceRequest{InvarianceID: votingID}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cancel()
+	<-done
+
+	if tallies := publisher.tallies(t); tallies[votingID] != 1 {
+		t.Errorf("Expected the final tally on shutdown, got %v", tallies)
+	}
+}
@@ -2,10 +2,14 @@ package service
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"log/slog"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
 	"github.com/yvv4git/task-voting/internal/domain/repository"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
 	"github.com/yvv4git/task-voting/internal/interfaces/web"
 )
 
@@ -14,28 +18,65 @@ type VotingRepository interface {
 	CreateVoting(context.Context, *repository.CreateVotingParams) (*repository.CreateVotingResult, error)
 	UpdateVoting(context.Context, *repository.UpdateVotingParams) error
 	DeleteVoting(context.Context, *repository.DeleteVotingParams) error
-	MakeChoice(context.Context, *repository.MakeChoiceParams) error
+	MakeChoice(context.Context, *repository.MakeChoiceParams) (*repository.MakeChoiceResult, error)
+	MakeChoices(context.Context, []*repository.MakeChoiceParams) ([]repository.MakeChoiceOutcome, error)
+	GetVoting(context.Context, *repository.GetVotingRequest) (*repository.VotingItem, error)
+	InvarianceVoting(ctx context.Context, invarianceID uuid.UUID) (uuid.UUID, error)
+	CloserCheckedAt(ctx context.Context) (time.Time, error)
+	CloseEnded(ctx context.Context, r *repository.ListEndedRequest) (int, error)
 }
 
 type SubscriptionProcessor interface {
-	Broadcast(message []byte)
+	PublishEvent(event entity.Event)
+}
+
+// OutboxRelay publishes the events written by the repository in the transaction of the change.
+type OutboxRelay interface {
+	Wake()
 }
 
 type Voting struct {
 	logger       *slog.Logger
 	repo         VotingRepository
 	subscription SubscriptionProcessor
+	outbox       OutboxRelay
+	tally        *tallyAggregator
+	// batcher is nil when the choices are made one by one
+	batcher *choiceBatcher
+	// cache is nil when the reads aren't cached
+	cache *ResultCache
 }
 
-func NewVoting(logger *slog.Logger, repo VotingRepository, subscription SubscriptionProcessor) *Voting {
-	return &Voting{
+func NewVoting(
+	logger *slog.Logger,
+	repo VotingRepository,
+	subscription SubscriptionProcessor,
+	outbox OutboxRelay,
+	ingest infrastructure.Ingest,
+	cache *ResultCache,
+) *Voting {
+	v := &Voting{
 		logger:       logger,
 		repo:         repo,
 		subscription: subscription,
+		outbox:       outbox,
+		tally:        newTallyAggregator(),
+		cache:        cache,
+	}
+	if ingest.Batching {
+		v.batcher = newChoiceBatcher(ingest)
 	}
+
+	return v
 }
 
 func (v *Voting) List(ctx context.Context, r *web.ListVotingRequest) (*web.ListVotingResponse, error) {
+	key := listKey{limit: r.Limit, offset: r.Offset}
+	cached, generation, ok := v.cache.list(ctx, key)
+	if ok {
+		return cached, nil
+	}
+
 	data, err := v.repo.List(ctx, &repository.ListVotingRequest{
 		Limit:  r.Limit,
 		Offset: r.Offset,
@@ -46,37 +87,47 @@ func (v *Voting) List(ctx context.Context, r *web.ListVotingRequest) (*web.ListV
 
 	var result = make([]web.VotingItem, 0, len(data.Items))
 	for _, item := range data.Items {
-		var dstItem web.VotingItem
-		dstItem.ID = item.ID
-		dstItem.Name = item.Name
-		dstItem.Description = item.Description
-		dstItem.CreatedAt = item.CreatedAt
-		dstItem.StartAt = item.StartAt
-		dstItem.EndAt = item.EndAt
-		if len(item.Invariance) > 0 {
-			var dstScoreItems = make([]web.InvarianceScore, 0, len(item.Invariance))
-			for _, invariance := range item.Invariance {
-				var dstInvariance web.InvarianceScore
-				dstInvariance.ID = invariance.ID
-				dstInvariance.Name = invariance.Name
-				dstInvariance.Score = invariance.Score
-				dstScoreItems = append(dstScoreItems, dstInvariance)
-			}
-			dstItem.Invariance = dstScoreItems
-		}
-
-		result = append(result, dstItem)
+		result = append(result, votingItemToWeb(item))
 	}
 
-	return &web.ListVotingResponse{
+	response := &web.ListVotingResponse{
 		Items: result,
-	}, nil
+	}
+	v.cache.storeList(key, generation, response)
+
+	return response, nil
+}
+
+func votingItemToWeb(item repository.VotingItem) web.VotingItem {
+	var dstItem web.VotingItem
+	dstItem.ID = item.ID
+	dstItem.Name = item.Name
+	dstItem.Description = item.Description
+	dstItem.Tags = item.Tags
+	dstItem.CreatedAt = item.CreatedAt
+	dstItem.StartAt = item.StartAt
+	dstItem.EndAt = item.EndAt
+	if len(item.Invariance) > 0 {
+		var dstScoreItems = make([]web.InvarianceScore, 0, len(item.Invariance))
+		for _, invariance := range item.Invariance {
+			var dstInvariance web.InvarianceScore
+			dstInvariance.ID = invariance.ID
+			dstInvariance.Name = invariance.Name
+			dstInvariance.Score = invariance.Score
+			dstScoreItems = append(dstScoreItems, dstInvariance)
+			dstItem.Turnout += invariance.Score
+		}
+		dstItem.Invariance = dstScoreItems
+	}
+
+	return dstItem
 }
 
 func (v *Voting) CreateVoting(ctx context.Context, r *web.CreateVotingRequest) (*web.CreateVotingResponse, error) {
 	result, err := v.repo.CreateVoting(ctx, &repository.CreateVotingParams{
 		Name:        r.Name,
 		Description: r.Description,
+		Tags:        r.Tags,
 		StartAt:     r.StartAt,
 		EndAt:       r.EndAt,
 		Invariance:  r.Invariance,
@@ -85,54 +136,144 @@ func (v *Voting) CreateVoting(ctx context.Context, r *web.CreateVotingRequest) (
 		return nil, err
 	}
 
+	v.cache.invalidate(result.ID)
+	// voting.created is written to the outbox by the repository, don't wait for the next poll
+	v.outbox.Wake()
+
 	return &web.CreateVotingResponse{
 		ID: result.ID,
 	}, nil
 }
 
 func (v *Voting) UpdateVoting(ctx context.Context, r *web.UpdateVotingRequest) error {
-	return v.repo.UpdateVoting(ctx, &repository.UpdateVotingParams{
+	if err := v.repo.UpdateVoting(ctx, &repository.UpdateVotingParams{
 		ID:          r.ID,
 		Name:        r.Name,
 		Description: r.Description,
+		Tags:        r.Tags,
 		StartAt:     r.StartAt,
 		EndAt:       r.EndAt,
 		Invariance:  r.Invariance,
-	})
+	}); err != nil {
+		return err
+	}
+
+	v.cache.invalidate(r.ID)
+	v.outbox.Wake()
+
+	return nil
 }
 
 func (v *Voting) DeleteVoting(ctx context.Context, r *web.DeleteVotingRequest) error {
-	return v.repo.DeleteVoting(ctx, &repository.DeleteVotingParams{
+	if err := v.repo.DeleteVoting(ctx, &repository.DeleteVotingParams{
+		ID: r.ID,
+	}); err != nil {
+		return err
+	}
+
+	v.cache.invalidate(r.ID)
+	v.outbox.Wake()
+
+	return nil
+}
+
+func (v *Voting) GetVoting(ctx context.Context, r *web.GetVotingRequest) (*web.VotingItem, error) {
+	cached, generation, ok := v.cache.voting(ctx, r.ID)
+	if ok {
+		return cached, nil
+	}
+
+	item, err := v.repo.GetVoting(ctx, &repository.GetVotingRequest{
 		ID: r.ID,
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := votingItemToWeb(*item)
+	v.cache.storeVoting(r.ID, generation, &result)
+
+	return &result, nil
 }
 
 func (v *Voting) MakeChoice(ctx context.Context, r *web.MakeChoiceRequest) error {
-	const (
-		limit  = 100
-		offset = 0
+	params := &repository.MakeChoiceParams{
+		InvarianceID: r.InvarianceID,
+		UserID:       r.UserID,
+	}
+
+	var (
+		result *repository.MakeChoiceResult
+		err    error
 	)
-	defer func() {
-		listVoting, err := v.repo.List(ctx, &repository.ListVotingRequest{
-			Limit:  limit,
-			Offset: offset,
-		})
-		if err != nil {
-			// TODO: log
+	if v.batcher != nil {
+		result, err = v.batcher.makeChoice(ctx, params)
+	} else {
+		result, err = v.repo.MakeChoice(ctx, params)
+	}
+	if err != nil {
+		return err
+	}
+
+	// vote.cast is written to the outbox by the repository, don't wait for the next poll
+	v.outbox.Wake()
+	// The cache is dropped by the voting.tally of the vote
+	v.tally.add(result.VotingID)
+
+	return nil
+}
+
+// InvarianceVoting returns the voting of the invariance, e.g. to charge the votes of its invariance to the voting.
+func (v *Voting) InvarianceVoting(ctx context.Context, invarianceID uuid.UUID) (uuid.UUID, error) {
+	return v.repo.InvarianceVoting(ctx, invarianceID)
+}
+
+// RunCloser writes voting.closed with the final results of every voting whose end passed to the outbox, until ctx
+// is done. The checked interval is saved with the events, so the votings which ended while no instance ran
+// are announced after the start.
+func (v *Voting) RunCloser(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	checkedAt, err := v.repo.CloserCheckedAt(ctx)
+	if err != nil {
+		if !errors.Is(err, infrastructure.ErrObjectNotFound) {
+			v.logger.Error("get closer checked at", slog.Any("error", err))
+		}
+		checkedAt = time.Now()
+	}
+	checkedAt = checkedAt.UTC()
+
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-ticker.C:
 		}
 
-		payload, err := json.Marshal(listVoting)
+		now := time.Now().UTC()
+		closed, err := v.repo.CloseEnded(ctx, &repository.ListEndedRequest{
+			From: checkedAt,
+			To:   now,
+		})
 		if err != nil {
-			// TODO: log
-			return
+			v.logger.Error("close ended votings", slog.Any("error", err))
+			continue
+		}
+		checkedAt = now
+
+		if closed > 0 {
+			v.outbox.Wake()
 		}
+	}
+}
 
-		v.subscription.Broadcast(payload)
-	}()
+func (v *Voting) publish(eventType entity.EventType, votingID uuid.UUID, tags []string, payload any) {
+	event, err := entity.NewEvent(eventType, votingID, tags, payload)
+	if err != nil {
+		v.logger.Error("create event", slog.Any("error", err))
+		return
+	}
 
-	return v.repo.MakeChoice(ctx, &repository.MakeChoiceParams{
-		InvarianceID: r.InvarianceID,
-		UserID:       r.UserID,
-	})
+	v.subscription.PublishEvent(event)
 }
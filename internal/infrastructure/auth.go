@@ -14,8 +14,8 @@ type AuthStub struct {
 	users map[string]entity.User
 }
 
-func NewAuthStub() *AuthStub {
-	return &AuthStub{
+func NewAuthStub(admins []string) *AuthStub {
+	a := &AuthStub{
 		users: map[string]entity.User{
 			"user1": {
 				ID:       uuid.New(),
@@ -44,6 +44,15 @@ func NewAuthStub() *AuthStub {
 			},
 		},
 	}
+
+	for _, name := range admins {
+		if userEntity, ok := a.users[name]; ok {
+			userEntity.Admin = true
+			a.users[name] = userEntity
+		}
+	}
+
+	return a
 }
 
 func (a *AuthStub) CheckLoginPassword(_ context.Context, username, password string) error {
@@ -68,6 +77,10 @@ func (a *AuthStub) UserIDByLoginPassword(_ context.Context, username, password s
 	return userEntity.ID, nil
 }
 
+func (a *AuthStub) IsAdmin(_ context.Context, username string) bool {
+	return a.users[username].Admin
+}
+
 func ExtractBasicAuthValid(c *gin.Context) (string, string, error) {
 	authHeader := c.GetHeader("Authorization")
 
@@ -1,13 +1,25 @@
 package infrastructure
 
+import "time"
+
 type (
 	Config struct {
 		VotingApp VotingApplication `mapstructure:"voting_service"`
 	}
 
 	VotingApplication struct {
-		DataBase DB     `mapstructure:"db"`
-		WebAPI   WebAPI `mapstructure:"webapi"`
+		// Storage of votings, postgres, sqlite or memory. Stores of other components are kept in memory
+		// with the sqlite and memory storages, whatever their config.
+		Storage   string    `mapstructure:"storage"`
+		DataBase  DB        `mapstructure:"db"`
+		SQLite    SQLite    `mapstructure:"sqlite"`
+		WebAPI    WebAPI    `mapstructure:"webapi"`
+		Auth      Auth      `mapstructure:"auth"`
+		RateLimit RateLimit `mapstructure:"rate_limit"`
+		Events    Events    `mapstructure:"events"`
+		Webhooks  Webhooks  `mapstructure:"webhooks"`
+		Ingest    Ingest    `mapstructure:"ingest"`
+		Cache     Cache     `mapstructure:"cache"`
 	}
 
 	DB struct {
@@ -16,6 +28,15 @@ type (
 		Port     int    `mapstructure:"port"`
 		Username string `mapstructure:"username"`
 		Password string `mapstructure:"password"`
+		// Replicas are DSNs of streaming replicas for read-only queries, writes always go to the primary.
+		Replicas []string `mapstructure:"replicas"`
+		// ReadYourWrites is the window after a write of a user when their reads go to the primary, zero disables it.
+		ReadYourWrites time.Duration `mapstructure:"read_your_writes"`
+	}
+
+	SQLite struct {
+		// Path of the data file, it's created with the schema on the first start.
+		Path string `mapstructure:"path"`
 	}
 
 	WebAPI struct {
@@ -23,5 +44,315 @@ type (
 		Port            int    `mapstructure:"port"`
 		ReadTimeout     int    `mapstructure:"read_timeout"`
 		ShutdownTimeout int    `mapstructure:"shutdown_timeout"`
+		// TrustedProxies are the IPs and CIDRs of the proxies whose X-Forwarded-For is believed,
+		// empty trusts none and the client IP is the remote address of the connection.
+		TrustedProxies []string  `mapstructure:"trusted_proxies"`
+		WebSocket      WebSocket `mapstructure:"websocket"`
+	}
+
+	WebSocket struct {
+		// AllowedOrigins of browser handshakes, "*" allows any origin.
+		// The same origin and clients without Origin header are always allowed.
+		AllowedOrigins []string      `mapstructure:"allowed_origins"`
+		TicketSecret   string        `mapstructure:"ticket_secret"`
+		TicketTTL      time.Duration `mapstructure:"ticket_ttl"`
+		// SendQueueSize is the number of messages queued per client, a client with a full queue is evicted.
+		SendQueueSize int           `mapstructure:"send_queue_size"`
+		WriteWait     time.Duration `mapstructure:"write_wait"`
+		// PongWait is how long the client may stay silent, it's pinged every PingPeriod.
+		PongWait   time.Duration `mapstructure:"pong_wait"`
+		PingPeriod time.Duration `mapstructure:"ping_period"`
+		// HistorySize is the number of the latest events kept to replay them to reconnecting clients.
+		HistorySize int `mapstructure:"history_size"`
+		// PresenceInterval throttles the broadcasts of the number of viewers of a voting.
+		PresenceInterval time.Duration `mapstructure:"presence_interval"`
+	}
+
+	Auth struct {
+		Admins  []string `mapstructure:"admins"`
+		Lockout Lockout  `mapstructure:"lockout"`
+	}
+
+	// Lockout configures brute-force protection of the login.
+	// Zero values are replaced with defaults, see Lockout.WithDefaults.
+	Lockout struct {
+		Store           string        `mapstructure:"store"` // memory or postgres
+		FreeAttempts    int           `mapstructure:"free_attempts"`
+		UserMaxAttempts int           `mapstructure:"user_max_attempts"`
+		IPMaxAttempts   int           `mapstructure:"ip_max_attempts"`
+		BaseDelay       time.Duration `mapstructure:"base_delay"`
+		MaxDelay        time.Duration `mapstructure:"max_delay"`
+		LockoutDuration time.Duration `mapstructure:"lockout_duration"`
+		Window          time.Duration `mapstructure:"window"`
+	}
+
+	// RateLimit configures token buckets of the write endpoints.
+	// Zero values are replaced with defaults, see RateLimit.WithDefaults.
+	RateLimit struct {
+		Enabled   bool        `mapstructure:"enabled"`
+		Store     string      `mapstructure:"store"` // memory or postgres
+		Choice    TokenBucket `mapstructure:"choice"`
+		Write     TokenBucket `mapstructure:"write"`
+		PerVoting TokenBucket `mapstructure:"per_voting"`
+	}
+
+	Events struct {
+		// CloserInterval is how often ended votings are checked to publish voting.closed.
+		CloserInterval time.Duration `mapstructure:"closer_interval"`
+		// TallyInterval is how often the changed tallies of votings are published as voting.tally,
+		// a shorter interval lowers the latency, a longer one lowers the load under many votes.
+		TallyInterval time.Duration `mapstructure:"tally_interval"`
+		// PublishVotes sends every vote.cast to subscribers besides the tallies.
+		PublishVotes bool `mapstructure:"publish_votes"`
+		// Bus distributes events between instances, memory is enough for a single instance.
+		Bus     string `mapstructure:"bus"`
+		Channel string `mapstructure:"channel"` // postgres NOTIFY channel
+		// ReconnectDelay is the first delay before the listener reconnects, it doubles up to MaxReconnectDelay.
+		ReconnectDelay    time.Duration `mapstructure:"reconnect_delay"`
+		MaxReconnectDelay time.Duration `mapstructure:"max_reconnect_delay"`
+		Outbox            Outbox        `mapstructure:"outbox"`
+	}
+
+	Outbox struct {
+		// PollInterval is how often the relay looks for pending events, it's also woken up after every vote.
+		PollInterval time.Duration `mapstructure:"poll_interval"`
+		BatchSize    int           `mapstructure:"batch_size"`
+		// Delivered events are deleted after Retention, the cleanup runs every CleanupInterval.
+		Retention       time.Duration `mapstructure:"retention"`
+		CleanupInterval time.Duration `mapstructure:"cleanup_interval"`
+	}
+
+	Webhooks struct {
+		Store string `mapstructure:"store"`
+		// PollInterval is how often due deliveries are sent, at most BatchSize at once.
+		PollInterval time.Duration `mapstructure:"poll_interval"`
+		BatchSize    int           `mapstructure:"batch_size"`
+		Timeout      time.Duration `mapstructure:"timeout"` // of a single request
+		// MaxAttempts failed attempts move the delivery to the dead letter,
+		// retries are delayed from BaseDelay doubling up to MaxDelay.
+		MaxAttempts int           `mapstructure:"max_attempts"`
+		BaseDelay   time.Duration `mapstructure:"base_delay"`
+		MaxDelay    time.Duration `mapstructure:"max_delay"`
+		// Delivered and dead deliveries are deleted after Retention, the cleanup runs every CleanupInterval.
+		Retention       time.Duration `mapstructure:"retention"`
+		CleanupInterval time.Duration `mapstructure:"cleanup_interval"`
+	}
+
+	// Ingest configures batching of votes, concurrent votes are written by one transaction.
+	// Zero values are replaced with defaults, see Ingest.WithDefaults.
+	Ingest struct {
+		Batching bool `mapstructure:"batching"`
+		// MaxBatch votes at most are written at once, a batch waits for more votes up to MaxWait.
+		MaxBatch int           `mapstructure:"max_batch"`
+		MaxWait  time.Duration `mapstructure:"max_wait"`
+		// Workers write batches in parallel, each of them uses a connection.
+		Workers int `mapstructure:"workers"`
+	}
+
+	// Cache configures the cache of voting reads, events of a voting drop its entries.
+	// Zero values are replaced with defaults, see Cache.WithDefaults.
+	Cache struct {
+		Enabled bool `mapstructure:"enabled"`
+		// TTL drops entries without events too, e.g. events missed by the bus
+		TTL time.Duration `mapstructure:"ttl"`
+		// MaxAge of the Cache-Control of voting reads, zero makes clients revalidate every time.
+		MaxAge time.Duration `mapstructure:"max_age"`
+	}
+
+	TokenBucket struct {
+		Rate  float64 `mapstructure:"rate"` // tokens per second
+		Burst int     `mapstructure:"burst"`
 	}
 )
+
+const (
+	StoreMemory   = "memory"
+	StorePostgres = "postgres"
+	StoreSQLite   = "sqlite"
+)
+
+func (l Lockout) WithDefaults() Lockout {
+	if l.Store == "" {
+		l.Store = StoreMemory
+	}
+	if l.FreeAttempts <= 0 {
+		l.FreeAttempts = 3
+	}
+	if l.UserMaxAttempts <= 0 {
+		l.UserMaxAttempts = 10
+	}
+	if l.IPMaxAttempts <= 0 {
+		l.IPMaxAttempts = 50
+	}
+	if l.BaseDelay <= 0 {
+		l.BaseDelay = time.Second
+	}
+	if l.MaxDelay <= 0 {
+		l.MaxDelay = time.Minute
+	}
+	if l.LockoutDuration <= 0 {
+		l.LockoutDuration = 15 * time.Minute
+	}
+	if l.Window <= 0 {
+		l.Window = time.Hour
+	}
+
+	return l
+}
+
+func (r RateLimit) WithDefaults() RateLimit {
+	if r.Store == "" {
+		r.Store = StoreMemory
+	}
+	r.Choice = r.Choice.withDefaults(1, 5)
+	r.Write = r.Write.withDefaults(0.2, 10)
+	r.PerVoting = r.PerVoting.withDefaults(500, 1000)
+
+	return r
+}
+
+func (b TokenBucket) withDefaults(rate float64, burst int) TokenBucket {
+	if b.Rate <= 0 {
+		b.Rate = rate
+	}
+	if b.Burst <= 0 {
+		b.Burst = burst
+	}
+
+	return b
+}
+
+func (s SQLite) WithDefaults() SQLite {
+	if s.Path == "" {
+		s.Path = "voting.db"
+	}
+
+	return s
+}
+
+func (w WebSocket) WithDefaults() WebSocket {
+	if w.TicketTTL <= 0 {
+		w.TicketTTL = 10 * time.Second
+	}
+	if w.SendQueueSize <= 0 {
+		w.SendQueueSize = 256
+	}
+	if w.WriteWait <= 0 {
+		w.WriteWait = 10 * time.Second
+	}
+	if w.PongWait <= 0 {
+		w.PongWait = 60 * time.Second
+	}
+	if w.PingPeriod <= 0 || w.PingPeriod >= w.PongWait {
+		w.PingPeriod = w.PongWait * 9 / 10
+	}
+	if w.HistorySize <= 0 {
+		w.HistorySize = 1024
+	}
+	if w.PresenceInterval <= 0 {
+		w.PresenceInterval = time.Second
+	}
+
+	return w
+}
+
+func (e Events) WithDefaults() Events {
+	if e.CloserInterval <= 0 {
+		e.CloserInterval = time.Second
+	}
+	if e.TallyInterval <= 0 {
+		e.TallyInterval = 250 * time.Millisecond
+	}
+	if e.Bus == "" {
+		e.Bus = StoreMemory
+	}
+	if e.Channel == "" {
+		e.Channel = "voting_events"
+	}
+	if e.ReconnectDelay <= 0 {
+		e.ReconnectDelay = 100 * time.Millisecond
+	}
+	if e.MaxReconnectDelay <= 0 {
+		e.MaxReconnectDelay = 10 * time.Second
+	}
+	if e.MaxReconnectDelay < e.ReconnectDelay {
+		e.MaxReconnectDelay = e.ReconnectDelay
+	}
+	e.Outbox = e.Outbox.WithDefaults()
+
+	return e
+}
+
+func (o Outbox) WithDefaults() Outbox {
+	if o.PollInterval <= 0 {
+		o.PollInterval = time.Second
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+	if o.Retention <= 0 {
+		o.Retention = time.Hour
+	}
+	if o.CleanupInterval <= 0 {
+		o.CleanupInterval = time.Minute
+	}
+
+	return o
+}
+
+func (w Webhooks) WithDefaults() Webhooks {
+	if w.Store == "" {
+		w.Store = StoreMemory
+	}
+	if w.PollInterval <= 0 {
+		w.PollInterval = time.Second
+	}
+	if w.BatchSize <= 0 {
+		w.BatchSize = 50
+	}
+	if w.Timeout <= 0 {
+		w.Timeout = 10 * time.Second
+	}
+	if w.MaxAttempts <= 0 {
+		w.MaxAttempts = 8
+	}
+	if w.BaseDelay <= 0 {
+		w.BaseDelay = time.Second
+	}
+	if w.MaxDelay < w.BaseDelay {
+		w.MaxDelay = max(10*time.Minute, w.BaseDelay)
+	}
+	if w.Retention <= 0 {
+		w.Retention = 7 * 24 * time.Hour
+	}
+	if w.CleanupInterval <= 0 {
+		w.CleanupInterval = 10 * time.Minute
+	}
+
+	return w
+}
+
+func (i Ingest) WithDefaults() Ingest {
+	if i.MaxBatch <= 0 {
+		i.MaxBatch = 500
+	}
+	if i.MaxWait <= 0 {
+		i.MaxWait = 2 * time.Millisecond
+	}
+	if i.Workers <= 0 {
+		i.Workers = 4
+	}
+
+	return i
+}
+
+func (c Cache) WithDefaults() Cache {
+	if c.TTL <= 0 {
+		c.TTL = time.Minute
+	}
+	if c.MaxAge < 0 {
+		c.MaxAge = 0
+	}
+
+	return c
+}
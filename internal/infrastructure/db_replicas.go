@@ -0,0 +1,178 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// replicaCooldown is the time a failed replica is skipped, the reads go to the other replicas or to the primary.
+const replicaCooldown = 5 * time.Second
+
+type readContextKey string
+
+const (
+	readUserKey    readContextKey = "readUser"
+	readPrimaryKey readContextKey = "readPrimary"
+)
+
+// WithReadUser stores the user of the reads in the context, reads of a user who just wrote go to the primary.
+func WithReadUser(ctx context.Context, userID uuid.UUID) context.Context {
+	return context.WithValue(ctx, readUserKey, userID)
+}
+
+// ReadUserFromContext returns the user stored by WithReadUser.
+func ReadUserFromContext(ctx context.Context) (uuid.UUID, bool) {
+	userID, ok := ctx.Value(readUserKey).(uuid.UUID)
+	return userID, ok
+}
+
+// WithPrimaryReads sends the reads of the context to the primary, e.g. for the state published in events.
+func WithPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readPrimaryKey, true)
+}
+
+// PrimaryReadsFromContext tells whether the reads of the context were sent to the primary by WithPrimaryReads.
+func PrimaryReadsFromContext(ctx context.Context) bool {
+	primary, _ := ctx.Value(readPrimaryKey).(bool)
+	return primary
+}
+
+// NewPostgresReplicas connects to the replicas by their DSNs.
+func NewPostgresReplicas(ctx context.Context, cfg DB) ([]*pgxpool.Pool, error) {
+	replicas := make([]*pgxpool.Pool, 0, len(cfg.Replicas))
+	for i, dsn := range cfg.Replicas {
+		pool, err := pgxpool.New(ctx, dsn)
+		if err != nil {
+			for _, replica := range replicas {
+				replica.Close()
+			}
+			return nil, fmt.Errorf("create replica %d connection: %w", i, err)
+		}
+		replicas = append(replicas, pool)
+	}
+
+	return replicas, nil
+}
+
+type replica struct {
+	db Queryer
+	// downUntil is the unix nano time the replica is skipped until
+	downUntil atomic.Int64
+}
+
+// ReadRouter is the Queryer of read-only queries. Queries are spread over the replicas and fall back to the primary
+// when every replica failed. With read-your-writes, a user reads from the primary for the window after their write.
+// The writes are known to this instance only, a user whose next request goes to another instance may read a replica.
+type ReadRouter struct {
+	log            *slog.Logger
+	primary        Queryer
+	replicas       []*replica
+	next           atomic.Uint64
+	readYourWrites time.Duration
+	now            func() time.Time
+
+	mu      sync.Mutex
+	writes  map[uuid.UUID]time.Time
+	sweptAt time.Time
+}
+
+// NewReadRouter routes the reads to replicas, without replicas every read goes to the primary.
+func NewReadRouter(log *slog.Logger, primary Queryer, replicas []Queryer, readYourWrites time.Duration) *ReadRouter {
+	r := &ReadRouter{
+		log:            log,
+		primary:        primary,
+		replicas:       make([]*replica, 0, len(replicas)),
+		readYourWrites: readYourWrites,
+		now:            time.Now,
+		writes:         make(map[uuid.UUID]time.Time),
+	}
+	for _, db := range replicas {
+		r.replicas = append(r.replicas, &replica{db: db})
+	}
+
+	return r
+}
+
+// Wrote records the write of the user, their reads go to the primary for the read-your-writes window.
+func (r *ReadRouter) Wrote(userID uuid.UUID) {
+	if r.readYourWrites <= 0 || len(r.replicas) == 0 {
+		return
+	}
+
+	now := r.now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.writes[userID] = now.Add(r.readYourWrites)
+
+	// Expired writes are dropped once per window, the map holds the users of the last two windows at most
+	if now.Sub(r.sweptAt) < r.readYourWrites {
+		return
+	}
+	r.sweptAt = now
+	for user, until := range r.writes {
+		if !now.Before(until) {
+			delete(r.writes, user)
+		}
+	}
+}
+
+// Query runs the read-only query on a replica, on the primary when none of them is available.
+func (r *ReadRouter) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	if r.primaryRequired(ctx) {
+		return r.primary.Query(ctx, sql, args...)
+	}
+
+	now := r.now()
+	start := r.next.Add(1)
+	for i := range r.replicas {
+		replica := r.replicas[(start+uint64(i))%uint64(len(r.replicas))]
+		if now.UnixNano() < replica.downUntil.Load() {
+			continue
+		}
+
+		rows, err := replica.db.Query(ctx, sql, args...)
+		if err == nil {
+			return rows, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		r.log.Warn("replica query failed", slog.Any("error", err))
+		replica.downUntil.Store(now.Add(replicaCooldown).UnixNano())
+	}
+
+	return r.primary.Query(ctx, sql, args...)
+}
+
+func (r *ReadRouter) primaryRequired(ctx context.Context) bool {
+	if len(r.replicas) == 0 || PrimaryReadsFromContext(ctx) {
+		return true
+	}
+
+	return r.InReadYourWrites(ctx)
+}
+
+// InReadYourWrites tells whether the user of the context wrote on this instance within the read-your-writes window.
+func (r *ReadRouter) InReadYourWrites(ctx context.Context) bool {
+	userID, ok := ReadUserFromContext(ctx)
+	if !ok || r.readYourWrites <= 0 {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	until, ok := r.writes[userID]
+	return ok && r.now().Before(until)
+}
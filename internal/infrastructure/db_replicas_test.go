@@ -0,0 +1,102 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// namedQueryer records its queries, it fails every query when err is set.
+type namedQueryer struct {
+	queries int
+	err     error
+}
+
+func (q *namedQueryer) Query(_ context.Context, _ string, _ ...interface{}) (pgx.Rows, error) {
+	q.queries++
+	return nil, q.err
+}
+
+func TestReadRouterSpreadsReadsOverReplicas(t *testing.T) {
+	primary, first, second := &namedQueryer{}, &namedQueryer{}, &namedQueryer{}
+	router := NewReadRouter(NewDefaultLogger(), primary, []Queryer{first, second}, 0)
+
+	for i := 0; i < 10; i++ {
+		if _, err := router.Query(context.Background(), "SELECT 1"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if primary.queries != 0 || first.queries != 5 || second.queries != 5 {
+		t.Errorf("Expected 5 reads per replica, got primary %d, replicas %d and %d", primary.queries, first.queries, second.queries)
+	}
+
+	if _, err := router.Query(WithPrimaryReads(context.Background()), "SELECT 1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if primary.queries != 1 {
+		t.Errorf("Expected the primary read, got %d", primary.queries)
+	}
+}
+
+func TestReadRouterFallsBackToPrimary(t *testing.T) {
+	primary, replica := &namedQueryer{}, &namedQueryer{err: errors.New("connection refused")}
+	router := NewReadRouter(NewDefaultLogger(), primary, []Queryer{replica}, 0)
+	now := time.Now()
+	router.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, err := router.Query(context.Background(), "SELECT 1"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if primary.queries != 3 || replica.queries != 1 {
+		t.Errorf("Expected the failed replica skipped, got primary %d and replica %d", primary.queries, replica.queries)
+	}
+
+	// The replica is tried again after the cooldown
+	replica.err = nil
+	now = now.Add(replicaCooldown)
+	if _, err := router.Query(context.Background(), "SELECT 1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if replica.queries != 2 {
+		t.Errorf("Expected the read from the recovered replica, got %d", replica.queries)
+	}
+}
+
+func TestReadRouterReadYourWrites(t *testing.T) {
+	primary, replica := &namedQueryer{}, &namedQueryer{}
+	router := NewReadRouter(NewDefaultLogger(), primary, []Queryer{replica}, time.Second)
+	now := time.Now()
+	router.now = func() time.Time { return now }
+
+	writer, reader := uuid.New(), uuid.New()
+	router.Wrote(writer)
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		primary bool
+	}{
+		{name: "writer", ctx: WithReadUser(context.Background(), writer), primary: true},
+		{name: "other user", ctx: WithReadUser(context.Background(), reader), primary: false},
+		{name: "no user", ctx: context.Background(), primary: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := router.primaryRequired(tt.ctx); got != tt.primary {
+				t.Errorf("Expected primary %v, got %v", tt.primary, got)
+			}
+		})
+	}
+
+	now = now.Add(time.Second)
+	if router.primaryRequired(WithReadUser(context.Background(), writer)) {
+		t.Errorf("Expected the writer back on the replicas after the window")
+	}
+}
@@ -0,0 +1,129 @@
+package infrastructure
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	// The driver is pure Go, the binary is built without cgo
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// sqliteBusyTimeout is how long a statement waits for the lock of the data file held by another process.
+	sqliteBusyTimeout = 5000 // milliseconds
+
+	gooseUp   = "-- +goose Up"
+	gooseDown = "-- +goose Down"
+)
+
+// NewSQLiteDB opens the data file of the sqlite storage, it's created when missing, and applies the migrations.
+// The file has a single writer, so the pool keeps a single connection and the writes of the service queue up
+// in Go instead of failing with SQLITE_BUSY.
+func NewSQLiteDB(ctx context.Context, cfg SQLite, migrations fs.FS) (*sql.DB, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(%d)",
+		cfg.Path, sqliteBusyTimeout)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open data file: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	if err = MigrateSQLite(ctx, db, migrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+
+	return db, nil
+}
+
+// MigrateSQLite applies the Up sections of the goose migrations at the root of migrations which aren't applied yet,
+// every migration by its own transaction. Applied versions are kept in schema_migrations.
+func MigrateSQLite(ctx context.Context, db *sql.DB, migrations fs.FS) error {
+	if _, err := db.ExecContext(ctx,
+		"CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+	); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	files, err := fs.Glob(migrations, "*.sql")
+	if err != nil {
+		return fmt.Errorf("list migrations: %w", err)
+	}
+	slices.Sort(files)
+
+	for _, file := range files {
+		version, err := migrationVersion(file)
+		if err != nil {
+			return err
+		}
+
+		var applied bool
+		if err = db.QueryRowContext(ctx,
+			"SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = ?)", version,
+		).Scan(&applied); err != nil {
+			return fmt.Errorf("check migration %s: %w", file, err)
+		}
+		if applied {
+			continue
+		}
+
+		content, err := fs.ReadFile(migrations, file)
+		if err != nil {
+			return fmt.Errorf("read migration %s: %w", file, err)
+		}
+
+		if err = applyMigration(ctx, db, version, gooseUpSection(string(content))); err != nil {
+			return fmt.Errorf("apply migration %s: %w", file, err)
+		}
+	}
+
+	return nil
+}
+
+// migrationVersion is the number before the first underscore of the name, as goose names the files.
+func migrationVersion(file string) (int64, error) {
+	name := path.Base(file)
+	prefix, _, _ := strings.Cut(name, "_")
+
+	version, err := strconv.ParseInt(prefix, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("version of migration %s: %w", file, err)
+	}
+
+	return version, nil
+}
+
+// gooseUpSection is the SQL between the Up and Down annotations, the other annotations are comments.
+func gooseUpSection(content string) string {
+	_, up, found := strings.Cut(content, gooseUp)
+	if !found {
+		return ""
+	}
+	up, _, _ = strings.Cut(up, gooseDown)
+
+	return up
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, version int64, stmt string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, stmt); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES (?)", version); err != nil {
+		return fmt.Errorf("record version: %w", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,62 @@
+package infrastructure
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMigrateSQLiteAppliesPendingMigrations(t *testing.T) {
+	ctx := context.Background()
+	migrations := fstest.MapFS{
+		"20240101000000_create_table_a.sql": {Data: []byte("-- +goose Up\nCREATE TABLE a (id INTEGER);\n\n-- +goose Down\nDROP TABLE a;\n")},
+	}
+
+	db, err := NewSQLiteDB(ctx, SQLite{Path: filepath.Join(t.TempDir(), "voting.db")}, migrations)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+
+	// Applied migrations are skipped, the Down section is never run
+	migrations["20240102000000_add_table_b.sql"] = &fstest.MapFile{
+		Data: []byte("-- +goose Up\n-- +goose StatementBegin\nCREATE TABLE b (id INTEGER);\nINSERT INTO a VALUES (1);\n-- +goose StatementEnd\n"),
+	}
+	if err = MigrateSQLite(ctx, db, migrations); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err = MigrateSQLite(ctx, db, migrations); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var rows, versions int
+	if err = db.QueryRowContext(ctx, "SELECT count(*) FROM a").Scan(&rows); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err = db.QueryRowContext(ctx, "SELECT count(*) FROM schema_migrations").Scan(&versions); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if rows != 1 || versions != 2 {
+		t.Errorf("Expected every migration applied once, got %d rows and %d versions", rows, versions)
+	}
+}
+
+func TestMigrateSQLiteRollsBackFailedMigration(t *testing.T) {
+	ctx := context.Background()
+	migrations := fstest.MapFS{
+		"20240101000000_broken.sql": {Data: []byte("-- +goose Up\nCREATE TABLE a (id INTEGER);\nINSERT INTO missing VALUES (1);\n")},
+	}
+
+	path := filepath.Join(t.TempDir(), "voting.db")
+	if _, err := NewSQLiteDB(ctx, SQLite{Path: path}, migrations); err == nil {
+		t.Fatalf("Expected an error of the broken migration")
+	}
+
+	migrations["20240101000000_broken.sql"].Data = []byte("-- +goose Up\nCREATE TABLE a (id INTEGER);\n")
+	db, err := NewSQLiteDB(ctx, SQLite{Path: path}, migrations)
+	if err != nil {
+		t.Fatalf("Expected the fixed migration to apply, got %v", err)
+	}
+	db.Close()
+}
@@ -0,0 +1,241 @@
+package infrastructure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	votingv1 "github.com/yvv4git/task-voting/api/proto/voting/v1"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Encoding of the events sent to a subscriber, binary encodings are sent as binary frames.
+type Encoding string
+
+const (
+	EncodingJSON Encoding = "json"
+	// EncodingMsgPack is the JSON of the event encoded as MessagePack, the keys are the same.
+	EncodingMsgPack Encoding = "msgpack"
+	// EncodingProtobuf is votingv1.Event generated from api/proto/voting/v1/events.proto.
+	EncodingProtobuf Encoding = "protobuf"
+)
+
+// Binary reports whether the encoded events are sent as binary frames.
+func (e Encoding) Binary() bool {
+	return e == EncodingMsgPack || e == EncodingProtobuf
+}
+
+// encodedEvent is encoded once per encoding and shared by the clients and the history,
+// it's accessed under the lock of the Subscription.
+type encodedEvent struct {
+	event  entity.Event
+	frames map[Encoding][]byte
+}
+
+func newEncodedEvent(event entity.Event) (*encodedEvent, error) {
+	message, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encodedEvent{
+		event:  event,
+		frames: map[Encoding][]byte{EncodingJSON: message},
+	}, nil
+}
+
+func (e *encodedEvent) frame(encoding Encoding) ([]byte, error) {
+	if frame, ok := e.frames[encoding]; ok {
+		return frame, nil
+	}
+
+	var (
+		frame []byte
+		err   error
+	)
+	switch encoding {
+	case EncodingMsgPack:
+		frame, err = jsonToMsgPack(e.frames[EncodingJSON])
+	case EncodingProtobuf:
+		frame, err = eventToProtobuf(e.event)
+	default:
+		return nil, fmt.Errorf("unknown encoding: %s", encoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encode %s as %s: %w", e.event.Type, encoding, err)
+	}
+
+	e.frames[encoding] = frame
+	return frame, nil
+}
+
+// jsonToMsgPack converts the JSON document to MessagePack, the map keys are sorted
+// and the integers are written in the smallest format.
+func jsonToMsgPack(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	value, err := msgPackNumbers(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetSortMapKeys(true)
+	encoder.UseCompactInts(true)
+	if err = encoder.Encode(value); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// msgPackNumbers replaces the JSON numbers with integers, or floats when they have a fraction.
+func msgPackNumbers(value any) (any, error) {
+	switch v := value.(type) {
+	case json.Number:
+		if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return u, nil
+		}
+		if i, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case []any:
+		for i, item := range v {
+			var err error
+			if v[i], err = msgPackNumbers(item); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]any:
+		for key, item := range v {
+			var err error
+			if v[key], err = msgPackNumbers(item); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return value, nil
+}
+
+// The JSON payloads of the events, they are decoded to be encoded as protobuf.
+type (
+	invariancePayload struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		Score int64  `json:"score"`
+	}
+
+	votingPayload struct {
+		ID          string              `json:"id"`
+		Name        string              `json:"name"`
+		Description string              `json:"description"`
+		Tags        []string            `json:"tags"`
+		CreatedAt   time.Time           `json:"created_at"`
+		StartAt     time.Time           `json:"startAt"`
+		EndAt       time.Time           `json:"endAt"`
+		Invariance  []invariancePayload `json:"invariance"`
+		Turnout     int64               `json:"turnout"`
+	}
+
+	snapshotPayload struct {
+		Items []votingPayload `json:"items"`
+	}
+)
+
+func eventToProtobuf(event entity.Event) ([]byte, error) {
+	message := &votingv1.Event{
+		Id:       event.ID.String(),
+		Version:  int32(event.Version),
+		Type:     string(event.Type),
+		VotingId: event.VotingID.String(),
+		Tags:     event.Tags,
+		Sequence: event.Sequence,
+		Epoch:    event.Epoch,
+	}
+
+	// The payload may be dropped by the bus, the event goes without it then
+	if len(event.Payload) > 0 && string(event.Payload) != "null" {
+		if err := setProtoPayload(message, event); err != nil {
+			return nil, err
+		}
+	}
+
+	return proto.MarshalOptions{Deterministic: true}.Marshal(message)
+}
+
+func setProtoPayload(message *votingv1.Event, event entity.Event) error {
+	switch event.Type {
+	case entity.EventVotingCreated, entity.EventVotingUpdated, entity.EventVotingClosed, entity.EventVotingTally:
+		var payload votingPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		message.Payload = &votingv1.Event_Voting{Voting: protoVoting(payload)}
+	case entity.EventVoteCast:
+		var payload entity.VoteCastPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		message.Payload = &votingv1.Event_VoteCast{VoteCast: &votingv1.VoteCast{
+			InvarianceId: payload.InvarianceID.String(),
+			Score:        payload.Score,
+			Turnout:      payload.Turnout,
+		}}
+	case entity.EventPresence:
+		var payload entity.PresencePayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		message.Payload = &votingv1.Event_Presence{Presence: &votingv1.Presence{Viewers: int64(payload.Viewers)}}
+	case entity.EventSnapshot:
+		var payload snapshotPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		snapshot := &votingv1.Snapshot{Items: make([]*votingv1.Voting, 0, len(payload.Items))}
+		for _, item := range payload.Items {
+			snapshot.Items = append(snapshot.Items, protoVoting(item))
+		}
+		message.Payload = &votingv1.Event_Snapshot{Snapshot: snapshot}
+	default:
+		return fmt.Errorf("no protobuf payload for %s", event.Type)
+	}
+
+	return nil
+}
+
+func protoVoting(voting votingPayload) *votingv1.Voting {
+	message := &votingv1.Voting{
+		Id:          voting.ID,
+		Name:        voting.Name,
+		Description: voting.Description,
+		Tags:        voting.Tags,
+		CreatedAt:   timestamppb.New(voting.CreatedAt),
+		StartAt:     timestamppb.New(voting.StartAt),
+		EndAt:       timestamppb.New(voting.EndAt),
+		Turnout:     voting.Turnout,
+	}
+	for _, invariance := range voting.Invariance {
+		message.Invariance = append(message.Invariance, &votingv1.Invariance{
+			Id:    invariance.ID,
+			Name:  invariance.Name,
+			Score: invariance.Score,
+		})
+	}
+
+	return message
+}
@@ -0,0 +1,173 @@
+package infrastructure
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+	votingv1 "github.com/yvv4git/task-voting/api/proto/voting/v1"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestJSONToMsgPack(t *testing.T) {
+	data, err := jsonToMsgPack([]byte(`{"b": [1, -1, 300, "x", null, true, 1.5], "a": {}}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The keys are sorted and the integers are compact
+	expected := []byte{
+		0x82,
+		0xa1, 'a', 0x80,
+		0xa1, 'b', 0x97, 0x01, 0xff, 0xcd, 0x01, 0x2c, 0xa1, 'x', 0xc0, 0xc3,
+		0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Expected % x, got % x", expected, data)
+	}
+}
+
+func TestEncodedEventMsgPackRoundTrip(t *testing.T) {
+	event, _ := entity.NewEvent(entity.EventVoteCast, uuid.New(), []string{"team-a"}, entity.VoteCastPayload{
+		InvarianceID: uuid.New(),
+		Score:        7,
+		Turnout:      300,
+	})
+	event.Epoch, event.Sequence = "k3x9", 42
+
+	encoded, err := newEncodedEvent(event)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := encoded.frame(EncodingMsgPack)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The keys are the same as of the JSON event
+	var decoded struct {
+		ID       string   `msgpack:"id"`
+		Type     string   `msgpack:"type"`
+		Tags     []string `msgpack:"tags"`
+		Epoch    string   `msgpack:"epoch"`
+		Sequence uint64   `msgpack:"sequence"`
+		Payload  struct {
+			InvarianceID string `msgpack:"invariance_id"`
+			Score        int64  `msgpack:"score"`
+			Turnout      int64  `msgpack:"turnout"`
+		} `msgpack:"payload"`
+	}
+	if err = msgpack.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decoded.ID != event.ID.String() || decoded.Type != string(event.Type) || decoded.Epoch != event.Epoch ||
+		decoded.Sequence != 42 || len(decoded.Tags) != 1 || decoded.Payload.Score != 7 || decoded.Payload.Turnout != 300 {
+		t.Errorf("Unexpected decoded event: %+v", decoded)
+	}
+}
+
+func TestEncodedEventProtobuf(t *testing.T) {
+	invarianceID := uuid.New()
+	event, err := entity.NewEvent(entity.EventVoteCast, uuid.New(), []string{"team-a"}, entity.VoteCastPayload{
+		InvarianceID: invarianceID,
+		Score:        7,
+		Turnout:      300,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	event.Epoch, event.Sequence = "k3x9", 42
+
+	encoded, err := newEncodedEvent(event)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := encoded.frame(EncodingProtobuf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var decoded votingv1.Event
+	if err = proto.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decoded.GetId() != event.ID.String() || decoded.GetType() != string(entity.EventVoteCast) ||
+		decoded.GetVotingId() != event.VotingID.String() || decoded.GetVersion() != entity.EventVersion {
+		t.Errorf("Unexpected envelope: %v", &decoded)
+	}
+	if decoded.GetEpoch() != "k3x9" || decoded.GetSequence() != 42 {
+		t.Errorf("Expected the cursor k3x9:42, got %s:%d", decoded.GetEpoch(), decoded.GetSequence())
+	}
+
+	voteCast := decoded.GetVoteCast()
+	if voteCast.GetInvarianceId() != invarianceID.String() || voteCast.GetScore() != 7 || voteCast.GetTurnout() != 300 {
+		t.Errorf("Expected vote_cast of %s with score 7 and turnout 300, got %v", invarianceID, voteCast)
+	}
+
+	// Every encoding is made once and shared by the clients
+	again, _ := encoded.frame(EncodingProtobuf)
+	if &again[0] != &data[0] {
+		t.Errorf("Expected the encoded frame to be reused")
+	}
+}
+
+func TestEncodedSnapshotProtobuf(t *testing.T) {
+	endAt := time.Date(2024, 9, 30, 12, 0, 0, 0, time.UTC)
+	event, _ := entity.NewEvent(entity.EventSnapshot, uuid.Nil, nil, snapshotPayload{
+		Items: []votingPayload{{
+			ID:         uuid.NewString(),
+			Name:       "lunch",
+			Tags:       []string{"team-a"},
+			EndAt:      endAt,
+			Invariance: []invariancePayload{{ID: uuid.NewString(), Name: "pizza", Score: 3}},
+			Turnout:    3,
+		}},
+	})
+
+	encoded, _ := newEncodedEvent(event)
+	data, err := encoded.frame(EncodingProtobuf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var decoded votingv1.Event
+	if err = proto.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	items := decoded.GetSnapshot().GetItems()
+	if len(items) != 1 || items[0].GetName() != "lunch" || !items[0].GetEndAt().AsTime().Equal(endAt) ||
+		len(items[0].GetInvariance()) != 1 || items[0].GetInvariance()[0].GetScore() != 3 {
+		t.Errorf("Unexpected snapshot: %v", items)
+	}
+}
+
+func TestEncodedEventWithoutPayload(t *testing.T) {
+	event, _ := entity.NewEvent(entity.EventVotingDeleted, uuid.New(), nil, nil)
+	encoded, err := newEncodedEvent(event)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	data, err := encoded.frame(EncodingProtobuf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var decoded votingv1.Event
+	if err = proto.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decoded.GetPayload() != nil {
+		t.Errorf("Expected no payload for %s, got %v", entity.EventVotingDeleted, decoded.GetPayload())
+	}
+
+	data, err = encoded.frame(EncodingMsgPack)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Contains(data, []byte("\xa7payload\xc0")) {
+		t.Errorf("Expected nil payload in % x", data)
+	}
+}
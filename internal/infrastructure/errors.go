@@ -6,4 +6,21 @@ var (
 	ErrObjectNotFound   = errors.New("object not found")
 	ErrAuthUserNotFound = errors.New("user not found")
 	ErrAuthInvalidCred  = errors.New("invalid credentials")
+
+	ErrAuthTooManyAttempts = errors.New("too many login attempts")
+
+	ErrInvarianceNotFound = errors.New("invariance not found")
+	ErrVotingFinished     = errors.New("voting is finished")
+	ErrAlreadyVoted       = errors.New("user already voted")
+	ErrIngestStopped      = errors.New("ingest is stopped")
+
+	ErrTicketInvalid = errors.New("invalid ticket")
+	ErrTicketExpired = errors.New("ticket expired")
+	ErrTicketUsed    = errors.New("ticket already used")
+
+	ErrTicketWeakSecret = errors.New("ticket_secret must be at least 32 bytes and not the example value")
+
+	ErrEventTooLarge = errors.New("event is too large for the bus")
+
+	ErrWebhookInvalidURL = errors.New("webhook url must be an absolute http or https url")
 )
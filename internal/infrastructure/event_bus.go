@@ -0,0 +1,201 @@
+package infrastructure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+)
+
+// EventBus carries encoded events between instances.
+type EventBus interface {
+	Publish(ctx context.Context, payload []byte) error
+	// Listen calls handle for every payload published by any instance, including this one.
+	// It blocks until ctx is done or the connection fails.
+	Listen(ctx context.Context, handle func(payload []byte)) error
+}
+
+// EventPublisher is implemented by Subscription.
+type EventPublisher interface {
+	PublishEvent(event entity.Event)
+}
+
+// EventPublishers publishes the event to every publisher in order.
+type EventPublishers []EventPublisher
+
+func (p EventPublishers) PublishEvent(event entity.Event) {
+	for _, publisher := range p {
+		publisher.PublishEvent(event)
+	}
+}
+
+const (
+	// dedupSize is the number of the latest event IDs remembered to drop duplicates.
+	dedupSize = 4096
+	// busPublishTimeout bounds the time a publisher waits for the bus.
+	busPublishTimeout = 5 * time.Second
+)
+
+// EventDistributor publishes events to the local hub and to the bus, and relays
+// events of other instances from the bus to the local hub. Events are deduplicated
+// by ID, so the echo of our own events and redelivered events are dropped.
+type EventDistributor struct {
+	log   *slog.Logger
+	bus   EventBus
+	local EventPublisher
+	cfg   Events
+
+	mu    sync.Mutex
+	seen  map[uuid.UUID]struct{}
+	order []uuid.UUID
+	next  int
+}
+
+func NewEventDistributor(log *slog.Logger, bus EventBus, local EventPublisher, cfg Events) *EventDistributor {
+	return &EventDistributor{
+		log:   log,
+		bus:   bus,
+		local: local,
+		cfg:   cfg.WithDefaults(),
+		seen:  make(map[uuid.UUID]struct{}, dedupSize),
+		order: make([]uuid.UUID, dedupSize),
+	}
+}
+
+// PublishEvent delivers the event to the local subscribers right away, so they
+// don't depend on the bus, then publishes it to the other instances.
+func (d *EventDistributor) PublishEvent(event entity.Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), busPublishTimeout)
+	defer cancel()
+
+	if err := d.DeliverEvent(ctx, event); err != nil {
+		d.log.Error("publish event to bus", slog.String("type", string(event.Type)), slog.Any("error", err))
+	}
+}
+
+// DeliverEvent is PublishEvent which reports bus failures, the redelivered event
+// is dropped by the local subscribers as a duplicate.
+func (d *EventDistributor) DeliverEvent(ctx context.Context, event entity.Event) error {
+	if d.markSeen(event.ID) {
+		d.local.PublishEvent(event)
+	}
+
+	err := d.publish(ctx, event)
+	if errors.Is(err, ErrEventTooLarge) {
+		// Other instances get the event without the payload, their clients can fetch the voting
+		d.log.Warn("Event payload is dropped for the bus", slog.String("type", string(event.Type)), slog.String("voting_id", event.VotingID.String()))
+		event.Payload = nil
+		err = d.publish(ctx, event)
+	}
+
+	return err
+}
+
+func (d *EventDistributor) publish(ctx context.Context, event entity.Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return d.bus.Publish(ctx, payload)
+}
+
+// Run relays events from the bus until ctx is done, the listener reconnects with exponential backoff.
+func (d *EventDistributor) Run(ctx context.Context) {
+	delay := d.cfg.ReconnectDelay
+	for {
+		startedAt := time.Now()
+		err := d.bus.Listen(ctx, d.receive)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// The listener was healthy for a while, so it's a new failure
+		if time.Since(startedAt) > d.cfg.MaxReconnectDelay {
+			delay = d.cfg.ReconnectDelay
+		}
+
+		d.log.Error("Event listener stopped, reconnecting", slog.Any("error", err), slog.Duration("delay", delay))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		delay = min(delay*2, d.cfg.MaxReconnectDelay)
+	}
+}
+
+func (d *EventDistributor) receive(payload []byte) {
+	var event entity.Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		d.log.Error("unmarshal event from bus", slog.Any("error", err))
+		return
+	}
+
+	if !d.markSeen(event.ID) {
+		return
+	}
+
+	d.local.PublishEvent(event)
+}
+
+// markSeen remembers the event ID, it returns false when the ID is already known.
+func (d *EventDistributor) markSeen(id uuid.UUID) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.seen[id]; ok {
+		return false
+	}
+
+	delete(d.seen, d.order[d.next])
+	d.order[d.next] = id
+	d.next = (d.next + 1) % len(d.order)
+	d.seen[id] = struct{}{}
+
+	return true
+}
+
+// MemoryEventBus delivers events inside a single process, it's enough for a single instance.
+type MemoryEventBus struct {
+	mu        sync.RWMutex
+	listeners map[*func(payload []byte)]struct{}
+}
+
+func NewMemoryEventBus() *MemoryEventBus {
+	return &MemoryEventBus{
+		listeners: make(map[*func(payload []byte)]struct{}),
+	}
+}
+
+func (b *MemoryEventBus) Publish(_ context.Context, payload []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for handle := range b.listeners {
+		(*handle)(payload)
+	}
+
+	return nil
+}
+
+func (b *MemoryEventBus) Listen(ctx context.Context, handle func(payload []byte)) error {
+	b.mu.Lock()
+	b.listeners[&handle] = struct{}{}
+	b.mu.Unlock()
+
+	<-ctx.Done()
+
+	b.mu.Lock()
+	delete(b.listeners, &handle)
+	b.mu.Unlock()
+
+	return ctx.Err()
+}
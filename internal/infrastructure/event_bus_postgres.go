@@ -0,0 +1,66 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// maxNotifyPayload is the limit of the NOTIFY payload in the default postgres build.
+const maxNotifyPayload = 7999
+
+// PostgresEventBus distributes events between instances with LISTEN/NOTIFY.
+type PostgresEventBus struct {
+	db      *pgxpool.Pool
+	channel string
+}
+
+func NewPostgresEventBus(db *pgxpool.Pool, channel string) *PostgresEventBus {
+	return &PostgresEventBus{
+		db:      db,
+		channel: channel,
+	}
+}
+
+func (b *PostgresEventBus) Publish(ctx context.Context, payload []byte) error {
+	if len(payload) > maxNotifyPayload {
+		return ErrEventTooLarge
+	}
+
+	if _, err := b.db.Exec(ctx, "SELECT pg_notify($1, $2)", b.channel, string(payload)); err != nil {
+		return fmt.Errorf("notify: %w", err)
+	}
+
+	return nil
+}
+
+func (b *PostgresEventBus) Listen(ctx context.Context, handle func(payload []byte)) error {
+	poolConn, err := b.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire connection: %w", err)
+	}
+
+	// The listening connection never goes back to the pool
+	conn := poolConn.Hijack()
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = conn.Close(closeCtx)
+	}()
+
+	if _, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{b.channel}.Sanitize()); err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("wait for notification: %w", err)
+		}
+
+		handle([]byte(notification.Payload))
+	}
+}
@@ -0,0 +1,127 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+)
+
+func newTestInstance(t *testing.T, bus EventBus) (*EventDistributor, *mockConn) {
+	t.Helper()
+	logger := NewDefaultLogger()
+
+	subscription := NewSubscription(logger, WebSocket{})
+	client := &mockConn{}
+	subscription.AddClient(client, entity.Identity{}, EncodingJSON)
+	subscription.Subscribe(client, Topics{All: true})
+
+	distributor := NewEventDistributor(logger, bus, subscription, Events{})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go distributor.Run(ctx)
+
+	return distributor, client
+}
+
+func countContaining(messages []string, substr string) int {
+	var count int
+	for _, message := range messages {
+		if strings.Contains(message, substr) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestEventDistributorFanOut(t *testing.T) {
+	bus := NewMemoryEventBus()
+	instanceA, clientA := newTestInstance(t, bus)
+	_, clientB := newTestInstance(t, bus)
+	waitFor(t, func() bool {
+		bus.mu.RLock()
+		defer bus.mu.RUnlock()
+		return len(bus.listeners) == 2
+	})
+
+	event, _ := entity.NewEvent(entity.EventVotingCreated, uuid.New(), nil, nil)
+	instanceA.PublishEvent(event)
+
+	for _, client := range []*mockConn{clientA, clientB} {
+		waitFor(t, func() bool {
+			return countContaining(client.received(), event.ID.String()) > 0
+		})
+	}
+
+	// The echo of the own event is dropped
+	instanceA.PublishEvent(event)
+	if count := countContaining(clientA.received(), event.ID.String()); count != 1 {
+		t.Errorf("Expected the event to be delivered once, got %d", count)
+	}
+	if count := countContaining(clientB.received(), event.ID.String()); count != 1 {
+		t.Errorf("Expected the event to be delivered once, got %d", count)
+	}
+}
+
+// flakyBus fails the first listen, like a dropped listener connection.
+type flakyBus struct {
+	*MemoryEventBus
+	mu      sync.Mutex
+	listens int
+}
+
+func (b *flakyBus) Listen(ctx context.Context, handle func(payload []byte)) error {
+	b.mu.Lock()
+	b.listens++
+	listens := b.listens
+	b.mu.Unlock()
+
+	if listens == 1 {
+		return errors.New("connection reset")
+	}
+
+	return b.MemoryEventBus.Listen(ctx, handle)
+}
+
+func TestEventDistributorReconnects(t *testing.T) {
+	bus := &flakyBus{MemoryEventBus: NewMemoryEventBus()}
+	_, client := newTestInstance(t, bus)
+	waitFor(t, func() bool {
+		bus.MemoryEventBus.mu.RLock()
+		defer bus.MemoryEventBus.mu.RUnlock()
+		return len(bus.listeners) == 1
+	})
+
+	event, _ := entity.NewEvent(entity.EventVotingCreated, uuid.New(), nil, nil)
+	payload := `{"id":"` + event.ID.String() + `","version":1,"type":"voting.created"}`
+	if err := bus.Publish(context.Background(), []byte(payload)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	waitFor(t, func() bool {
+		return countContaining(client.received(), event.ID.String()) == 1
+	})
+}
+
+func TestMarkSeenForgetsOldest(t *testing.T) {
+	distributor := NewEventDistributor(NewDefaultLogger(), NewMemoryEventBus(), nil, Events{})
+
+	first := uuid.New()
+	if !distributor.markSeen(first) {
+		t.Fatalf("Expected new ID to be marked")
+	}
+	if distributor.markSeen(first) {
+		t.Errorf("Expected duplicate ID to be dropped")
+	}
+
+	for i := 0; i < dedupSize; i++ {
+		distributor.markSeen(uuid.New())
+	}
+	if !distributor.markSeen(first) {
+		t.Errorf("Expected the oldest ID to be forgotten")
+	}
+}
@@ -0,0 +1,264 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// LoginAttempt is the failed login history of a single key (username or client IP).
+type LoginAttempt struct {
+	Key           string    `db:"key"`
+	Failures      int       `db:"failures"`
+	LastFailureAt time.Time `db:"last_failure_at"`
+	BlockedUntil  time.Time `db:"blocked_until"`
+}
+
+type LoginAttemptStore interface {
+	// Get returns the zero LoginAttempt when nothing is known about the key.
+	Get(ctx context.Context, key string) (LoginAttempt, error)
+	// RegisterFailure atomically increments the failures counter, failures older than window are forgotten.
+	RegisterFailure(ctx context.Context, key string, at time.Time, window time.Duration) (LoginAttempt, error)
+	Block(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, key string) error
+}
+
+// LoginGuard throttles login attempts per username and per client IP.
+// The first FreeAttempts failures are free, then every failure blocks the key
+// with exponential backoff, and after the max attempts the key is locked out
+// until LockoutDuration passes or an admin unlocks it.
+type LoginGuard struct {
+	log   *slog.Logger
+	store LoginAttemptStore
+	cfg   Lockout
+	now   func() time.Time
+}
+
+func NewLoginGuard(log *slog.Logger, store LoginAttemptStore, cfg Lockout) *LoginGuard {
+	return &LoginGuard{
+		log:   log,
+		store: store,
+		cfg:   cfg.WithDefaults(),
+		now:   time.Now,
+	}
+}
+
+func userKey(username string) string {
+	return "user:" + username
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// LoginCheck is the state of the attempt read by Allow, Success takes it to skip the store when there's nothing to forget.
+type LoginCheck struct {
+	// Wait is how long the caller has to wait before the next attempt, zero means the attempt is allowed.
+	Wait time.Duration
+	// userFailed tells the username has failures or a block recorded
+	userFailed bool
+}
+
+// Allow checks the username and the IP before the credentials are.
+func (g *LoginGuard) Allow(ctx context.Context, username, ip string) (LoginCheck, error) {
+	now := g.now()
+
+	var check LoginCheck
+	for _, key := range []string{userKey(username), ipKey(ip)} {
+		attempt, err := g.store.Get(ctx, key)
+		if err != nil {
+			return LoginCheck{}, fmt.Errorf("get login attempt: %w", err)
+		}
+
+		if d := attempt.BlockedUntil.Sub(now); d > check.Wait {
+			check.Wait = d
+		}
+		if key == userKey(username) {
+			check.userFailed = attempt.Failures > 0 || !attempt.BlockedUntil.IsZero()
+		}
+	}
+
+	if wait := check.Wait; wait > 0 {
+		g.log.Warn("security event",
+			slog.String("event", "auth.attempt_blocked"),
+			slog.String("username", username),
+			slog.String("ip", ip),
+			slog.Duration("retry_after", wait),
+		)
+	}
+
+	return check, nil
+}
+
+// Failure registers a failed login attempt and blocks the username and the IP when needed.
+func (g *LoginGuard) Failure(ctx context.Context, username, ip string) error {
+	g.log.Warn("security event",
+		slog.String("event", "auth.login_failed"),
+		slog.String("username", username),
+		slog.String("ip", ip),
+	)
+
+	if err := g.failure(ctx, userKey(username), g.cfg.UserMaxAttempts, username, ip); err != nil {
+		return err
+	}
+
+	return g.failure(ctx, ipKey(ip), g.cfg.IPMaxAttempts, username, ip)
+}
+
+func (g *LoginGuard) failure(ctx context.Context, key string, maxAttempts int, username, ip string) error {
+	now := g.now()
+
+	attempt, err := g.store.RegisterFailure(ctx, key, now, g.cfg.Window)
+	if err != nil {
+		return fmt.Errorf("register login failure: %w", err)
+	}
+
+	if attempt.Failures < g.cfg.FreeAttempts {
+		return nil
+	}
+
+	event := "auth.backoff"
+	delay := g.backoff(attempt.Failures)
+	if attempt.Failures >= maxAttempts {
+		event = "auth.locked"
+		delay = g.cfg.LockoutDuration
+	}
+
+	if err = g.store.Block(ctx, key, now.Add(delay)); err != nil {
+		return fmt.Errorf("block login: %w", err)
+	}
+
+	g.log.Warn("security event",
+		slog.String("event", event),
+		slog.String("key", key),
+		slog.String("username", username),
+		slog.String("ip", ip),
+		slog.Int("failures", attempt.Failures),
+		slog.Duration("blocked_for", delay),
+	)
+
+	return nil
+}
+
+func (g *LoginGuard) backoff(failures int) time.Duration {
+	delay := g.cfg.BaseDelay
+	for i := g.cfg.FreeAttempts; i < failures && delay < g.cfg.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, g.cfg.MaxDelay)
+}
+
+// Success forgets the failures of the username found by Allow, the store isn't touched when there are none,
+// so authenticated requests make no writes. IP failures are kept, so a single valid account can't be used
+// to reset password spraying.
+func (g *LoginGuard) Success(ctx context.Context, check LoginCheck, username, _ string) error {
+	if !check.userFailed {
+		return nil
+	}
+
+	if err := g.store.Reset(ctx, userKey(username)); err != nil {
+		return fmt.Errorf("reset login attempts: %w", err)
+	}
+
+	return nil
+}
+
+// Unlock lifts the lockout of the username and/or the IP, empty values are skipped.
+func (g *LoginGuard) Unlock(ctx context.Context, username, ip string) error {
+	if username != "" {
+		if err := g.store.Reset(ctx, userKey(username)); err != nil {
+			return fmt.Errorf("unlock username: %w", err)
+		}
+	}
+
+	if ip != "" {
+		if err := g.store.Reset(ctx, ipKey(ip)); err != nil {
+			return fmt.Errorf("unlock ip: %w", err)
+		}
+	}
+
+	g.log.Warn("security event",
+		slog.String("event", "auth.unlocked"),
+		slog.String("username", username),
+		slog.String("ip", ip),
+	)
+
+	return nil
+}
+
+// MemoryLoginAttemptStore keeps login attempts of a single instance.
+type MemoryLoginAttemptStore struct {
+	mu        sync.Mutex
+	attempts  map[string]LoginAttempt
+	lastSweep time.Time
+}
+
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{
+		attempts: make(map[string]LoginAttempt),
+	}
+}
+
+func (s *MemoryLoginAttemptStore) Get(_ context.Context, key string) (LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.attempts[key], nil
+}
+
+func (s *MemoryLoginAttemptStore) RegisterFailure(_ context.Context, key string, at time.Time, window time.Duration) (LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(at, window)
+
+	attempt := s.attempts[key]
+	if at.Sub(attempt.LastFailureAt) > window {
+		attempt.Failures = 0
+	}
+
+	attempt.Key = key
+	attempt.Failures++
+	attempt.LastFailureAt = at
+	s.attempts[key] = attempt
+
+	return attempt, nil
+}
+
+// sweep drops stale attempts, so sprayed usernames don't grow the map forever.
+func (s *MemoryLoginAttemptStore) sweep(now time.Time, window time.Duration) {
+	if now.Sub(s.lastSweep) < window {
+		return
+	}
+
+	for key, attempt := range s.attempts {
+		if now.Sub(attempt.LastFailureAt) > window && now.After(attempt.BlockedUntil) {
+			delete(s.attempts, key)
+		}
+	}
+
+	s.lastSweep = now
+}
+
+func (s *MemoryLoginAttemptStore) Block(_ context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempt := s.attempts[key]
+	attempt.Key = key
+	attempt.BlockedUntil = until
+	s.attempts[key] = attempt
+
+	return nil
+}
+
+func (s *MemoryLoginAttemptStore) Reset(_ context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.attempts, key)
+	s.mu.Unlock()
+
+	return nil
+}
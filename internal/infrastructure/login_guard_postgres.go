@@ -0,0 +1,92 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const tbAuthLoginAttempts = "auth_login_attempts"
+
+// PostgresLoginAttemptStore shares login attempts between instances.
+type PostgresLoginAttemptStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresLoginAttemptStore(db *pgxpool.Pool) *PostgresLoginAttemptStore {
+	return &PostgresLoginAttemptStore{
+		db: db,
+	}
+}
+
+func (s *PostgresLoginAttemptStore) Get(ctx context.Context, key string) (LoginAttempt, error) {
+	stmt, args, err := sq.Select("key", "failures", "last_failure_at", "blocked_until").
+		From(tbAuthLoginAttempts).
+		Where(sq.Eq{"key": key}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return LoginAttempt{}, fmt.Errorf("build statement: %w", err)
+	}
+
+	attempt, err := FetchRow[LoginAttempt](ctx, s.db, stmt, args...)
+	if errors.Is(err, ErrObjectNotFound) {
+		return LoginAttempt{}, nil
+	}
+	if err != nil {
+		return LoginAttempt{}, err
+	}
+
+	return *attempt, nil
+}
+
+func (s *PostgresLoginAttemptStore) RegisterFailure(ctx context.Context, key string, at time.Time, window time.Duration) (LoginAttempt, error) {
+	stmt, args, err := sq.Insert(tbAuthLoginAttempts).
+		Columns("key", "failures", "last_failure_at").
+		Values(key, 1, at).
+		Suffix(`ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN auth_login_attempts.last_failure_at < ? THEN 1 ELSE auth_login_attempts.failures + 1 END,
+			last_failure_at = EXCLUDED.last_failure_at`, at.Add(-window)).
+		Suffix("RETURNING key, failures, last_failure_at, blocked_until").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return LoginAttempt{}, fmt.Errorf("build statement: %w", err)
+	}
+
+	attempt, err := FetchRow[LoginAttempt](ctx, s.db, stmt, args...)
+	if err != nil {
+		return LoginAttempt{}, err
+	}
+
+	return *attempt, nil
+}
+
+func (s *PostgresLoginAttemptStore) Block(ctx context.Context, key string, until time.Time) error {
+	stmt, args, err := sq.Update(tbAuthLoginAttempts).
+		Set("blocked_until", until).
+		Where(sq.Eq{"key": key}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("build statement: %w", err)
+	}
+
+	return Execute(ctx, s.db, stmt, args...)
+}
+
+func (s *PostgresLoginAttemptStore) Reset(ctx context.Context, key string) error {
+	stmt, args, err := sq.Delete(tbAuthLoginAttempts).
+		Where(sq.Eq{"key": key}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("build statement: %w", err)
+	}
+
+	return Execute(ctx, s.db, stmt, args...)
+}
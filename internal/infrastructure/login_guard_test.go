@@ -0,0 +1,145 @@
+package infrastructure
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestLoginGuard(now *time.Time) *LoginGuard {
+	guard := NewLoginGuard(NewDefaultLogger(), NewMemoryLoginAttemptStore(), Lockout{
+		FreeAttempts:    2,
+		UserMaxAttempts: 5,
+		IPMaxAttempts:   8,
+		BaseDelay:       time.Second,
+		MaxDelay:        4 * time.Second,
+		LockoutDuration: time.Hour,
+	})
+	guard.now = func() time.Time { return *now }
+
+	return guard
+}
+
+func TestLoginGuardFreeAttempts(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	guard := newTestLoginGuard(&now)
+
+	_ = guard.Failure(ctx, "user1", "10.0.0.1")
+	check, err := guard.Allow(ctx, "user1", "10.0.0.1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if check.Wait != 0 {
+		t.Errorf("Expected attempt to be allowed, got wait %v", check.Wait)
+	}
+}
+
+func TestLoginGuardBackoff(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	guard := newTestLoginGuard(&now)
+
+	expected := []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second}
+	for i, want := range expected {
+		_ = guard.Failure(ctx, "user1", "10.0.0.1")
+		check, _ := guard.Allow(ctx, "user1", "10.0.0.1")
+		if wait := check.Wait; wait != want {
+			t.Errorf("Failure %d: expected wait %v, got %v", i+1, want, wait)
+		}
+	}
+}
+
+func TestLoginGuardLockoutAndUnlock(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	guard := newTestLoginGuard(&now)
+
+	for i := 0; i < 5; i++ {
+		_ = guard.Failure(ctx, "user1", "10.0.0.1")
+	}
+
+	check, _ := guard.Allow(ctx, "user1", "10.0.0.2")
+	if wait := check.Wait; wait != time.Hour {
+		t.Errorf("Expected username to be locked for an hour, got %v", wait)
+	}
+
+	if err := guard.Unlock(ctx, "user1", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	check, _ = guard.Allow(ctx, "user1", "10.0.0.2")
+	if wait := check.Wait; wait != 0 {
+		t.Errorf("Expected username to be unlocked, got wait %v", wait)
+	}
+}
+
+func TestLoginGuardPasswordSpraying(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	guard := newTestLoginGuard(&now)
+
+	for i := 0; i < 8; i++ {
+		_ = guard.Failure(ctx, "sprayed", "10.0.0.1")
+		check, _ := guard.Allow(ctx, "sprayed", "10.0.0.1")
+		_ = guard.Success(ctx, check, "sprayed", "10.0.0.1")
+	}
+
+	check, _ := guard.Allow(ctx, "another", "10.0.0.1")
+	if wait := check.Wait; wait != time.Hour {
+		t.Errorf("Expected ip to be locked for an hour, got %v", wait)
+	}
+}
+
+func TestLoginGuardWindow(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	guard := newTestLoginGuard(&now)
+
+	for i := 0; i < 4; i++ {
+		_ = guard.Failure(ctx, "user1", "10.0.0.1")
+	}
+
+	now = now.Add(2 * time.Hour)
+	_ = guard.Failure(ctx, "user1", "10.0.0.1")
+
+	check, _ := guard.Allow(ctx, "user1", "10.0.0.1")
+	if wait := check.Wait; wait != 0 {
+		t.Errorf("Expected failures outside of the window to be forgotten, got wait %v", wait)
+	}
+}
+
+// resetCountingStore counts the resets of the store.
+type resetCountingStore struct {
+	*MemoryLoginAttemptStore
+	resets int
+}
+
+func (s *resetCountingStore) Reset(ctx context.Context, key string) error {
+	s.resets++
+	return s.MemoryLoginAttemptStore.Reset(ctx, key)
+}
+
+func TestLoginGuardSuccessResetsRecordedFailuresOnly(t *testing.T) {
+	ctx := context.Background()
+	store := &resetCountingStore{MemoryLoginAttemptStore: NewMemoryLoginAttemptStore()}
+	guard := NewLoginGuard(NewDefaultLogger(), store, Lockout{})
+
+	check, _ := guard.Allow(ctx, "user1", "10.0.0.1")
+	if err := guard.Success(ctx, check, "user1", "10.0.0.1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if store.resets != 0 {
+		t.Errorf("Expected no reset without failures, got %d", store.resets)
+	}
+
+	_ = guard.Failure(ctx, "user1", "10.0.0.1")
+	check, _ = guard.Allow(ctx, "user1", "10.0.0.1")
+	if err := guard.Success(ctx, check, "user1", "10.0.0.1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	check, _ = guard.Allow(ctx, "user1", "10.0.0.1")
+	if store.resets != 1 || check.userFailed {
+		t.Errorf("Expected the failures reset once, got %d resets", store.resets)
+	}
+}
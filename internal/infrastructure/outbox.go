@@ -0,0 +1,228 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+)
+
+// OutboxStore keeps the events written in the transaction of the change.
+type OutboxStore interface {
+	// Claim locks up to limit pending events, oldest first, and passes them to deliver.
+	// The events are marked delivered only when deliver succeeds, it returns the number of claimed events.
+	Claim(ctx context.Context, limit int, deliver func(ctx context.Context, events []entity.Event) error) (int, error)
+	// DeleteDelivered deletes the events delivered before the time, it returns the number of deleted events.
+	DeleteDelivered(ctx context.Context, before time.Time) (int64, error)
+}
+
+// OutboxSink receives the relayed events, an error makes the relay retry the event later.
+type OutboxSink interface {
+	DeliverEvent(ctx context.Context, event entity.Event) error
+}
+
+type skipEventsSink struct {
+	sink    OutboxSink
+	skipped []entity.EventType
+}
+
+// SkipEvents passes the events to the sink except the ones of the skipped types.
+func SkipEvents(sink OutboxSink, skipped ...entity.EventType) OutboxSink {
+	return &skipEventsSink{
+		sink:    sink,
+		skipped: skipped,
+	}
+}
+
+func (s *skipEventsSink) DeliverEvent(ctx context.Context, event entity.Event) error {
+	if slices.Contains(s.skipped, event.Type) {
+		return nil
+	}
+
+	return s.sink.DeliverEvent(ctx, event)
+}
+
+// OutboxRelay delivers outbox events to the sinks at least once, so an event is
+// published only when its change is committed, and it's not lost on a crash.
+// A retried batch is delivered to every sink again, consumers deduplicate by the event ID.
+type OutboxRelay struct {
+	log   *slog.Logger
+	store OutboxStore
+	sinks []OutboxSink
+	cfg   Outbox
+	wake  chan struct{}
+	now   func() time.Time
+}
+
+func NewOutboxRelay(log *slog.Logger, store OutboxStore, cfg Outbox, sinks ...OutboxSink) *OutboxRelay {
+	return &OutboxRelay{
+		log:   log,
+		store: store,
+		sinks: sinks,
+		cfg:   cfg.WithDefaults(),
+		wake:  make(chan struct{}, 1),
+		now:   time.Now,
+	}
+}
+
+// Wake makes the relay look for pending events right away, it never blocks.
+func (r *OutboxRelay) Wake() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run relays pending events and cleans up the delivered ones until ctx is done.
+func (r *OutboxRelay) Run(ctx context.Context) {
+	poll := time.NewTicker(r.cfg.PollInterval)
+	defer poll.Stop()
+	cleanup := time.NewTicker(r.cfg.CleanupInterval)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+			r.relay(ctx)
+		case <-poll.C:
+			r.relay(ctx)
+		case <-cleanup.C:
+			r.cleanup(ctx)
+		}
+	}
+}
+
+// relay claims batches until the pending events are drained or a delivery fails.
+func (r *OutboxRelay) relay(ctx context.Context) {
+	for {
+		claimed, err := r.store.Claim(ctx, r.cfg.BatchSize, r.deliver)
+		if err != nil {
+			if ctx.Err() == nil {
+				r.log.Error("relay outbox events", slog.Any("error", err))
+			}
+			return
+		}
+
+		if claimed < r.cfg.BatchSize {
+			return
+		}
+	}
+}
+
+func (r *OutboxRelay) deliver(ctx context.Context, events []entity.Event) error {
+	for _, event := range events {
+		for _, sink := range r.sinks {
+			if err := sink.DeliverEvent(ctx, event); err != nil {
+				return fmt.Errorf("deliver %s event %s: %w", event.Type, event.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *OutboxRelay) cleanup(ctx context.Context) {
+	deleted, err := r.store.DeleteDelivered(ctx, r.now().Add(-r.cfg.Retention))
+	if err != nil {
+		r.log.Error("clean up outbox", slog.Any("error", err))
+		return
+	}
+
+	if deleted > 0 {
+		r.log.Debug("Outbox cleaned up", slog.Int64("deleted", deleted))
+	}
+}
+
+type memoryOutboxEvent struct {
+	event entity.Event
+	// claimed is set while the event is delivered, other claims skip it as SKIP LOCKED does
+	claimed     bool
+	deliveredAt time.Time
+}
+
+// MemoryOutboxStore follows the semantics of PostgresOutboxStore for a single relay, events are lost on restart.
+type MemoryOutboxStore struct {
+	mu     sync.Mutex
+	events []*memoryOutboxEvent
+}
+
+func NewMemoryOutboxStore() *MemoryOutboxStore {
+	return &MemoryOutboxStore{}
+}
+
+// Add writes the events to the outbox, they are relayed in the given order.
+func (s *MemoryOutboxStore) Add(events ...entity.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, event := range events {
+		s.events = append(s.events, &memoryOutboxEvent{event: event})
+	}
+}
+
+// Claim delivers the batch without holding the lock, Add isn't blocked by a slow sink.
+func (s *MemoryOutboxStore) Claim(ctx context.Context, limit int, deliver func(ctx context.Context, events []entity.Event) error) (int, error) {
+	claimed, events := s.claim(limit)
+	if len(claimed) == 0 {
+		return 0, nil
+	}
+
+	err := deliver(ctx, events)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range claimed {
+		e.claimed = false
+		if err == nil {
+			e.deliveredAt = time.Now()
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(claimed), nil
+}
+
+// claim marks the undelivered events of the batch claimed and copies them out.
+func (s *MemoryOutboxStore) claim(limit int) ([]*memoryOutboxEvent, []entity.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var claimed []*memoryOutboxEvent
+	var events []entity.Event
+	for _, e := range s.events {
+		if e.deliveredAt.IsZero() && !e.claimed && len(claimed) < limit {
+			e.claimed = true
+			claimed = append(claimed, e)
+			events = append(events, e.event)
+		}
+	}
+
+	return claimed, events
+}
+
+func (s *MemoryOutboxStore) DeleteDelivered(_ context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	kept := s.events[:0]
+	for _, e := range s.events {
+		if !e.deliveredAt.IsZero() && e.deliveredAt.Before(before) {
+			deleted++
+			continue
+		}
+		kept = append(kept, e)
+	}
+	s.events = kept
+
+	return deleted, nil
+}
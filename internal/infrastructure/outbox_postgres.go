@@ -0,0 +1,143 @@
+package infrastructure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+)
+
+const tbVotingEventsOutbox = "voting_events_outbox"
+
+// InsertOutboxEvent writes the event to the outbox, q is the transaction of the change.
+func InsertOutboxEvent(ctx context.Context, q Queryer, event entity.Event) error {
+	return InsertOutboxEvents(ctx, q, []entity.Event{event})
+}
+
+// InsertOutboxEvents writes the events to the outbox by one statement, they are relayed in the given order.
+func InsertOutboxEvents(ctx context.Context, q Queryer, events []entity.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	insertBuilder := sq.Insert(tbVotingEventsOutbox).
+		Columns("id", "event")
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("marshal event: %w", err)
+		}
+		insertBuilder = insertBuilder.Values(event.ID, string(data))
+	}
+	// An event written again, e.g. voting.closed by the closers of several instances, is kept once
+	insertBuilder = insertBuilder.Suffix("ON CONFLICT (id) DO NOTHING")
+
+	stmt, args, err := insertBuilder.PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return fmt.Errorf("build statement: %w", err)
+	}
+
+	return Execute(ctx, q, stmt, args...)
+}
+
+type outboxRow struct {
+	ID    uuid.UUID `db:"id"`
+	Event []byte    `db:"event"`
+}
+
+// PostgresOutboxStore is safe for several relays, each of them claims different events.
+type PostgresOutboxStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresOutboxStore(db *pgxpool.Pool) *PostgresOutboxStore {
+	return &PostgresOutboxStore{
+		db: db,
+	}
+}
+
+func (s *PostgresOutboxStore) Claim(ctx context.Context, limit int, deliver func(ctx context.Context, events []entity.Event) error) (int, error) {
+	tx, err := s.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return 0, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	stmt, args, err := sq.Select("id", "event").
+		From(tbVotingEventsOutbox).
+		Where(sq.Eq{"delivered_at": nil}).
+		OrderBy("position").
+		Limit(uint64(limit)).
+		Suffix("FOR UPDATE SKIP LOCKED").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("build statement: %w", err)
+	}
+
+	rows, err := FetchRows[outboxRow](ctx, tx, stmt, args...)
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]uuid.UUID, 0, len(rows))
+	events := make([]entity.Event, 0, len(rows))
+	for _, row := range rows {
+		var event entity.Event
+		if err = json.Unmarshal(row.Event, &event); err != nil {
+			return 0, fmt.Errorf("unmarshal event %s: %w", row.ID, err)
+		}
+
+		ids = append(ids, row.ID)
+		events = append(events, event)
+	}
+
+	if err = deliver(ctx, events); err != nil {
+		return 0, err
+	}
+
+	stmt, args, err = sq.Update(tbVotingEventsOutbox).
+		Set("delivered_at", sq.Expr("current_timestamp")).
+		Where(sq.Eq{"id": ids}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("build statement: %w", err)
+	}
+
+	if err = Execute(ctx, tx, stmt, args...); err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	return len(rows), nil
+}
+
+func (s *PostgresOutboxStore) DeleteDelivered(ctx context.Context, before time.Time) (int64, error) {
+	stmt, args, err := sq.Delete(tbVotingEventsOutbox).
+		Where(sq.Lt{"delivered_at": before}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("build statement: %w", err)
+	}
+
+	tag, err := s.db.Exec(ctx, stmt, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
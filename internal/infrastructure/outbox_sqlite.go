@@ -0,0 +1,139 @@
+package infrastructure
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+)
+
+// InsertSQLiteOutboxEvents writes the events to the outbox of the data file by one statement, tx is the transaction
+// of the change. They are relayed in the given order.
+func InsertSQLiteOutboxEvents(ctx context.Context, tx *sql.Tx, events []entity.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	insertBuilder := sq.Insert(tbVotingEventsOutbox).
+		Columns("id", "event")
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("marshal event: %w", err)
+		}
+		insertBuilder = insertBuilder.Values(event.ID, string(data))
+	}
+	// An event written again is kept once, as in Postgres
+	insertBuilder = insertBuilder.Suffix("ON CONFLICT (id) DO NOTHING")
+
+	stmt, args, err := insertBuilder.ToSql()
+	if err != nil {
+		return fmt.Errorf("build statement: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, stmt, args...)
+
+	return err
+}
+
+// SQLiteOutboxStore keeps the outbox in the data file of the sqlite storage. The file serves a single instance
+// with a single relay, so the claimed events aren't locked: the connection of the file isn't held while they're delivered.
+type SQLiteOutboxStore struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+func NewSQLiteOutboxStore(db *sql.DB) *SQLiteOutboxStore {
+	return &SQLiteOutboxStore{
+		db:  db,
+		now: time.Now,
+	}
+}
+
+func (s *SQLiteOutboxStore) Claim(ctx context.Context, limit int, deliver func(ctx context.Context, events []entity.Event) error) (int, error) {
+	ids, events, err := s.pending(ctx, limit)
+	if err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	if err = deliver(ctx, events); err != nil {
+		return 0, err
+	}
+
+	stmt, args, err := sq.Update(tbVotingEventsOutbox).
+		Set("delivered_at", s.now().UTC()).
+		Where(sq.Eq{"id": ids}).
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("build statement: %w", err)
+	}
+
+	if _, err = s.db.ExecContext(ctx, stmt, args...); err != nil {
+		return 0, err
+	}
+
+	return len(events), nil
+}
+
+// pending reads up to limit undelivered events, oldest first.
+func (s *SQLiteOutboxStore) pending(ctx context.Context, limit int) ([]uuid.UUID, []entity.Event, error) {
+	stmt, args, err := sq.Select("id", "event").
+		From(tbVotingEventsOutbox).
+		Where(sq.Eq{"delivered_at": nil}).
+		OrderBy("position").
+		Limit(uint64(limit)).
+		ToSql()
+	if err != nil {
+		return nil, nil, fmt.Errorf("build statement: %w", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	var events []entity.Event
+	for rows.Next() {
+		var id uuid.UUID
+		var data string
+		if err = rows.Scan(&id, &data); err != nil {
+			return nil, nil, err
+		}
+
+		var event entity.Event
+		if err = json.Unmarshal([]byte(data), &event); err != nil {
+			return nil, nil, fmt.Errorf("unmarshal event %s: %w", id, err)
+		}
+
+		ids = append(ids, id)
+		events = append(events, event)
+	}
+
+	return ids, events, rows.Err()
+}
+
+func (s *SQLiteOutboxStore) DeleteDelivered(ctx context.Context, before time.Time) (int64, error) {
+	stmt, args, err := sq.Delete(tbVotingEventsOutbox).
+		Where(sq.Lt{"delivered_at": before.UTC()}).
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("build statement: %w", err)
+	}
+
+	result, err := s.db.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
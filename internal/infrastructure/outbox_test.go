@@ -0,0 +1,157 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+)
+
+func (s *MemoryOutboxStore) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count int
+	for _, e := range s.events {
+		if e.deliveredAt.IsZero() {
+			count++
+		}
+	}
+	return count
+}
+
+// recordingSink fails the first failures deliveries.
+type recordingSink struct {
+	mu        sync.Mutex
+	failures  int
+	delivered []uuid.UUID
+}
+
+func (s *recordingSink) DeliverEvent(_ context.Context, event entity.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("broker is down")
+	}
+	s.delivered = append(s.delivered, event.ID)
+	return nil
+}
+
+func (s *recordingSink) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.delivered)
+}
+
+func TestOutboxRelayDeliversInBatches(t *testing.T) {
+	store := NewMemoryOutboxStore()
+	for i := 0; i < 5; i++ {
+		event, _ := entity.NewEvent(entity.EventVoteCast, uuid.New(), nil, nil)
+		store.Add(event)
+	}
+
+	sink := &recordingSink{}
+	relay := NewOutboxRelay(NewDefaultLogger(), store, Outbox{BatchSize: 2, PollInterval: time.Hour}, sink)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go relay.Run(ctx)
+
+	relay.Wake()
+	waitFor(t, func() bool { return sink.count() == 5 })
+
+	if pending := store.pending(); pending != 0 {
+		t.Errorf("Expected no pending events, got %d", pending)
+	}
+	for i, id := range sink.delivered {
+		if id != store.events[i].event.ID {
+			t.Errorf("Expected events to be delivered in order")
+		}
+	}
+}
+
+func TestOutboxRelayRetriesFailedDelivery(t *testing.T) {
+	store := NewMemoryOutboxStore()
+	event, _ := entity.NewEvent(entity.EventVoteCast, uuid.New(), nil, nil)
+	store.Add(event)
+
+	sink := &recordingSink{failures: 2}
+	relay := NewOutboxRelay(NewDefaultLogger(), store, Outbox{PollInterval: 10 * time.Millisecond}, sink)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go relay.Run(ctx)
+
+	waitFor(t, func() bool { return store.pending() == 0 })
+	if count := sink.count(); count != 1 {
+		t.Errorf("Expected the event to be delivered once, got %d", count)
+	}
+}
+
+func TestSkipEvents(t *testing.T) {
+	sink := &recordingSink{}
+	skipping := SkipEvents(sink, entity.EventVoteCast)
+
+	for _, eventType := range []entity.EventType{entity.EventVoteCast, entity.EventVotingCreated, entity.EventVotingClosed} {
+		event, _ := entity.NewEvent(eventType, uuid.New(), nil, nil)
+		if err := skipping.DeliverEvent(context.Background(), event); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if count := sink.count(); count != 2 {
+		t.Errorf("Expected the voting events only, got %d", count)
+	}
+}
+
+func TestOutboxRelayCleanup(t *testing.T) {
+	store := NewMemoryOutboxStore()
+	event, _ := entity.NewEvent(entity.EventVoteCast, uuid.New(), nil, nil)
+	store.Add(event)
+
+	relay := NewOutboxRelay(NewDefaultLogger(), store, Outbox{Retention: time.Minute}, &recordingSink{})
+	relay.relay(context.Background())
+
+	relay.cleanup(context.Background())
+	if len(store.events) != 1 {
+		t.Errorf("Expected the event to be kept for the retention, got %d events", len(store.events))
+	}
+
+	relay.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	relay.cleanup(context.Background())
+	if len(store.events) != 0 {
+		t.Errorf("Expected the delivered event to be deleted, got %d events", len(store.events))
+	}
+}
+
+func TestMemoryOutboxClaimDeliversWithoutLock(t *testing.T) {
+	store := NewMemoryOutboxStore()
+	first, _ := entity.NewEvent(entity.EventVoteCast, uuid.New(), nil, nil)
+	second, _ := entity.NewEvent(entity.EventVoteCast, uuid.New(), nil, nil)
+	store.Add(first)
+
+	// A sink may write to the outbox, another claim meanwhile skips the claimed events
+	claimed, err := store.Claim(context.Background(), 10, func(ctx context.Context, events []entity.Event) error {
+		store.Add(second)
+
+		nested, err := store.Claim(ctx, 10, func(_ context.Context, events []entity.Event) error {
+			if len(events) != 1 || events[0].ID != second.ID {
+				t.Errorf("Expected the added event only, got %+v", events)
+			}
+			return nil
+		})
+		if err != nil || nested != 1 {
+			t.Errorf("Expected one event claimed meanwhile, got %d, %v", nested, err)
+		}
+		return nil
+	})
+	if err != nil || claimed != 1 {
+		t.Fatalf("Expected one event claimed, got %d, %v", claimed, err)
+	}
+	if pending := store.pending(); pending != 0 {
+		t.Errorf("Expected every event delivered, got %d pending", pending)
+	}
+}
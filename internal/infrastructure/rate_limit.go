@@ -0,0 +1,187 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitScopeChoice    = "choice"
+	RateLimitScopeWrite     = "write"
+	RateLimitScopePerVoting = "per_voting"
+)
+
+// RateLimitKey is the bucket of the key in the scope.
+type RateLimitKey struct {
+	Scope string
+	Key   string
+}
+
+// RateLimitBucket is the bucket of the key with its rate and burst.
+type RateLimitBucket struct {
+	Key    string
+	Bucket TokenBucket
+}
+
+type RateLimitStore interface {
+	// Take takes a token from every bucket when all of them have one and returns zero. Otherwise no token
+	// is taken and the longest time until the next token of the empty buckets is returned.
+	Take(ctx context.Context, buckets []RateLimitBucket, now time.Time) (time.Duration, error)
+}
+
+// RateLimiter applies the token buckets of their scopes to the keys of a request.
+type RateLimiter struct {
+	log   *slog.Logger
+	store RateLimitStore
+	cfg   RateLimit
+	now   func() time.Time
+}
+
+func NewRateLimiter(log *slog.Logger, store RateLimitStore, cfg RateLimit) *RateLimiter {
+	return &RateLimiter{
+		log:   log,
+		store: store,
+		cfg:   cfg.WithDefaults(),
+		now:   time.Now,
+	}
+}
+
+func (l *RateLimiter) bucket(scope string) (TokenBucket, error) {
+	switch scope {
+	case RateLimitScopeChoice:
+		return l.cfg.Choice, nil
+	case RateLimitScopeWrite:
+		return l.cfg.Write, nil
+	case RateLimitScopePerVoting:
+		return l.cfg.PerVoting, nil
+	default:
+		return TokenBucket{}, fmt.Errorf("unknown rate limit scope: %s", scope)
+	}
+}
+
+// Enabled tells whether the requests are limited at all, a disabled limiter allows every request.
+func (l *RateLimiter) Enabled() bool {
+	return l.cfg.Enabled
+}
+
+// Allow returns how long the caller has to wait before the next request, zero means the request is allowed.
+// Every key has its own bucket in the scope, the request is rejected when any of them is empty.
+func (l *RateLimiter) Allow(ctx context.Context, scope string, keys ...string) (time.Duration, error) {
+	scoped := make([]RateLimitKey, 0, len(keys))
+	for _, key := range keys {
+		scoped = append(scoped, RateLimitKey{Scope: scope, Key: key})
+	}
+
+	return l.AllowKeys(ctx, scoped...)
+}
+
+// AllowKeys is Allow for keys of different scopes. A rejected request takes no tokens,
+// so a request rejected by one bucket doesn't drain the others.
+func (l *RateLimiter) AllowKeys(ctx context.Context, keys ...RateLimitKey) (time.Duration, error) {
+	if !l.cfg.Enabled || len(keys) == 0 {
+		return 0, nil
+	}
+
+	buckets := make([]RateLimitBucket, 0, len(keys))
+	for _, key := range keys {
+		bucket, err := l.bucket(key.Scope)
+		if err != nil {
+			return 0, err
+		}
+		buckets = append(buckets, RateLimitBucket{Key: key.Scope + ":" + key.Key, Bucket: bucket})
+	}
+
+	wait, err := l.store.Take(ctx, buckets, l.now())
+	if err != nil {
+		return 0, fmt.Errorf("take tokens: %w", err)
+	}
+
+	if wait > 0 {
+		l.log.Warn("rate limit exceeded",
+			slog.Any("keys", keys),
+			slog.Duration("retry_after", wait),
+		)
+	}
+
+	return wait, nil
+}
+
+// retryAfter returns the time until the bucket refills up to one token.
+func retryAfter(tokens float64, bucket TokenBucket) time.Duration {
+	return time.Duration(math.Ceil((1 - tokens) / bucket.Rate * float64(time.Second)))
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// MemoryRateLimitStore keeps buckets of a single instance.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: make(map[string]*memoryBucket),
+	}
+}
+
+func (s *MemoryRateLimitStore) Take(_ context.Context, buckets []RateLimitBucket, now time.Time) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+
+	// Buckets are refilled first, the tokens are taken when none of them is empty
+	var wait time.Duration
+	refilled := make([]*memoryBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		b, ok := s.buckets[bucket.Key]
+		if !ok {
+			b = &memoryBucket{tokens: float64(bucket.Bucket.Burst), updatedAt: now}
+			s.buckets[bucket.Key] = b
+		}
+
+		b.tokens = min(float64(bucket.Bucket.Burst), b.tokens+now.Sub(b.updatedAt).Seconds()*bucket.Bucket.Rate)
+		b.updatedAt = now
+		refilled = append(refilled, b)
+
+		if b.tokens < 1 {
+			wait = max(wait, retryAfter(b.tokens, bucket.Bucket))
+		}
+	}
+
+	if wait > 0 {
+		return wait, nil
+	}
+
+	for _, b := range refilled {
+		b.tokens--
+	}
+
+	return 0, nil
+}
+
+// sweep drops buckets which have been idle for a while, they would be full anyway.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	const idle = 10 * time.Minute
+
+	if now.Sub(s.lastSweep) < idle {
+		return
+	}
+
+	for key, b := range s.buckets {
+		if now.Sub(b.updatedAt) > idle {
+			delete(s.buckets, key)
+		}
+	}
+
+	s.lastSweep = now
+}
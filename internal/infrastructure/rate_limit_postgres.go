@@ -0,0 +1,118 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const tbRateLimitBuckets = "rate_limit_buckets"
+
+// PostgresRateLimitStore shares buckets between replicas.
+// The database clock is used, so replicas with skewed clocks agree on the refill.
+// The buckets of a request are locked together, so a rejected request takes no tokens.
+type PostgresRateLimitStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresRateLimitStore(db *pgxpool.Pool) *PostgresRateLimitStore {
+	return &PostgresRateLimitStore{
+		db: db,
+	}
+}
+
+type bucketState struct {
+	Key    string  `db:"key"`
+	Tokens float64 `db:"tokens"`
+	// Elapsed seconds since the last update by the database clock
+	Elapsed float64 `db:"elapsed"`
+}
+
+// updateBucketsSQL takes the tokens of the refilled buckets by one statement.
+const updateBucketsSQL = `UPDATE ` + tbRateLimitBuckets + ` b
+SET tokens = t.tokens, updated_at = now()
+FROM unnest($1::text[], $2::float8[]) AS t (key, tokens)
+WHERE b.key = t.key`
+
+func (s *PostgresRateLimitStore) Take(ctx context.Context, buckets []RateLimitBucket, _ time.Time) (time.Duration, error) {
+	// Rows are created and locked in the order of their keys, requests sharing keys don't deadlock
+	buckets = slices.Clone(buckets)
+	slices.SortFunc(buckets, func(a, b RateLimitBucket) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	buckets = slices.CompactFunc(buckets, func(a, b RateLimitBucket) bool {
+		return a.Key == b.Key
+	})
+
+	tx, err := s.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	insertBuilder := sq.Insert(tbRateLimitBuckets).
+		Columns("key", "tokens", "updated_at").
+		Suffix("ON CONFLICT (key) DO NOTHING")
+	keys := make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		insertBuilder = insertBuilder.Values(bucket.Key, float64(bucket.Bucket.Burst), sq.Expr("now()"))
+		keys = append(keys, bucket.Key)
+	}
+
+	stmt, args, err := insertBuilder.PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("build statement: %w", err)
+	}
+
+	if _, err = tx.Exec(ctx, stmt, args...); err != nil {
+		return 0, fmt.Errorf("create buckets: %w", err)
+	}
+
+	stmt, args, err = sq.Select("key", "tokens", "EXTRACT(EPOCH FROM (now() - updated_at))::float8 AS elapsed").
+		From(tbRateLimitBuckets).
+		Where(sq.Eq{"key": keys}).
+		OrderBy("key").
+		Suffix("FOR UPDATE").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("build statement: %w", err)
+	}
+
+	states, err := FetchRows[bucketState](ctx, tx, stmt, args...)
+	if err != nil {
+		return 0, fmt.Errorf("lock buckets: %w", err)
+	}
+
+	// The refill is calculated from the locked rows, the tokens are taken when none of the buckets is empty
+	var wait time.Duration
+	tokens := make([]float64, len(buckets))
+	for i, bucket := range buckets {
+		idx := slices.IndexFunc(states, func(state *bucketState) bool { return state.Key == bucket.Key })
+		if idx < 0 {
+			return 0, fmt.Errorf("bucket %s is missing", bucket.Key)
+		}
+
+		tokens[i] = min(float64(bucket.Bucket.Burst), states[idx].Tokens+states[idx].Elapsed*bucket.Bucket.Rate)
+		if tokens[i] < 1 {
+			wait = max(wait, retryAfter(tokens[i], bucket.Bucket))
+		}
+		tokens[i]--
+	}
+
+	if wait > 0 {
+		return wait, nil
+	}
+
+	if _, err = tx.Exec(ctx, updateBucketsSQL, keys, tokens); err != nil {
+		return 0, fmt.Errorf("take tokens: %w", err)
+	}
+
+	return 0, tx.Commit(ctx)
+}
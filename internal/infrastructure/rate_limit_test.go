@@ -0,0 +1,111 @@
+package infrastructure
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter(now *time.Time) *RateLimiter {
+	limiter := NewRateLimiter(NewDefaultLogger(), NewMemoryRateLimitStore(), RateLimit{
+		Enabled: true,
+		Choice:  TokenBucket{Rate: 1, Burst: 2},
+	})
+	limiter.now = func() time.Time { return *now }
+
+	return limiter
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	limiter := newTestRateLimiter(&now)
+
+	for i := 0; i < 2; i++ {
+		if wait, _ := limiter.Allow(ctx, RateLimitScopeChoice, "user:1"); wait != 0 {
+			t.Errorf("Request %d: expected to be allowed, got wait %v", i+1, wait)
+		}
+	}
+
+	wait, _ := limiter.Allow(ctx, RateLimitScopeChoice, "user:1")
+	if wait != time.Second {
+		t.Errorf("Expected wait of a second, got %v", wait)
+	}
+
+	if wait, _ = limiter.Allow(ctx, RateLimitScopeChoice, "user:2"); wait != 0 {
+		t.Errorf("Expected another key to be allowed, got wait %v", wait)
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	limiter := newTestRateLimiter(&now)
+
+	for i := 0; i < 3; i++ {
+		_, _ = limiter.Allow(ctx, RateLimitScopeChoice, "user:1")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if wait, _ := limiter.Allow(ctx, RateLimitScopeChoice, "user:1"); wait != 500*time.Millisecond {
+		t.Errorf("Expected wait of half a second, got %v", wait)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if wait, _ := limiter.Allow(ctx, RateLimitScopeChoice, "user:1"); wait != 0 {
+		t.Errorf("Expected refilled bucket to allow the request, got wait %v", wait)
+	}
+}
+
+func TestRateLimiterAnyKeyRejects(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	limiter := newTestRateLimiter(&now)
+
+	_, _ = limiter.Allow(ctx, RateLimitScopeChoice, "ip:10.0.0.1")
+	_, _ = limiter.Allow(ctx, RateLimitScopeChoice, "ip:10.0.0.1")
+
+	if wait, _ := limiter.Allow(ctx, RateLimitScopeChoice, "user:1", "ip:10.0.0.1"); wait == 0 {
+		t.Errorf("Expected request to be rejected by the ip bucket")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := NewRateLimiter(NewDefaultLogger(), NewMemoryRateLimitStore(), RateLimit{})
+
+	for i := 0; i < 100; i++ {
+		if wait, _ := limiter.Allow(context.Background(), RateLimitScopeChoice, "user:1"); wait != 0 {
+			t.Fatalf("Expected disabled limiter to allow everything, got wait %v", wait)
+		}
+	}
+}
+
+func TestRateLimiterRejectedRequestTakesNoTokens(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	limiter := NewRateLimiter(NewDefaultLogger(), NewMemoryRateLimitStore(), RateLimit{
+		Enabled:   true,
+		Choice:    TokenBucket{Rate: 1, Burst: 2},
+		PerVoting: TokenBucket{Rate: 1, Burst: 1},
+	})
+	limiter.now = func() time.Time { return now }
+
+	request := []RateLimitKey{
+		{Scope: RateLimitScopeChoice, Key: "user:1"},
+		{Scope: RateLimitScopePerVoting, Key: "voting:1"},
+	}
+	if wait, _ := limiter.AllowKeys(ctx, request...); wait != 0 {
+		t.Fatalf("Expected the first request to be allowed, got wait %v", wait)
+	}
+
+	// The voting bucket is empty, the user bucket keeps its last token
+	for i := 0; i < 3; i++ {
+		if wait, _ := limiter.AllowKeys(ctx, request...); wait == 0 {
+			t.Fatalf("Expected the request to be rejected by the voting bucket")
+		}
+	}
+
+	if wait, _ := limiter.Allow(ctx, RateLimitScopeChoice, "user:1"); wait != 0 {
+		t.Errorf("Expected rejected requests to keep the user tokens, got wait %v", wait)
+	}
+}
@@ -1,51 +1,689 @@
 package infrastructure
 
 import (
+	"fmt"
 	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
 )
 
+// ClientConn is implemented by *websocket.Conn.
 type ClientConn interface {
 	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetWriteDeadline(t time.Time) error
 	Close() error
 }
 
+// CloseSlowConsumer is the close reason of clients evicted due to the full send queue.
+const CloseSlowConsumer = "slow consumer"
+
+// Topic describes what a published message is about.
+type Topic struct {
+	VotingID uuid.UUID
+	Tags     []string
+}
+
+// Topics a client is subscribed to, All subscribes to every voting.
+type Topics struct {
+	All       bool        `json:"all,omitempty"`
+	VotingIDs []uuid.UUID `json:"voting_ids,omitempty"`
+	Tags      []string    `json:"tags,omitempty"`
+}
+
+// Cursor is the position of a client in the events of a hub. Sequences are assigned by the hub
+// of every instance on its own, Epoch tells which hub assigned them and changes when it's restarted.
+type Cursor struct {
+	Epoch    string
+	Sequence uint64
+}
+
+// String is the id of the SSE event, "<epoch>:<sequence>".
+func (c Cursor) String() string {
+	return c.Epoch + ":" + strconv.FormatUint(c.Sequence, 10)
+}
+
+// ParseCursor parses String, a bare sequence of an older client has no epoch and never matches a hub.
+func ParseCursor(s string) (Cursor, error) {
+	epoch, sequence, found := strings.Cut(s, ":")
+	if !found {
+		epoch, sequence = "", s
+	}
+
+	n, err := strconv.ParseUint(sequence, 10, 64)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("invalid cursor: %s", s)
+	}
+
+	return Cursor{Epoch: epoch, Sequence: n}, nil
+}
+
+type subscriber struct {
+	identity entity.Identity
+	// encoding of the events, the other messages are sent as text
+	encoding Encoding
+	all      bool
+	votings  map[uuid.UUID]struct{}
+	tags     map[string]struct{}
+	// send is drained by the writer goroutine of the client, it's closed when the client is removed
+	send chan outgoing
+	// closeCode is sent to the client by the writer when it's evicted
+	closeCode   int
+	closeReason string
+}
+
+// matches reports whether the client is subscribed to the topic.
+func (s *subscriber) matches(topic Topic) bool {
+	if s.all {
+		return true
+	}
+	if _, ok := s.votings[topic.VotingID]; ok {
+		return true
+	}
+
+	return slices.ContainsFunc(topic.Tags, func(tag string) bool {
+		_, ok := s.tags[tag]
+		return ok
+	})
+}
+
+func (s *subscriber) topics() Topics {
+	topics := Topics{All: s.all}
+	for id := range s.votings {
+		topics.VotingIDs = append(topics.VotingIDs, id)
+	}
+	for tag := range s.tags {
+		topics.Tags = append(topics.Tags, tag)
+	}
+
+	return topics
+}
+
+// Subscription is the hub of the subscribed clients. Clients are indexed
+// by their topics, so a published message only touches interested clients.
+// Every client has its own writer goroutine with a bounded queue, publishing
+// never waits for a client and the clients which can't keep up are evicted.
 type Subscription struct {
 	logger  *slog.Logger
-	clients map[ClientConn]bool
-	mu      sync.Mutex
+	cfg     WebSocket
+	clients map[ClientConn]*subscriber
+	all     map[ClientConn]struct{}
+	votings map[uuid.UUID]map[ClientConn]struct{}
+	tags    map[string]map[ClientConn]struct{}
+	// epoch of the sequences of this hub
+	epoch string
+	// sequence of the last published event
+	sequence uint64
+	history  eventHistory
+	// votingTags are the tags of the votings seen in events, the tag subscribers of a voting are its viewers too
+	votingTags map[uuid.UUID][]string
+	// presenceDirty are the votings whose viewers may have changed since the last broadcast
+	presenceDirty   map[uuid.UUID]struct{}
+	presenceSent    map[uuid.UUID]int
+	presencePending bool
+	mu              sync.Mutex
+}
+
+// outgoing is a message queued for a client.
+type outgoing struct {
+	data   []byte
+	binary bool
 }
 
-func NewSubscription(logger *slog.Logger) *Subscription {
+type historyEntry struct {
+	topic Topic
+	event *encodedEvent
+}
+
+// eventHistory is a ring of the latest published events, their sequences are consecutive.
+type eventHistory struct {
+	entries []historyEntry
+	start   int
+	// last is the sequence of the newest entry
+	last uint64
+}
+
+func (h *eventHistory) push(sequence uint64, entry historyEntry) {
+	if len(h.entries) < cap(h.entries) {
+		h.entries = append(h.entries, entry)
+	} else {
+		h.entries[h.start] = entry
+		h.start = (h.start + 1) % len(h.entries)
+	}
+	h.last = sequence
+}
+
+// since returns the entries after the sequence, ok is false when some of them are already dropped.
+func (h *eventHistory) since(sequence uint64) ([]historyEntry, bool) {
+	if sequence > h.last {
+		// Not a sequence of this hub, e.g. it was restarted
+		return nil, false
+	}
+
+	missed := h.last - sequence
+	if missed > uint64(len(h.entries)) {
+		return nil, false
+	}
+
+	entries := make([]historyEntry, 0, missed)
+	for i := len(h.entries) - int(missed); i < len(h.entries); i++ {
+		entries = append(entries, h.entries[(h.start+i)%len(h.entries)])
+	}
+
+	return entries, true
+}
+
+func NewSubscription(logger *slog.Logger, cfg WebSocket) *Subscription {
+	cfg = cfg.WithDefaults()
+
 	return &Subscription{
 		logger:  logger,
-		clients: make(map[ClientConn]bool),
+		cfg:     cfg,
+		clients: make(map[ClientConn]*subscriber),
+		all:     make(map[ClientConn]struct{}),
+		votings: make(map[uuid.UUID]map[ClientConn]struct{}),
+		tags:    make(map[string]map[ClientConn]struct{}),
+		epoch:   strconv.FormatUint(rand.Uint64(), 36),
+		history: eventHistory{
+			entries: make([]historyEntry, 0, cfg.HistorySize),
+		},
+		votingTags:    make(map[uuid.UUID][]string),
+		presenceDirty: make(map[uuid.UUID]struct{}),
+		presenceSent:  make(map[uuid.UUID]int),
 	}
 }
 
-func (s *Subscription) AddClient(client ClientConn) {
+// AddClient subscribes the client on behalf of the authenticated identity, the client is subscribed to nothing yet.
+// Events are sent to the client in the encoding, the other messages are sent as text.
+func (s *Subscription) AddClient(client ClientConn, identity entity.Identity, encoding Encoding) {
+	sub := &subscriber{
+		identity: identity,
+		encoding: encoding,
+		votings:  make(map[uuid.UUID]struct{}),
+		tags:     make(map[string]struct{}),
+		send:     make(chan outgoing, s.cfg.SendQueueSize),
+	}
+
 	s.mu.Lock()
-	s.clients[client] = true
+	s.clients[client] = sub
+	count := len(s.clients)
 	s.mu.Unlock()
+
+	s.logger.Debug("Client connected", slog.String("user", identity.Username), slog.Int("clients", count))
+
+	go s.writeLoop(client, sub)
 }
 
+// RemoveClient forgets the client and stops its writer, the connection is closed by the owner.
 func (s *Subscription) RemoveClient(client ClientConn) {
 	s.mu.Lock()
-	delete(s.clients, client)
+	s.removeClient(client)
 	s.mu.Unlock()
 }
 
+func (s *Subscription) removeClient(client ClientConn) {
+	sub, ok := s.clients[client]
+	if !ok {
+		return
+	}
+
+	close(sub.send)
+	delete(s.all, client)
+	for id := range sub.votings {
+		removeIndex(s.votings, id, client)
+	}
+	for tag := range sub.tags {
+		removeIndex(s.tags, tag, client)
+	}
+	delete(s.clients, client)
+	s.viewersChanged(sub.topics())
+
+	s.logger.Debug("Client removed", slog.String("user", sub.identity.Username), slog.Int("clients", len(s.clients)))
+}
+
+// ClientsCount returns the number of connected clients.
+func (s *Subscription) ClientsCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.clients)
+}
+
+// Subscribe adds the topics to the client, it returns all topics of the client.
+func (s *Subscription) Subscribe(client ClientConn, topics Topics) Topics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.clients[client]
+	if !ok {
+		return Topics{}
+	}
+
+	return s.subscribe(client, sub, topics)
+}
+
+func (s *Subscription) subscribe(client ClientConn, sub *subscriber, topics Topics) Topics {
+	if topics.All {
+		sub.all = true
+		s.all[client] = struct{}{}
+	}
+	for _, id := range topics.VotingIDs {
+		sub.votings[id] = struct{}{}
+		addIndex(s.votings, id, client)
+	}
+	for _, tag := range topics.Tags {
+		sub.tags[tag] = struct{}{}
+		addIndex(s.tags, tag, client)
+	}
+	s.viewersChanged(topics)
+
+	return sub.topics()
+}
+
+// SubscribeFrom adds the topics to the client and replays the events published after the cursor
+// which the client gets only due to the new topics. Nothing is replayed and ok is false when
+// the events are not in the history anymore or the cursor is of another hub (another instance
+// or before a restart), the client needs a snapshot then.
+func (s *Subscription) SubscribeFrom(client ClientConn, topics Topics, from Cursor) (Topics, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.clients[client]
+	if !ok {
+		return Topics{}, true
+	}
+
+	before := &subscriber{
+		all:     sub.all,
+		votings: maps.Clone(sub.votings),
+		tags:    maps.Clone(sub.tags),
+	}
+	result := s.subscribe(client, sub, topics)
+	if from.Epoch != s.epoch {
+		return result, false
+	}
+
+	entries, ok := s.history.since(from.Sequence)
+	if !ok {
+		return result, false
+	}
+
+	for _, entry := range entries {
+		if sub.matches(entry.topic) && !before.matches(entry.topic) {
+			s.enqueueEvent(client, entry.event)
+		}
+	}
+
+	return result, true
+}
+
+// Unsubscribe removes the topics from the client, it returns the remaining topics of the client.
+func (s *Subscription) Unsubscribe(client ClientConn, topics Topics) Topics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.clients[client]
+	if !ok {
+		return Topics{}
+	}
+
+	if topics.All {
+		sub.all = false
+		delete(s.all, client)
+	}
+	for _, id := range topics.VotingIDs {
+		delete(sub.votings, id)
+		removeIndex(s.votings, id, client)
+	}
+	for _, tag := range topics.Tags {
+		delete(sub.tags, tag)
+		removeIndex(s.tags, tag, client)
+	}
+	s.viewersChanged(topics)
+
+	return sub.topics()
+}
+
+// Viewers returns the number of users receiving the events of the voting on this instance: subscribed to it,
+// to any of its tags or to everything. A user with several connections counts once.
+func (s *Subscription) Viewers(topic Topic) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.viewers(topic)
+}
+
+func (s *Subscription) viewers(topic Topic) int {
+	viewers := make(map[string]struct{})
+	for client := range s.interested(topic) {
+		viewers[viewerKey(s.clients[client].identity)] = struct{}{}
+	}
+
+	return len(viewers)
+}
+
+func viewerKey(identity entity.Identity) string {
+	if identity.UserID != uuid.Nil {
+		return identity.UserID.String()
+	}
+
+	return identity.Username
+}
+
+// viewersChanged marks the votings whose viewers may change with the topics: the votings themselves
+// and the known votings of the tags, or every known voting for All.
+func (s *Subscription) viewersChanged(topics Topics) {
+	for _, id := range topics.VotingIDs {
+		s.presenceChanged(id)
+	}
+	if !topics.All && len(topics.Tags) == 0 {
+		return
+	}
+
+	for id, tags := range s.votingTags {
+		if topics.All || slices.ContainsFunc(tags, func(tag string) bool { return slices.Contains(topics.Tags, tag) }) {
+			s.presenceChanged(id)
+		}
+	}
+	if topics.All {
+		for id := range s.presenceSent {
+			s.presenceChanged(id)
+		}
+	}
+}
+
+// presenceChanged schedules the broadcast, all changes within PresenceInterval are sent at once.
+func (s *Subscription) presenceChanged(votingID uuid.UUID) {
+	s.presenceDirty[votingID] = struct{}{}
+	if s.presencePending {
+		return
+	}
+
+	s.presencePending = true
+	time.AfterFunc(s.cfg.PresenceInterval, s.broadcastPresence)
+}
+
+// broadcastPresence sends the number of viewers to the viewers of every changed voting.
+// It's stamped with the last sequence and not kept in the history, like a snapshot.
+func (s *Subscription) broadcastPresence() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.presencePending = false
+	for votingID := range s.presenceDirty {
+		delete(s.presenceDirty, votingID)
+
+		topic := Topic{VotingID: votingID, Tags: s.votingTags[votingID]}
+		viewers := s.viewers(topic)
+		sent, ok := s.presenceSent[votingID]
+		if (ok && sent == viewers) || (!ok && viewers == 0) {
+			continue
+		}
+		if viewers == 0 {
+			delete(s.presenceSent, votingID)
+		} else {
+			s.presenceSent[votingID] = viewers
+		}
+
+		event, err := entity.NewEvent(entity.EventPresence, votingID, nil, entity.PresencePayload{
+			Viewers: viewers,
+		})
+		if err != nil {
+			s.logger.Error("create presence event", slog.Any("error", err))
+			continue
+		}
+		event.Epoch, event.Sequence = s.epoch, s.sequence
+
+		encoded, err := newEncodedEvent(event)
+		if err != nil {
+			s.logger.Error("marshal event", slog.String("type", string(event.Type)), slog.Any("error", err))
+			continue
+		}
+
+		for client := range s.interested(topic) {
+			s.enqueueEvent(client, encoded)
+		}
+	}
+}
+
+func addIndex[K comparable](index map[K]map[ClientConn]struct{}, key K, client ClientConn) {
+	clients, ok := index[key]
+	if !ok {
+		clients = make(map[ClientConn]struct{})
+		index[key] = clients
+	}
+	clients[client] = struct{}{}
+}
+
+func removeIndex[K comparable](index map[K]map[ClientConn]struct{}, key K, client ClientConn) {
+	clients := index[key]
+	delete(clients, client)
+	if len(clients) == 0 {
+		delete(index, key)
+	}
+}
+
+// PublishEvent assigns the next sequence to the event and publishes it to the interested clients.
+func (s *Subscription) PublishEvent(event entity.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sequence++
+	event.Epoch, event.Sequence = s.epoch, s.sequence
+
+	encoded, err := newEncodedEvent(event)
+	if err != nil {
+		s.logger.Error("marshal event", slog.String("type", string(event.Type)), slog.Any("error", err))
+		return
+	}
+
+	topic := Topic{VotingID: event.VotingID, Tags: event.Tags}
+	s.learnTags(event)
+	s.history.push(event.Sequence, historyEntry{topic: topic, event: encoded})
+	for client := range s.interested(topic) {
+		s.enqueueEvent(client, encoded)
+	}
+}
+
+// Cursor returns the cursor of the last published event.
+func (s *Subscription) Cursor() Cursor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return Cursor{Epoch: s.epoch, Sequence: s.sequence}
+}
+
+// learnTags keeps the tags of the voting of the event, the viewers of a voting include its tag subscribers.
+func (s *Subscription) learnTags(event entity.Event) {
+	if event.VotingID == uuid.Nil {
+		return
+	}
+	if event.Type == entity.EventVotingDeleted {
+		delete(s.votingTags, event.VotingID)
+		delete(s.presenceSent, event.VotingID)
+		return
+	}
+
+	known, ok := s.votingTags[event.VotingID]
+	if ok && slices.Equal(known, event.Tags) {
+		return
+	}
+	s.votingTags[event.VotingID] = slices.Clone(event.Tags)
+	if ok || len(event.Tags) > 0 {
+		// The tag subscribers start or stop viewing the voting
+		s.presenceChanged(event.VotingID)
+	}
+}
+
+// SendEvent sends the event to a single client with the cursor set by the caller. A snapshot is stamped
+// with Cursor taken before its state is read: the state has at least the events up to that sequence,
+// the events published while it's read are replayed to the client again and applying them twice is harmless.
+func (s *Subscription) SendEvent(client ClientConn, event entity.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.clients[client]; !ok {
+		return
+	}
+
+	encoded, err := newEncodedEvent(event)
+	if err != nil {
+		s.logger.Error("marshal event", slog.String("type", string(event.Type)), slog.Any("error", err))
+		return
+	}
+
+	s.enqueueEvent(client, encoded)
+}
+
+// Topics returns the topics of the client.
+func (s *Subscription) Topics(client ClientConn) Topics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.clients[client]
+	if !ok {
+		return Topics{}
+	}
+
+	return sub.topics()
+}
+
+// Publish sends the message to the clients subscribed to the voting, to any of its tags or to everything.
+func (s *Subscription) Publish(topic Topic, message []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for client := range s.interested(topic) {
+		s.enqueue(client, outgoing{data: message})
+	}
+}
+
+// interested returns the clients subscribed to the voting, to any of its tags or to everything.
+func (s *Subscription) interested(topic Topic) map[ClientConn]struct{} {
+	interested := make(map[ClientConn]struct{}, len(s.all))
+	for client := range s.all {
+		interested[client] = struct{}{}
+	}
+	for client := range s.votings[topic.VotingID] {
+		interested[client] = struct{}{}
+	}
+	for _, tag := range topic.Tags {
+		for client := range s.tags[tag] {
+			interested[client] = struct{}{}
+		}
+	}
+
+	return interested
+}
+
+// Send writes the message to a single client, e.g. the reply to its command.
+func (s *Subscription) Send(client ClientConn, message []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.clients[client]; ok {
+		s.enqueue(client, outgoing{data: message})
+	}
+}
+
+// Broadcast sends the message to every client, the identity of the client is not checked,
+// votings have no visibility rules yet, so everyone may see everything.
 func (s *Subscription) Broadcast(message []byte) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	for client := range s.clients {
-		if err := client.WriteMessage(websocket.TextMessage, message); err != nil {
-			client.Close()
-			delete(s.clients, client)
-			s.logger.Error("Client disconnected", slog.String("error", err.Error()))
+		s.enqueue(client, outgoing{data: message})
+	}
+}
+
+// enqueueEvent queues the event in the encoding of the client.
+func (s *Subscription) enqueueEvent(client ClientConn, event *encodedEvent) {
+	sub, ok := s.clients[client]
+	if !ok {
+		return
+	}
+
+	encoding := sub.encoding
+	if encoding == "" {
+		encoding = EncodingJSON
+	}
+	frame, err := event.frame(encoding)
+	if err != nil {
+		s.logger.Error("encode event", slog.String("encoding", string(encoding)), slog.Any("error", err))
+		return
+	}
+
+	s.enqueue(client, outgoing{data: frame, binary: encoding.Binary()})
+}
+
+// enqueue never blocks, the client with the full queue is evicted.
+func (s *Subscription) enqueue(client ClientConn, message outgoing) {
+	sub, ok := s.clients[client]
+	if !ok {
+		return
+	}
+
+	select {
+	case sub.send <- message:
+	default:
+		s.logger.Warn("Evict slow client", slog.String("user", sub.identity.Username), slog.Int("queue", len(sub.send)))
+		sub.closeCode = websocket.ClosePolicyViolation
+		sub.closeReason = CloseSlowConsumer
+		s.removeClient(client)
+	}
+}
+
+func (s *Subscription) writeLoop(client ClientConn, sub *subscriber) {
+	ticker := time.NewTicker(s.cfg.PingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message, ok := <-sub.send:
+			if !ok {
+				// Removed by the owner or evicted by the hub
+				if sub.closeCode != 0 {
+					closeMessage := websocket.FormatCloseMessage(sub.closeCode, sub.closeReason)
+					_ = client.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(s.cfg.WriteWait))
+					client.Close()
+				}
+				return
+			}
+
+			if err := client.SetWriteDeadline(time.Now().Add(s.cfg.WriteWait)); err != nil {
+				s.dropClient(client, err)
+				return
+			}
+
+			messageType := websocket.TextMessage
+			if message.binary {
+				messageType = websocket.BinaryMessage
+			}
+			if err := client.WriteMessage(messageType, message.data); err != nil {
+				s.dropClient(client, err)
+				return
+			}
+		case <-ticker.C:
+			if err := client.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.cfg.WriteWait)); err != nil {
+				s.dropClient(client, err)
+				return
+			}
 		}
 	}
 }
+
+func (s *Subscription) dropClient(client ClientConn, err error) {
+	client.Close()
+	s.RemoveClient(client)
+	s.logger.Error("Client disconnected", slog.String("error", err.Error()))
+}
@@ -1,15 +1,21 @@
 package infrastructure
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
 )
 
 func TestNewSubscription(t *testing.T) {
 	logger := NewDefaultLogger()
-	s := NewSubscription(logger)
+	s := NewSubscription(logger, WebSocket{})
 	if len(s.clients) != 0 {
 		t.Errorf("Expected empty clients map, got %v", s.clients)
 	}
@@ -17,48 +23,129 @@ func TestNewSubscription(t *testing.T) {
 
 func TestAddClient(t *testing.T) {
 	logger := NewDefaultLogger()
-	s := NewSubscription(logger)
+	s := NewSubscription(logger, WebSocket{})
 	client := &websocket.Conn{}
-	s.AddClient(client)
-	if _, ok := s.clients[client]; !ok {
+	s.AddClient(client, entity.Identity{}, EncodingJSON)
+	if !hasClient(s, client) {
 		t.Errorf("Expected client to be added to clients map")
 	}
 }
 
 func TestRemoveClient(t *testing.T) {
 	logger := NewDefaultLogger()
-	s := NewSubscription(logger)
+	s := NewSubscription(logger, WebSocket{})
 	client := &websocket.Conn{}
-	s.AddClient(client)
+	s.AddClient(client, entity.Identity{}, EncodingJSON)
 	s.RemoveClient(client)
-	if _, ok := s.clients[client]; ok {
+	if hasClient(s, client) {
 		t.Errorf("Expected client to be removed from clients map")
 	}
 }
 
+// mockConn records the written messages unless writeMessage or Conn is set.
 type mockConn struct {
 	Conn         ClientConn
 	writeMessage func(mt int, data []byte) error
+
+	mu       sync.Mutex
+	messages []string
+	controls []int
+	closed   bool
 }
 
 func (c *mockConn) WriteMessage(mt int, data []byte) error {
 	if c.writeMessage != nil {
 		return c.writeMessage(mt, data)
 	}
-	return c.Conn.WriteMessage(mt, data)
+	if c.Conn != nil {
+		return c.Conn.WriteMessage(mt, data)
+	}
+
+	c.mu.Lock()
+	c.messages = append(c.messages, string(data))
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *mockConn) WriteControl(mt int, data []byte, deadline time.Time) error {
+	c.mu.Lock()
+	c.controls = append(c.controls, mt)
+	if mt == websocket.CloseMessage {
+		c.messages = append(c.messages, string(data))
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *mockConn) SetWriteDeadline(t time.Time) error {
+	return nil
 }
 
 func (c *mockConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
 	return nil
 }
 
+func (c *mockConn) received() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.messages...)
+}
+
+func (c *mockConn) hasControl(mt int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, control := range c.controls {
+		if control == mt {
+			return true
+		}
+	}
+	return false
+}
+
+func hasClient(s *Subscription, client ClientConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.clients[client]
+	return ok
+}
+
+// waitFor polls the condition, writers deliver messages asynchronously.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Condition is not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fence sends a marker to the clients and waits for it, the queue of a client is FIFO,
+// so everything published before the fence has been written by then.
+func fence(t *testing.T, s *Subscription, clients ...*mockConn) {
+	t.Helper()
+	for _, client := range clients {
+		s.Send(client, []byte("fence"))
+	}
+	for _, client := range clients {
+		waitFor(t, func() bool {
+			received := client.received()
+			return len(received) > 0 && received[len(received)-1] == "fence"
+		})
+	}
+}
+
 func TestBroadcast(t *testing.T) {
 	logger := NewDefaultLogger()
-	subscription := NewSubscription(logger)
+	subscription := NewSubscription(logger, WebSocket{})
 	client1 := &mockConn{Conn: &websocket.Conn{}}
 	client2 := &mockConn{Conn: &websocket.Conn{}}
-	subscription.AddClient(client1)
-	subscription.AddClient(client2)
+	subscription.AddClient(client1, entity.Identity{}, EncodingJSON)
+	subscription.AddClient(client2, entity.Identity{}, EncodingJSON)
 
 	client1.writeMessage = func(mt int, data []byte) error {
 		return fmt.Errorf("mock error")
@@ -71,16 +158,406 @@ func TestBroadcast(t *testing.T) {
 	message := []byte("Hello")
 	subscription.Broadcast(message)
 
-	_, hasClient1 := subscription.clients[client1]
-	if hasClient1 {
-		t.Errorf("Expected client1 to be removed from clients map")
+	waitFor(t, func() bool {
+		return !hasClient(subscription, client1)
+	})
+	if !hasClient(subscription, client2) {
+		t.Errorf("Expected client2 to stay in clients map")
 	}
 }
 
 func TestBroadcastNoClients(t *testing.T) {
 	logger := NewDefaultLogger()
-	s := NewSubscription(logger)
+	s := NewSubscription(logger, WebSocket{})
 	message := []byte("Hello")
 	s.Broadcast(message)
 	// No error expected
 }
+
+func TestPublishRoutesByTopic(t *testing.T) {
+	logger := NewDefaultLogger()
+	subscription := NewSubscription(logger, WebSocket{})
+	votingID := uuid.New()
+
+	byVoting := &mockConn{}
+	byTag := &mockConn{}
+	everything := &mockConn{}
+	other := &mockConn{}
+	nothing := &mockConn{}
+	clients := []*mockConn{byVoting, byTag, everything, other, nothing}
+	for _, client := range clients {
+		subscription.AddClient(client, entity.Identity{}, EncodingJSON)
+	}
+
+	subscription.Subscribe(byVoting, Topics{VotingIDs: []uuid.UUID{votingID}})
+	subscription.Subscribe(byTag, Topics{Tags: []string{"team-a"}})
+	subscription.Subscribe(everything, Topics{All: true})
+	subscription.Subscribe(other, Topics{VotingIDs: []uuid.UUID{uuid.New()}, Tags: []string{"team-b"}})
+
+	subscription.Publish(Topic{VotingID: votingID, Tags: []string{"team-a"}}, []byte("Hello"))
+	fence(t, subscription, clients...)
+
+	for name, tc := range map[string]struct {
+		client *mockConn
+		want   int
+	}{
+		"voting":  {byVoting, 1},
+		"tag":     {byTag, 1},
+		"all":     {everything, 1},
+		"other":   {other, 0},
+		"nothing": {nothing, 0},
+	} {
+		if got := len(tc.client.received()) - 1; got != tc.want {
+			t.Errorf("Expected %s to receive %d messages, got %d", name, tc.want, got)
+		}
+	}
+}
+
+func TestPublishDeliversOncePerClient(t *testing.T) {
+	logger := NewDefaultLogger()
+	subscription := NewSubscription(logger, WebSocket{})
+	votingID := uuid.New()
+
+	client := &mockConn{}
+	subscription.AddClient(client, entity.Identity{}, EncodingJSON)
+	subscription.Subscribe(client, Topics{All: true, VotingIDs: []uuid.UUID{votingID}, Tags: []string{"a", "b"}})
+
+	subscription.Publish(Topic{VotingID: votingID, Tags: []string{"a", "b"}}, []byte("Hello"))
+	fence(t, subscription, client)
+
+	if got := len(client.received()) - 1; got != 1 {
+		t.Errorf("Expected exactly one message, got %d", got)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	logger := NewDefaultLogger()
+	subscription := NewSubscription(logger, WebSocket{})
+	votingID := uuid.New()
+
+	client := &mockConn{}
+	subscription.AddClient(client, entity.Identity{}, EncodingJSON)
+	subscription.Subscribe(client, Topics{VotingIDs: []uuid.UUID{votingID}, Tags: []string{"a"}})
+
+	topics := subscription.Unsubscribe(client, Topics{VotingIDs: []uuid.UUID{votingID}})
+	if len(topics.VotingIDs) != 0 || len(topics.Tags) != 1 {
+		t.Errorf("Expected only the tag to remain, got %+v", topics)
+	}
+
+	subscription.Publish(Topic{VotingID: votingID}, []byte("Hello"))
+	fence(t, subscription, client)
+	if got := len(client.received()) - 1; got != 0 {
+		t.Errorf("Expected no messages after unsubscribe, got %d", got)
+	}
+
+	subscription.RemoveClient(client)
+	if len(subscription.tags) != 0 || len(subscription.votings) != 0 {
+		t.Errorf("Expected indexes to be empty after the client is removed")
+	}
+}
+
+func TestPublishEventSequence(t *testing.T) {
+	logger := NewDefaultLogger()
+	subscription := NewSubscription(logger, WebSocket{})
+
+	client := &mockConn{}
+	subscription.AddClient(client, entity.Identity{}, EncodingJSON)
+	subscription.Subscribe(client, Topics{All: true})
+
+	for i := 0; i < 3; i++ {
+		event, _ := entity.NewEvent(entity.EventVoteCast, uuid.New(), nil, entity.VoteCastPayload{Score: int64(i)})
+		subscription.PublishEvent(event)
+	}
+
+	// The snapshot keeps the sequence taken before its state was read
+	snapshot, _ := entity.NewEvent(entity.EventSnapshot, uuid.Nil, nil, nil)
+	cursor := subscription.Cursor()
+	snapshot.Epoch, snapshot.Sequence = cursor.Epoch, cursor.Sequence
+	event, _ := entity.NewEvent(entity.EventVoteCast, uuid.New(), nil, entity.VoteCastPayload{Score: 3})
+	subscription.PublishEvent(event)
+	subscription.SendEvent(client, snapshot)
+
+	expected := []uint64{1, 2, 3, 4, 3}
+	waitFor(t, func() bool {
+		return len(client.received()) == len(expected)
+	})
+	for i, message := range client.received() {
+		var event entity.Event
+		if err := json.Unmarshal([]byte(message), &event); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if event.Sequence != expected[i] {
+			t.Errorf("Event %d: expected sequence %d, got %d", i, expected[i], event.Sequence)
+		}
+		if event.Version != entity.EventVersion {
+			t.Errorf("Event %d: expected version %d, got %d", i, entity.EventVersion, event.Version)
+		}
+	}
+}
+
+func TestSlowClientIsEvicted(t *testing.T) {
+	logger := NewDefaultLogger()
+	subscription := NewSubscription(logger, WebSocket{SendQueueSize: 2})
+
+	unblock := make(chan struct{})
+	slow := &mockConn{}
+	slow.writeMessage = func(mt int, data []byte) error {
+		<-unblock
+		return nil
+	}
+	fast := &mockConn{}
+	subscription.AddClient(slow, entity.Identity{}, EncodingJSON)
+	subscription.AddClient(fast, entity.Identity{}, EncodingJSON)
+
+	// The fast client keeps up with every message, the slow one gets stuck on the first
+	for i := 0; i < 10; i++ {
+		start := time.Now()
+		subscription.Broadcast([]byte("Hello"))
+		if time.Since(start) > 100*time.Millisecond {
+			t.Fatalf("Expected broadcast not to wait for the slow client")
+		}
+
+		waitFor(t, func() bool {
+			return len(fast.received()) == i+1
+		})
+	}
+
+	if hasClient(subscription, slow) {
+		t.Errorf("Expected slow client to be evicted")
+	}
+	if !hasClient(subscription, fast) {
+		t.Errorf("Expected fast client to stay")
+	}
+
+	close(unblock)
+	waitFor(t, func() bool {
+		return slow.hasControl(websocket.CloseMessage)
+	})
+
+	received := slow.received()
+	closeMessage := string(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, CloseSlowConsumer))
+	if received[len(received)-1] != closeMessage {
+		t.Errorf("Expected close message with policy violation, got %q", received[len(received)-1])
+	}
+}
+
+func TestClientIsPinged(t *testing.T) {
+	logger := NewDefaultLogger()
+	subscription := NewSubscription(logger, WebSocket{PongWait: 20 * time.Millisecond, PingPeriod: 5 * time.Millisecond})
+
+	client := &mockConn{}
+	subscription.AddClient(client, entity.Identity{}, EncodingJSON)
+	defer subscription.RemoveClient(client)
+
+	waitFor(t, func() bool {
+		return client.hasControl(websocket.PingMessage)
+	})
+}
+
+func TestManyClients(t *testing.T) {
+	logger := NewDefaultLogger()
+	subscription := NewSubscription(logger, WebSocket{})
+
+	const clientsCount = 2000
+	clients := make([]*mockConn, 0, clientsCount)
+	for i := 0; i < clientsCount; i++ {
+		client := &mockConn{}
+		clients = append(clients, client)
+		subscription.AddClient(client, entity.Identity{}, EncodingJSON)
+		subscription.Subscribe(client, Topics{All: true})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			subscription.Publish(Topic{VotingID: uuid.New()}, []byte("Hello"))
+		}()
+	}
+	wg.Wait()
+
+	for _, client := range clients {
+		waitFor(t, func() bool {
+			return len(client.received()) == 10
+		})
+		subscription.RemoveClient(client)
+	}
+}
+
+func TestClientsCount(t *testing.T) {
+	logger := NewDefaultLogger()
+	subscription := NewSubscription(logger, WebSocket{})
+
+	client1 := &mockConn{}
+	client2 := &mockConn{}
+	subscription.AddClient(client1, entity.Identity{}, EncodingJSON)
+	subscription.AddClient(client2, entity.Identity{}, EncodingJSON)
+	if count := subscription.ClientsCount(); count != 2 {
+		t.Errorf("Expected 2 clients, got %d", count)
+	}
+
+	subscription.RemoveClient(client1)
+	subscription.RemoveClient(client1)
+	if count := subscription.ClientsCount(); count != 1 {
+		t.Errorf("Expected 1 client, got %d", count)
+	}
+}
+
+func sequences(t *testing.T, messages []string) []uint64 {
+	t.Helper()
+	var result []uint64
+	for _, message := range messages {
+		var event entity.Event
+		if err := json.Unmarshal([]byte(message), &event); err != nil {
+			t.Fatalf("Unexpected message %s: %v", message, err)
+		}
+		result = append(result, event.Sequence)
+	}
+	return result
+}
+
+func TestSubscribeFromReplaysMissedEvents(t *testing.T) {
+	s := NewSubscription(NewDefaultLogger(), WebSocket{HistorySize: 3})
+
+	votingID := uuid.New()
+	for i := 0; i < 5; i++ {
+		event, _ := entity.NewEvent(entity.EventVoteCast, votingID, nil, nil)
+		s.PublishEvent(event)
+	}
+
+	client := &mockConn{}
+	s.AddClient(client, entity.Identity{}, EncodingJSON)
+	if _, ok := s.SubscribeFrom(client, Topics{VotingIDs: []uuid.UUID{votingID}}, Cursor{Epoch: s.epoch, Sequence: 3}); !ok {
+		t.Fatalf("Expected events after 3 to be replayed")
+	}
+	fence(t, s, client)
+
+	received := client.received()
+	if got := sequences(t, received[:len(received)-1]); fmt.Sprint(got) != "[4 5]" {
+		t.Errorf("Expected events [4 5], got %v", got)
+	}
+
+	// Events 1 and 2 are dropped from the history, 9 is not published yet, the sequences of
+	// another hub (another instance or before a restart) are unknown
+	other := NewSubscription(NewDefaultLogger(), WebSocket{})
+	for _, from := range []Cursor{{Epoch: s.epoch, Sequence: 1}, {Epoch: s.epoch, Sequence: 9}, {Epoch: other.epoch, Sequence: 4}, {Sequence: 4}} {
+		if _, ok := s.SubscribeFrom(client, Topics{}, from); ok {
+			t.Errorf("Expected replay from %v to require a snapshot", from)
+		}
+	}
+	if _, ok := s.SubscribeFrom(client, Topics{}, Cursor{Epoch: s.epoch, Sequence: 5}); !ok {
+		t.Errorf("Expected nothing to replay from the last sequence")
+	}
+}
+
+func TestParseCursor(t *testing.T) {
+	cursor := Cursor{Epoch: "k3x9", Sequence: 42}
+	parsed, err := ParseCursor(cursor.String())
+	if err != nil || parsed != cursor {
+		t.Errorf("Expected %v, got %v, %v", cursor, parsed, err)
+	}
+
+	if parsed, err = ParseCursor("42"); err != nil || parsed != (Cursor{Sequence: 42}) {
+		t.Errorf("Expected a bare sequence without epoch, got %v, %v", parsed, err)
+	}
+	if _, err = ParseCursor("k3x9:"); err == nil {
+		t.Errorf("Expected an error for the cursor without sequence")
+	}
+}
+
+func TestSubscribeFromReplaysOnlyNewTopics(t *testing.T) {
+	s := NewSubscription(NewDefaultLogger(), WebSocket{})
+	client := &mockConn{}
+	s.AddClient(client, entity.Identity{}, EncodingJSON)
+
+	votingA, votingB := uuid.New(), uuid.New()
+	s.Subscribe(client, Topics{VotingIDs: []uuid.UUID{votingA}})
+
+	eventA, _ := entity.NewEvent(entity.EventVoteCast, votingA, nil, nil)
+	s.PublishEvent(eventA)
+	eventB, _ := entity.NewEvent(entity.EventVoteCast, votingB, []string{"team-b"}, nil)
+	s.PublishEvent(eventB)
+	fence(t, s, client)
+
+	// The event of voting A is already delivered, only the event of the new tag is replayed
+	s.SubscribeFrom(client, Topics{Tags: []string{"team-b"}}, Cursor{Epoch: s.epoch})
+	s.Send(client, []byte("fence"))
+	waitFor(t, func() bool { return len(client.received()) == 4 })
+
+	received := client.received()
+	if received[1] != "fence" || received[3] != "fence" {
+		t.Fatalf("Expected a single replayed event, got %v", received)
+	}
+	if got := sequences(t, []string{received[0], received[2]}); fmt.Sprint(got) != "[1 2]" {
+		t.Errorf("Expected events [1 2], got %v", got)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	s := NewSubscription(NewDefaultLogger(), WebSocket{PresenceInterval: 20 * time.Millisecond})
+	votingID := uuid.New()
+	alice := entity.Identity{UserID: uuid.New(), Username: "alice"}
+	bob := entity.Identity{UserID: uuid.New(), Username: "bob"}
+
+	// Alice watches from two tabs, she counts once
+	aliceTab1, aliceTab2, bobTab := &mockConn{}, &mockConn{}, &mockConn{}
+	for client, identity := range map[*mockConn]entity.Identity{aliceTab1: alice, aliceTab2: alice, bobTab: bob} {
+		s.AddClient(client, identity, EncodingJSON)
+		s.Subscribe(client, Topics{VotingIDs: []uuid.UUID{votingID}})
+	}
+	if viewers := s.Viewers(Topic{VotingID: votingID}); viewers != 2 {
+		t.Errorf("Expected 2 viewers, got %d", viewers)
+	}
+
+	// The changes are throttled into a single broadcast
+	waitFor(t, func() bool { return len(bobTab.received()) == 1 })
+	time.Sleep(50 * time.Millisecond)
+	received := bobTab.received()
+	if len(received) != 1 || !strings.Contains(received[0], `"type":"voting.presence"`) || !strings.Contains(received[0], `"viewers":2`) {
+		t.Fatalf("Expected a single presence event with 2 viewers, got %v", received)
+	}
+
+	s.RemoveClient(aliceTab1)
+	if viewers := s.Viewers(Topic{VotingID: votingID}); viewers != 2 {
+		t.Errorf("Expected 2 viewers while alice has a tab open, got %d", viewers)
+	}
+
+	s.Unsubscribe(aliceTab2, Topics{VotingIDs: []uuid.UUID{votingID}})
+	waitFor(t, func() bool { return len(bobTab.received()) == 2 })
+	if received := bobTab.received(); !strings.Contains(received[1], `"viewers":1`) {
+		t.Errorf("Expected presence event with 1 viewer, got %s", received[1])
+	}
+}
+
+func TestPresenceCountsTagSubscribers(t *testing.T) {
+	s := NewSubscription(NewDefaultLogger(), WebSocket{PresenceInterval: 20 * time.Millisecond})
+	votingID := uuid.New()
+	alice := entity.Identity{UserID: uuid.New(), Username: "alice"}
+	bob := entity.Identity{UserID: uuid.New(), Username: "bob"}
+
+	aliceConn, bobConn := &mockConn{}, &mockConn{}
+	s.AddClient(aliceConn, alice, EncodingJSON)
+	s.Subscribe(aliceConn, Topics{VotingIDs: []uuid.UUID{votingID}})
+	s.AddClient(bobConn, bob, EncodingJSON)
+	s.Subscribe(bobConn, Topics{Tags: []string{"team-a"}})
+
+	// Bob gets the events of the voting by its tag, so he views it once its tags are known
+	if viewers := s.Viewers(Topic{VotingID: votingID, Tags: []string{"team-a"}}); viewers != 2 {
+		t.Errorf("Expected 2 viewers, got %d", viewers)
+	}
+
+	event, _ := entity.NewEvent(entity.EventVotingUpdated, votingID, []string{"team-a"}, nil)
+	s.PublishEvent(event)
+	waitFor(t, func() bool {
+		received := bobConn.received()
+		return len(received) == 2 && strings.Contains(received[1], `"viewers":2`)
+	})
+
+	before := len(aliceConn.received())
+	s.Unsubscribe(bobConn, Topics{Tags: []string{"team-a"}})
+	waitFor(t, func() bool {
+		received := aliceConn.received()
+		return len(received) > before && strings.Contains(received[len(received)-1], `"viewers":1`)
+	})
+}
@@ -0,0 +1,143 @@
+package infrastructure
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+)
+
+const (
+	// ticketSecretPlaceholder is the secret of config.example.toml, it must not sign real tickets.
+	ticketSecretPlaceholder = "change-me"
+	// minTicketSecretLength is the length of the HMAC-SHA256 key.
+	minTicketSecretLength = 32
+)
+
+// SubscribeTickets issues short-lived tickets for the websocket handshake,
+// browsers can't send the Authorization header there.
+// Tickets are signed with HMAC, so any instance sharing the secret can verify them.
+// A ticket is single-use: the instance verifying it remembers its nonce until it expires.
+type SubscribeTickets struct {
+	secret []byte
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu sync.Mutex
+	// used are the nonces of verified tickets with their expiry
+	used map[string]int64
+}
+
+// NewSubscribeTickets generates a random secret when none is configured, tickets then work on this instance only.
+// The placeholder of the example config and secrets shorter than 32 bytes are refused.
+func NewSubscribeTickets(cfg WebSocket) (*SubscribeTickets, error) {
+	cfg = cfg.WithDefaults()
+
+	secret := []byte(cfg.TicketSecret)
+	if len(secret) > 0 && (cfg.TicketSecret == ticketSecretPlaceholder || len(secret) < minTicketSecretLength) {
+		return nil, ErrTicketWeakSecret
+	}
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("generate ticket secret: %w", err)
+		}
+	}
+
+	return &SubscribeTickets{
+		secret: secret,
+		ttl:    cfg.TicketTTL,
+		now:    time.Now,
+		used:   make(map[string]int64),
+	}, nil
+}
+
+type ticketPayload struct {
+	entity.Identity
+	ExpiresAt int64  `json:"exp"`
+	Nonce     string `json:"nonce"`
+}
+
+func (t *SubscribeTickets) Issue(identity entity.Identity) (string, time.Time, error) {
+	expiresAt := t.now().Add(t.ttl)
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", time.Time{}, fmt.Errorf("generate ticket nonce: %w", err)
+	}
+
+	payload, err := json.Marshal(ticketPayload{
+		Identity:  identity,
+		ExpiresAt: expiresAt.Unix(),
+		Nonce:     base64.RawURLEncoding.EncodeToString(nonce),
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("marshal ticket: %w", err)
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return encoded + "." + t.sign(encoded), expiresAt, nil
+}
+
+func (t *SubscribeTickets) Verify(ticket string) (entity.Identity, error) {
+	encoded, signature, ok := strings.Cut(ticket, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(t.sign(encoded))) {
+		return entity.Identity{}, ErrTicketInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return entity.Identity{}, ErrTicketInvalid
+	}
+
+	var p ticketPayload
+	if err = json.Unmarshal(payload, &p); err != nil {
+		return entity.Identity{}, ErrTicketInvalid
+	}
+
+	now := t.now().Unix()
+	if now > p.ExpiresAt {
+		return entity.Identity{}, ErrTicketExpired
+	}
+
+	if !t.use(p.Nonce, p.ExpiresAt, now) {
+		return entity.Identity{}, ErrTicketUsed
+	}
+
+	return p.Identity, nil
+}
+
+// use marks the nonce used, it returns false when it was used before. Expired nonces are forgotten,
+// their tickets are rejected as expired anyway.
+func (t *SubscribeTickets) use(nonce string, expiresAt, now int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for used, exp := range t.used {
+		if now > exp {
+			delete(t.used, used)
+		}
+	}
+
+	if _, ok := t.used[nonce]; ok {
+		return false
+	}
+	t.used[nonce] = expiresAt
+
+	return true
+}
+
+func (t *SubscribeTickets) sign(encoded string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(encoded))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
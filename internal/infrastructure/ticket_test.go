@@ -0,0 +1,86 @@
+package infrastructure
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+)
+
+const (
+	testTicketSecret    = "0123456789abcdef0123456789abcdef"
+	anotherTicketSecret = "fedcba9876543210fedcba9876543210"
+)
+
+func TestSubscribeTicketsRoundTrip(t *testing.T) {
+	tickets, err := NewSubscribeTickets(WebSocket{TicketSecret: testTicketSecret})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	identity := entity.Identity{UserID: uuid.New(), Username: "user1"}
+	ticket, _, err := tickets.Issue(identity)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	got, err := tickets.Verify(ticket)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got != identity {
+		t.Errorf("Expected identity %v, got %v", identity, got)
+	}
+}
+
+func TestSubscribeTicketsExpired(t *testing.T) {
+	tickets, _ := NewSubscribeTickets(WebSocket{TicketSecret: testTicketSecret, TicketTTL: time.Second})
+	ticket, _, _ := tickets.Issue(entity.Identity{Username: "user1"})
+
+	tickets.now = func() time.Time { return time.Now().Add(time.Minute) }
+	if _, err := tickets.Verify(ticket); !errors.Is(err, ErrTicketExpired) {
+		t.Errorf("Expected ErrTicketExpired, got %v", err)
+	}
+}
+
+func TestSubscribeTicketsForeignSecret(t *testing.T) {
+	issuer, _ := NewSubscribeTickets(WebSocket{TicketSecret: testTicketSecret})
+	verifier, _ := NewSubscribeTickets(WebSocket{TicketSecret: anotherTicketSecret})
+	ticket, _, _ := issuer.Issue(entity.Identity{Username: "user1"})
+
+	if _, err := verifier.Verify(ticket); !errors.Is(err, ErrTicketInvalid) {
+		t.Errorf("Expected ErrTicketInvalid, got %v", err)
+	}
+
+	if _, err := issuer.Verify(ticket + "x"); !errors.Is(err, ErrTicketInvalid) {
+		t.Errorf("Expected ErrTicketInvalid for tampered ticket, got %v", err)
+	}
+}
+
+func TestSubscribeTicketsSingleUse(t *testing.T) {
+	tickets, _ := NewSubscribeTickets(WebSocket{TicketSecret: testTicketSecret})
+	ticket, _, _ := tickets.Issue(entity.Identity{Username: "user1"})
+
+	if _, err := tickets.Verify(ticket); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := tickets.Verify(ticket); !errors.Is(err, ErrTicketUsed) {
+		t.Errorf("Expected ErrTicketUsed for the replayed ticket, got %v", err)
+	}
+
+	// Every ticket has its own nonce
+	another, _, _ := tickets.Issue(entity.Identity{Username: "user1"})
+	if _, err := tickets.Verify(another); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSubscribeTicketsWeakSecret(t *testing.T) {
+	for _, secret := range []string{"change-me", "short"} {
+		if _, err := NewSubscribeTickets(WebSocket{TicketSecret: secret}); !errors.Is(err, ErrTicketWeakSecret) {
+			t.Errorf("Expected ErrTicketWeakSecret for %q, got %v", secret, err)
+		}
+	}
+}
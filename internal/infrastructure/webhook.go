@@ -0,0 +1,542 @@
+package infrastructure
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+)
+
+// Headers of a webhook request.
+const (
+	WebhookHeaderID        = "X-Webhook-Id"
+	WebhookHeaderEvent     = "X-Webhook-Event"
+	WebhookHeaderSignature = "X-Webhook-Signature"
+)
+
+// WebhookTask is a claimed delivery with the endpoint it's sent to.
+type WebhookTask struct {
+	Delivery entity.WebhookDelivery
+	URL      string
+	Secret   string
+}
+
+type WebhookStore interface {
+	CreateWebhook(ctx context.Context, webhook entity.Webhook) error
+	ListWebhooks(ctx context.Context) ([]entity.Webhook, error)
+	// DeleteWebhook deletes the webhook with its deliveries, it returns ErrObjectNotFound when there's no webhook.
+	DeleteWebhook(ctx context.Context, id uuid.UUID) error
+	// MatchingWebhooks returns the webhooks of the voting and the global ones subscribed to the event type.
+	MatchingWebhooks(ctx context.Context, votingID uuid.UUID, eventType entity.EventType) ([]entity.Webhook, error)
+	// DisableVotingWebhooks disables the webhooks of the deleted voting, its voting.deleted is already enqueued.
+	DisableVotingWebhooks(ctx context.Context, votingID uuid.UUID, at time.Time) error
+	// EnqueueDeliveries skips the event already enqueued for the webhook, so redelivered events are sent once.
+	EnqueueDeliveries(ctx context.Context, deliveries []entity.WebhookDelivery) error
+	// ClaimDeliveries returns up to limit pending deliveries due at now and postpones them until the lease ends,
+	// so they are not claimed twice while being sent.
+	ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]WebhookTask, error)
+	SaveDeliveryResult(ctx context.Context, delivery entity.WebhookDelivery) error
+	// ListDeliveries returns the latest deliveries of the webhook, newest first.
+	ListDeliveries(ctx context.Context, webhookID uuid.UUID, limit int) ([]entity.WebhookDelivery, error)
+	// Redeliver makes the delivery pending again with no attempts, it returns ErrObjectNotFound when there's no delivery.
+	Redeliver(ctx context.Context, id uuid.UUID, at time.Time) error
+	// DeleteFinishedDeliveries deletes the delivered and dead deliveries finished before the time,
+	// it returns the number of deleted deliveries.
+	DeleteFinishedDeliveries(ctx context.Context, before time.Time) (int64, error)
+}
+
+// WebhookDispatcher enqueues a delivery for every webhook subscribed to an event and sends
+// the due deliveries. A failed delivery is retried with exponential backoff, after
+// MaxAttempts failures it's moved to the dead letter until it's redelivered manually.
+type WebhookDispatcher struct {
+	log    *slog.Logger
+	store  WebhookStore
+	client *http.Client
+	cfg    Webhooks
+	now    func() time.Time
+}
+
+func NewWebhookDispatcher(log *slog.Logger, store WebhookStore, cfg Webhooks) *WebhookDispatcher {
+	cfg = cfg.WithDefaults()
+
+	return &WebhookDispatcher{
+		log:   log,
+		store: store,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+		},
+		cfg: cfg,
+		now: time.Now,
+	}
+}
+
+// SignWebhook returns the signature header of the body: "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">".
+// The time is signed too, so receivers can reject replayed requests.
+func SignWebhook(secret string, timestamp time.Time, body []byte) string {
+	unix := strconv.FormatInt(timestamp.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unix))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "t=" + unix + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Register creates the webhook, a secret is generated when it's empty.
+func (d *WebhookDispatcher) Register(ctx context.Context, webhook entity.Webhook) (entity.Webhook, error) {
+	endpoint, err := url.Parse(webhook.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return entity.Webhook{}, ErrWebhookInvalidURL
+	}
+
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			return entity.Webhook{}, fmt.Errorf("generate secret: %w", err)
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+
+	webhook.ID = uuid.New()
+	webhook.CreatedAt = d.now().UTC()
+	if err = d.store.CreateWebhook(ctx, webhook); err != nil {
+		return entity.Webhook{}, fmt.Errorf("create webhook: %w", err)
+	}
+
+	return webhook, nil
+}
+
+// List returns the webhooks without their secrets.
+func (d *WebhookDispatcher) List(ctx context.Context) ([]entity.Webhook, error) {
+	webhooks, err := d.store.ListWebhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	return webhooks, nil
+}
+
+func (d *WebhookDispatcher) Delete(ctx context.Context, id uuid.UUID) error {
+	return d.store.DeleteWebhook(ctx, id)
+}
+
+func (d *WebhookDispatcher) Deliveries(ctx context.Context, webhookID uuid.UUID, limit int) ([]entity.WebhookDelivery, error) {
+	return d.store.ListDeliveries(ctx, webhookID, limit)
+}
+
+func (d *WebhookDispatcher) Redeliver(ctx context.Context, deliveryID uuid.UUID) error {
+	return d.store.Redeliver(ctx, deliveryID, d.now())
+}
+
+// PublishEvent enqueues the event for the subscribed webhooks, errors are only logged.
+func (d *WebhookDispatcher) PublishEvent(event entity.Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.cfg.Timeout)
+	defer cancel()
+
+	if err := d.DeliverEvent(ctx, event); err != nil {
+		d.log.Error("enqueue webhook deliveries", slog.String("type", string(event.Type)), slog.Any("error", err))
+	}
+}
+
+// DeliverEvent enqueues the event for the subscribed webhooks, it's an OutboxSink.
+// After voting.deleted the webhooks of the voting are disabled, there are no more events of it.
+func (d *WebhookDispatcher) DeliverEvent(ctx context.Context, event entity.Event) error {
+	if !event.Type.Valid() {
+		return nil
+	}
+
+	if err := d.enqueueEvent(ctx, event); err != nil {
+		return err
+	}
+
+	if event.Type == entity.EventVotingDeleted {
+		if err := d.store.DisableVotingWebhooks(ctx, event.VotingID, d.now().UTC()); err != nil {
+			return fmt.Errorf("disable webhooks of deleted voting: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (d *WebhookDispatcher) enqueueEvent(ctx context.Context, event entity.Event) error {
+	webhooks, err := d.store.MatchingWebhooks(ctx, event.VotingID, event.Type)
+	if err != nil {
+		return fmt.Errorf("get matching webhooks: %w", err)
+	}
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	// The sequence is assigned by the hub of every instance, it means nothing to webhooks
+	event.Epoch, event.Sequence = "", 0
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	now := d.now().UTC()
+	deliveries := make([]entity.WebhookDelivery, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		deliveries = append(deliveries, entity.WebhookDelivery{
+			ID:            uuid.New(),
+			WebhookID:     webhook.ID,
+			EventID:       event.ID,
+			EventType:     event.Type,
+			Event:         data,
+			Status:        entity.WebhookDeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		})
+	}
+
+	return d.store.EnqueueDeliveries(ctx, deliveries)
+}
+
+// Run sends the due deliveries and cleans up the finished ones until ctx is done.
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+	cleanup := time.NewTicker(d.cfg.CleanupInterval)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.dispatch(ctx)
+		case <-cleanup.C:
+			d.cleanup(ctx)
+		}
+	}
+}
+
+func (d *WebhookDispatcher) cleanup(ctx context.Context) {
+	deleted, err := d.store.DeleteFinishedDeliveries(ctx, d.now().UTC().Add(-d.cfg.Retention))
+	if err != nil {
+		d.log.Error("clean up webhook deliveries", slog.Any("error", err))
+		return
+	}
+
+	if deleted > 0 {
+		d.log.Debug("Webhook deliveries cleaned up", slog.Int64("deleted", deleted))
+	}
+}
+
+func (d *WebhookDispatcher) dispatch(ctx context.Context) {
+	// The lease outlives the request, so a slow endpoint doesn't get the delivery twice
+	tasks, err := d.store.ClaimDeliveries(ctx, d.now().UTC(), 2*d.cfg.Timeout, d.cfg.BatchSize)
+	if err != nil {
+		d.log.Error("claim webhook deliveries", slog.Any("error", err))
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.deliver(ctx, task)
+		}()
+	}
+	wg.Wait()
+}
+
+func (d *WebhookDispatcher) deliver(ctx context.Context, task WebhookTask) {
+	delivery := task.Delivery
+	delivery.Attempts++
+
+	code, err := d.send(ctx, task)
+	delivery.ResponseCode = code
+
+	now := d.now().UTC()
+	switch {
+	case err == nil:
+		delivery.Status = entity.WebhookDeliveryDelivered
+		delivery.LastError = ""
+		delivery.DeliveredAt = &now
+	case delivery.Attempts >= d.cfg.MaxAttempts:
+		delivery.Status = entity.WebhookDeliveryDead
+		delivery.LastError = err.Error()
+		// The dead letter is kept for the retention from its last attempt
+		delivery.NextAttemptAt = now
+		d.log.Warn("Webhook delivery is dead",
+			slog.String("delivery_id", delivery.ID.String()),
+			slog.String("webhook_id", delivery.WebhookID.String()),
+			slog.Int("attempts", delivery.Attempts),
+			slog.Any("error", err),
+		)
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = now.Add(d.backoff(delivery.Attempts))
+	}
+
+	if err = d.store.SaveDeliveryResult(ctx, delivery); err != nil {
+		d.log.Error("save webhook delivery", slog.String("delivery_id", delivery.ID.String()), slog.Any("error", err))
+	}
+}
+
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	delay := d.cfg.BaseDelay
+	for i := 1; i < attempts && delay < d.cfg.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, d.cfg.MaxDelay)
+}
+
+// send posts the event, any status but 2xx is a failure.
+func (d *WebhookDispatcher) send(ctx context.Context, task WebhookTask) (int, error) {
+	body := []byte(task.Delivery.Event)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, task.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookHeaderID, task.Delivery.ID.String())
+	req.Header.Set(WebhookHeaderEvent, string(task.Delivery.EventType))
+	req.Header.Set(WebhookHeaderSignature, SignWebhook(task.Secret, d.now(), body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// webhookEvent is the event enqueued for the webhook, it's enqueued once.
+type webhookEvent struct {
+	webhookID uuid.UUID
+	eventID   uuid.UUID
+}
+
+// MemoryWebhookStore keeps webhooks of a single instance, deliveries are lost on restart.
+type MemoryWebhookStore struct {
+	mu       sync.Mutex
+	webhooks []entity.Webhook
+	// deliveries are in the order they were enqueued, enqueued keys them by the webhook and the event
+	deliveries []*entity.WebhookDelivery
+	enqueued   map[webhookEvent]*entity.WebhookDelivery
+}
+
+func NewMemoryWebhookStore() *MemoryWebhookStore {
+	return &MemoryWebhookStore{
+		enqueued: make(map[webhookEvent]*entity.WebhookDelivery),
+	}
+}
+
+func (s *MemoryWebhookStore) CreateWebhook(_ context.Context, webhook entity.Webhook) error {
+	s.mu.Lock()
+	s.webhooks = append(s.webhooks, webhook)
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *MemoryWebhookStore) ListWebhooks(_ context.Context) ([]entity.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.webhooks), nil
+}
+
+func (s *MemoryWebhookStore) DeleteWebhook(_ context.Context, id uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.webhooks, func(w entity.Webhook) bool { return w.ID == id })
+	if i < 0 {
+		return ErrObjectNotFound
+	}
+
+	s.webhooks = slices.Delete(s.webhooks, i, i+1)
+	s.deliveries = slices.DeleteFunc(s.deliveries, func(d *entity.WebhookDelivery) bool { return d.WebhookID == id })
+	for key := range s.enqueued {
+		if key.webhookID == id {
+			delete(s.enqueued, key)
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryWebhookStore) MatchingWebhooks(_ context.Context, votingID uuid.UUID, eventType entity.EventType) ([]entity.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event := entity.Event{VotingID: votingID, Type: eventType}
+
+	var webhooks []entity.Webhook
+	for _, webhook := range s.webhooks {
+		if webhook.Matches(event) {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+
+	return webhooks, nil
+}
+
+func (s *MemoryWebhookStore) DisableVotingWebhooks(_ context.Context, votingID uuid.UUID, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, webhook := range s.webhooks {
+		if webhook.VotingID != nil && *webhook.VotingID == votingID && webhook.DisabledAt == nil {
+			s.webhooks[i].DisabledAt = &at
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryWebhookStore) EnqueueDeliveries(_ context.Context, deliveries []entity.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, delivery := range deliveries {
+		key := webhookEvent{webhookID: delivery.WebhookID, eventID: delivery.EventID}
+		if _, ok := s.enqueued[key]; ok {
+			continue
+		}
+
+		s.deliveries = append(s.deliveries, &delivery)
+		s.enqueued[key] = &delivery
+	}
+
+	return nil
+}
+
+func (s *MemoryWebhookStore) ClaimDeliveries(_ context.Context, now time.Time, lease time.Duration, limit int) ([]WebhookTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tasks []WebhookTask
+	for _, delivery := range s.deliveries {
+		if len(tasks) == limit {
+			break
+		}
+		if delivery.Status != entity.WebhookDeliveryPending || delivery.NextAttemptAt.After(now) {
+			continue
+		}
+
+		i := slices.IndexFunc(s.webhooks, func(w entity.Webhook) bool { return w.ID == delivery.WebhookID })
+		if i < 0 {
+			continue
+		}
+
+		delivery.NextAttemptAt = now.Add(lease)
+		tasks = append(tasks, WebhookTask{
+			Delivery: *delivery,
+			URL:      s.webhooks[i].URL,
+			Secret:   s.webhooks[i].Secret,
+		})
+	}
+
+	return tasks, nil
+}
+
+func (s *MemoryWebhookStore) SaveDeliveryResult(_ context.Context, delivery entity.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.deliveries {
+		if d.ID == delivery.ID {
+			*d = delivery
+			return nil
+		}
+	}
+
+	return ErrObjectNotFound
+}
+
+func (s *MemoryWebhookStore) ListDeliveries(_ context.Context, webhookID uuid.UUID, limit int) ([]entity.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deliveries []entity.WebhookDelivery
+	for i := len(s.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if s.deliveries[i].WebhookID == webhookID {
+			deliveries = append(deliveries, *s.deliveries[i])
+		}
+	}
+
+	return deliveries, nil
+}
+
+func (s *MemoryWebhookStore) Redeliver(_ context.Context, id uuid.UUID, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.deliveries {
+		if d.ID == id {
+			d.Status = entity.WebhookDeliveryPending
+			d.Attempts = 0
+			d.LastError = ""
+			d.NextAttemptAt = at
+			d.DeliveredAt = nil
+			return nil
+		}
+	}
+
+	return ErrObjectNotFound
+}
+
+func (s *MemoryWebhookStore) DeleteFinishedDeliveries(_ context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	kept := s.deliveries[:0]
+	for _, d := range s.deliveries {
+		if finishedBefore(d, before) {
+			delete(s.enqueued, webhookEvent{webhookID: d.WebhookID, eventID: d.EventID})
+			deleted++
+			continue
+		}
+		kept = append(kept, d)
+	}
+	clear(s.deliveries[len(kept):])
+	s.deliveries = kept
+
+	return deleted, nil
+}
+
+// finishedBefore tells whether the delivery was delivered or went to the dead letter before the time.
+func finishedBefore(d *entity.WebhookDelivery, before time.Time) bool {
+	switch d.Status {
+	case entity.WebhookDeliveryDelivered:
+		return d.DeliveredAt != nil && d.DeliveredAt.Before(before)
+	case entity.WebhookDeliveryDead:
+		return d.NextAttemptAt.Before(before)
+	default:
+		return false
+	}
+}
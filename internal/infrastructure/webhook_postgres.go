@@ -0,0 +1,292 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+)
+
+const (
+	tbWebhooks          = "webhooks"
+	tbWebhookDeliveries = "webhook_deliveries"
+)
+
+var webhookColumns = []string{"id", "url", "secret", "voting_id", "event_types", "created_at", "disabled_at"}
+
+var webhookDeliveryColumns = []string{
+	"id", "webhook_id", "event_id", "event_type", "event", "status", "attempts",
+	"next_attempt_at", "last_error", "response_code", "created_at", "delivered_at",
+}
+
+type webhookRow struct {
+	ID         uuid.UUID  `db:"id"`
+	URL        string     `db:"url"`
+	Secret     string     `db:"secret"`
+	VotingID   *uuid.UUID `db:"voting_id"`
+	EventTypes []string   `db:"event_types"`
+	CreatedAt  time.Time  `db:"created_at"`
+	DisabledAt *time.Time `db:"disabled_at"`
+}
+
+func (r webhookRow) toEntity() entity.Webhook {
+	webhook := entity.Webhook{
+		ID:         r.ID,
+		URL:        r.URL,
+		Secret:     r.Secret,
+		VotingID:   r.VotingID,
+		CreatedAt:  r.CreatedAt,
+		DisabledAt: r.DisabledAt,
+	}
+	for _, eventType := range r.EventTypes {
+		webhook.EventTypes = append(webhook.EventTypes, entity.EventType(eventType))
+	}
+
+	return webhook
+}
+
+type webhookTaskRow struct {
+	entity.WebhookDelivery
+	URL    string `db:"url"`
+	Secret string `db:"secret"`
+}
+
+// PostgresWebhookStore shares webhooks and deliveries between instances.
+type PostgresWebhookStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresWebhookStore(db *pgxpool.Pool) *PostgresWebhookStore {
+	return &PostgresWebhookStore{
+		db: db,
+	}
+}
+
+func (s *PostgresWebhookStore) CreateWebhook(ctx context.Context, webhook entity.Webhook) error {
+	eventTypes := make([]string, 0, len(webhook.EventTypes))
+	for _, eventType := range webhook.EventTypes {
+		eventTypes = append(eventTypes, string(eventType))
+	}
+
+	stmt, args, err := sq.Insert(tbWebhooks).
+		Columns("id", "url", "secret", "voting_id", "event_types", "created_at").
+		Values(webhook.ID, webhook.URL, webhook.Secret, webhook.VotingID, eventTypes, webhook.CreatedAt).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("build statement: %w", err)
+	}
+
+	return Execute(ctx, s.db, stmt, args...)
+}
+
+func (s *PostgresWebhookStore) ListWebhooks(ctx context.Context) ([]entity.Webhook, error) {
+	return s.selectWebhooks(ctx, sq.Select(webhookColumns...).
+		From(tbWebhooks).
+		OrderBy("created_at"))
+}
+
+func (s *PostgresWebhookStore) MatchingWebhooks(ctx context.Context, votingID uuid.UUID, eventType entity.EventType) ([]entity.Webhook, error) {
+	return s.selectWebhooks(ctx, sq.Select(webhookColumns...).
+		From(tbWebhooks).
+		Where(sq.Eq{"disabled_at": nil}).
+		Where(sq.Or{sq.Eq{"voting_id": nil}, sq.Eq{"voting_id": votingID}}).
+		Where(sq.Or{sq.Expr("cardinality(event_types) = 0"), sq.Expr("? = ANY(event_types)", string(eventType))}))
+}
+
+func (s *PostgresWebhookStore) DisableVotingWebhooks(ctx context.Context, votingID uuid.UUID, at time.Time) error {
+	stmt, args, err := sq.Update(tbWebhooks).
+		Set("disabled_at", at).
+		Where(sq.Eq{"voting_id": votingID, "disabled_at": nil}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("build statement: %w", err)
+	}
+
+	_, err = s.db.Exec(ctx, stmt, args...)
+
+	return err
+}
+
+func (s *PostgresWebhookStore) selectWebhooks(ctx context.Context, builder sq.SelectBuilder) ([]entity.Webhook, error) {
+	stmt, args, err := builder.PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("build statement: %w", err)
+	}
+
+	rows, err := FetchRows[webhookRow](ctx, s.db, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := make([]entity.Webhook, 0, len(rows))
+	for _, row := range rows {
+		webhooks = append(webhooks, row.toEntity())
+	}
+
+	return webhooks, nil
+}
+
+func (s *PostgresWebhookStore) DeleteWebhook(ctx context.Context, id uuid.UUID) error {
+	stmt, args, err := sq.Delete(tbWebhooks).
+		Where(sq.Eq{"id": id}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("build statement: %w", err)
+	}
+
+	return s.execAffected(ctx, stmt, args...)
+}
+
+// execAffected executes the statement, it returns ErrObjectNotFound when no rows are affected.
+func (s *PostgresWebhookStore) execAffected(ctx context.Context, stmt string, args ...any) error {
+	tag, err := s.db.Exec(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrObjectNotFound
+	}
+
+	return nil
+}
+
+func (s *PostgresWebhookStore) EnqueueDeliveries(ctx context.Context, deliveries []entity.WebhookDelivery) error {
+	builder := sq.Insert(tbWebhookDeliveries).
+		Columns("id", "webhook_id", "event_id", "event_type", "event", "status", "next_attempt_at", "created_at")
+	for _, d := range deliveries {
+		builder = builder.Values(d.ID, d.WebhookID, d.EventID, string(d.EventType), string(d.Event), string(d.Status), d.NextAttemptAt, d.CreatedAt)
+	}
+
+	stmt, args, err := builder.
+		Suffix("ON CONFLICT (webhook_id, event_id) DO NOTHING").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("build statement: %w", err)
+	}
+
+	return Execute(ctx, s.db, stmt, args...)
+}
+
+func (s *PostgresWebhookStore) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]WebhookTask, error) {
+	// squirrel can't put FROM before WHERE in UPDATE
+	stmt := `UPDATE webhook_deliveries d SET next_attempt_at = $1
+		FROM webhooks w
+		WHERE d.webhook_id = w.id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $2 AND next_attempt_at <= $3
+			ORDER BY next_attempt_at
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.*, w.url, w.secret`
+
+	rows, err := FetchRows[webhookTaskRow](ctx, s.db, stmt, now.Add(lease), string(entity.WebhookDeliveryPending), now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := make([]WebhookTask, 0, len(rows))
+	for _, row := range rows {
+		tasks = append(tasks, WebhookTask{
+			Delivery: row.WebhookDelivery,
+			URL:      row.URL,
+			Secret:   row.Secret,
+		})
+	}
+
+	return tasks, nil
+}
+
+func (s *PostgresWebhookStore) SaveDeliveryResult(ctx context.Context, delivery entity.WebhookDelivery) error {
+	stmt, args, err := sq.Update(tbWebhookDeliveries).
+		SetMap(map[string]any{
+			"status":          string(delivery.Status),
+			"attempts":        delivery.Attempts,
+			"next_attempt_at": delivery.NextAttemptAt,
+			"last_error":      delivery.LastError,
+			"response_code":   delivery.ResponseCode,
+			"delivered_at":    delivery.DeliveredAt,
+		}).
+		Where(sq.Eq{"id": delivery.ID}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("build statement: %w", err)
+	}
+
+	return s.execAffected(ctx, stmt, args...)
+}
+
+func (s *PostgresWebhookStore) ListDeliveries(ctx context.Context, webhookID uuid.UUID, limit int) ([]entity.WebhookDelivery, error) {
+	stmt, args, err := sq.Select(webhookDeliveryColumns...).
+		From(tbWebhookDeliveries).
+		Where(sq.Eq{"webhook_id": webhookID}).
+		OrderBy("created_at DESC").
+		Limit(uint64(limit)).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("build statement: %w", err)
+	}
+
+	rows, err := FetchRows[entity.WebhookDelivery](ctx, s.db, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]entity.WebhookDelivery, 0, len(rows))
+	for _, row := range rows {
+		deliveries = append(deliveries, *row)
+	}
+
+	return deliveries, nil
+}
+
+func (s *PostgresWebhookStore) Redeliver(ctx context.Context, id uuid.UUID, at time.Time) error {
+	stmt, args, err := sq.Update(tbWebhookDeliveries).
+		SetMap(map[string]any{
+			"status":          string(entity.WebhookDeliveryPending),
+			"attempts":        0,
+			"next_attempt_at": at,
+			"last_error":      "",
+			"delivered_at":    nil,
+		}).
+		Where(sq.Eq{"id": id}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("build statement: %w", err)
+	}
+
+	return s.execAffected(ctx, stmt, args...)
+}
+
+// DeleteFinishedDeliveries deletes by the status, the dead letter keeps the time of its last attempt in next_attempt_at.
+func (s *PostgresWebhookStore) DeleteFinishedDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	stmt, args, err := sq.Delete(tbWebhookDeliveries).
+		Where(sq.Or{
+			sq.And{sq.Eq{"status": string(entity.WebhookDeliveryDelivered)}, sq.Lt{"delivered_at": before}},
+			sq.And{sq.Eq{"status": string(entity.WebhookDeliveryDead)}, sq.Lt{"next_attempt_at": before}},
+		}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("build statement: %w", err)
+	}
+
+	tag, err := s.db.Exec(ctx, stmt, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,234 @@
+package infrastructure
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+)
+
+// webhookReceiver is a local endpoint answering with status.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookReceiver(t *testing.T, status int) (*webhookReceiver, string) {
+	t.Helper()
+	receiver := &webhookReceiver{status: status}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		receiver.mu.Lock()
+		receiver.requests = append(receiver.requests, r)
+		receiver.bodies = append(receiver.bodies, body)
+		status := receiver.status
+		receiver.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	return receiver, server.URL
+}
+
+func (r *webhookReceiver) setStatus(status int) {
+	r.mu.Lock()
+	r.status = status
+	r.mu.Unlock()
+}
+
+func (r *webhookReceiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+func TestWebhookDeliverySigned(t *testing.T) {
+	receiver, url := newWebhookReceiver(t, http.StatusNoContent)
+	dispatcher := NewWebhookDispatcher(NewDefaultLogger(), NewMemoryWebhookStore(), Webhooks{})
+	ctx := context.Background()
+
+	votingID := uuid.New()
+	webhook, err := dispatcher.Register(ctx, entity.Webhook{
+		URL:        url,
+		VotingID:   &votingID,
+		EventTypes: []entity.EventType{entity.EventVotingClosed},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	closed, _ := entity.NewEvent(entity.EventVotingClosed, votingID, nil, nil)
+	otherType, _ := entity.NewEvent(entity.EventVoteCast, votingID, nil, nil)
+	otherVoting, _ := entity.NewEvent(entity.EventVotingClosed, uuid.New(), nil, nil)
+	for _, event := range []entity.Event{closed, otherType, otherVoting, closed} {
+		if err = dispatcher.DeliverEvent(ctx, event); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	dispatcher.dispatch(ctx)
+
+	if receiver.count() != 1 {
+		t.Fatalf("Expected 1 delivery, got %d", receiver.count())
+	}
+
+	req, body := receiver.requests[0], receiver.bodies[0]
+	if req.Header.Get(WebhookHeaderEvent) != string(entity.EventVotingClosed) {
+		t.Errorf("Expected event header %s, got %s", entity.EventVotingClosed, req.Header.Get(WebhookHeaderEvent))
+	}
+	if !strings.Contains(string(body), closed.ID.String()) {
+		t.Errorf("Expected body of event %s, got %s", closed.ID, body)
+	}
+
+	signature := req.Header.Get(WebhookHeaderSignature)
+	timestamp, _, _ := strings.Cut(strings.TrimPrefix(signature, "t="), ",")
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		t.Fatalf("Unexpected signature %s: %v", signature, err)
+	}
+	at := time.Unix(unix, 0)
+	if expected := SignWebhook(webhook.Secret, at, body); signature != expected {
+		t.Errorf("Expected signature %s, got %s", expected, signature)
+	}
+
+	deliveries, _ := dispatcher.Deliveries(ctx, webhook.ID, 10)
+	if len(deliveries) != 1 || deliveries[0].Status != entity.WebhookDeliveryDelivered || deliveries[0].ResponseCode != http.StatusNoContent {
+		t.Errorf("Expected a delivered delivery, got %+v", deliveries)
+	}
+}
+
+func TestWebhookRetryDeadLetterRedeliver(t *testing.T) {
+	receiver, url := newWebhookReceiver(t, http.StatusInternalServerError)
+	dispatcher := NewWebhookDispatcher(NewDefaultLogger(), NewMemoryWebhookStore(), Webhooks{
+		MaxAttempts: 3,
+		BaseDelay:   time.Minute,
+	})
+	now := time.Now()
+	dispatcher.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	webhook, _ := dispatcher.Register(ctx, entity.Webhook{URL: url})
+	event, _ := entity.NewEvent(entity.EventVoteCast, uuid.New(), nil, nil)
+	_ = dispatcher.DeliverEvent(ctx, event)
+
+	// The retry is not due before the backoff passes: 1m, then 2m
+	for _, wait := range []time.Duration{0, 30 * time.Second, 31 * time.Second, 2 * time.Minute} {
+		now = now.Add(wait)
+		dispatcher.dispatch(ctx)
+	}
+	if receiver.count() != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", receiver.count())
+	}
+
+	deliveries, _ := dispatcher.Deliveries(ctx, webhook.ID, 10)
+	if deliveries[0].Status != entity.WebhookDeliveryDead || deliveries[0].Attempts != 3 {
+		t.Fatalf("Expected a dead delivery after 3 attempts, got %+v", deliveries[0])
+	}
+
+	// The dead letter is not retried
+	now = now.Add(time.Hour)
+	dispatcher.dispatch(ctx)
+	if receiver.count() != 3 {
+		t.Errorf("Expected no more attempts, got %d", receiver.count())
+	}
+
+	receiver.setStatus(http.StatusOK)
+	if err := dispatcher.Redeliver(ctx, deliveries[0].ID); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dispatcher.dispatch(ctx)
+
+	deliveries, _ = dispatcher.Deliveries(ctx, webhook.ID, 10)
+	if deliveries[0].Status != entity.WebhookDeliveryDelivered {
+		t.Errorf("Expected the redelivered delivery to be delivered, got %s", deliveries[0].Status)
+	}
+	if err := dispatcher.Redeliver(ctx, uuid.New()); err != ErrObjectNotFound {
+		t.Errorf("Expected ErrObjectNotFound, got %v", err)
+	}
+}
+
+func TestWebhookOfDeletedVotingGetsDeletedEvent(t *testing.T) {
+	receiver, url := newWebhookReceiver(t, http.StatusOK)
+	dispatcher := NewWebhookDispatcher(NewDefaultLogger(), NewMemoryWebhookStore(), Webhooks{})
+	ctx := context.Background()
+
+	votingID := uuid.New()
+	webhook, _ := dispatcher.Register(ctx, entity.Webhook{URL: url, VotingID: &votingID})
+
+	deleted, _ := entity.NewEvent(entity.EventVotingDeleted, votingID, nil, nil)
+	late, _ := entity.NewEvent(entity.EventVotingClosed, votingID, nil, nil)
+	for _, event := range []entity.Event{deleted, late} {
+		if err := dispatcher.DeliverEvent(ctx, event); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	dispatcher.dispatch(ctx)
+
+	if receiver.count() != 1 || receiver.requests[0].Header.Get(WebhookHeaderEvent) != string(entity.EventVotingDeleted) {
+		t.Fatalf("Expected voting.deleted only, got %d deliveries", receiver.count())
+	}
+
+	webhooks, _ := dispatcher.List(ctx)
+	if len(webhooks) != 1 || webhooks[0].ID != webhook.ID || webhooks[0].DisabledAt == nil {
+		t.Errorf("Expected the webhook to be disabled, got %+v", webhooks)
+	}
+}
+
+func TestWebhookCleanupDeletesFinishedDeliveries(t *testing.T) {
+	receiver, url := newWebhookReceiver(t, http.StatusOK)
+	dispatcher := NewWebhookDispatcher(NewDefaultLogger(), NewMemoryWebhookStore(), Webhooks{
+		MaxAttempts: 1,
+		Retention:   time.Hour,
+	})
+	now := time.Now()
+	dispatcher.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	webhook, _ := dispatcher.Register(ctx, entity.Webhook{URL: url})
+	delivered, _ := entity.NewEvent(entity.EventVoteCast, uuid.New(), nil, nil)
+	_ = dispatcher.DeliverEvent(ctx, delivered)
+	dispatcher.dispatch(ctx)
+
+	receiver.setStatus(http.StatusInternalServerError)
+	dead, _ := entity.NewEvent(entity.EventVoteCast, uuid.New(), nil, nil)
+	_ = dispatcher.DeliverEvent(ctx, dead)
+	dispatcher.dispatch(ctx)
+
+	pending, _ := entity.NewEvent(entity.EventVoteCast, uuid.New(), nil, nil)
+	_ = dispatcher.DeliverEvent(ctx, pending)
+
+	now = now.Add(2 * time.Hour)
+	dispatcher.cleanup(ctx)
+
+	deliveries, _ := dispatcher.Deliveries(ctx, webhook.ID, 10)
+	if len(deliveries) != 1 || deliveries[0].EventID != pending.ID {
+		t.Fatalf("Expected the pending delivery only, got %+v", deliveries)
+	}
+
+	// The event of a deleted delivery is enqueued again like in Postgres, the pending one is not
+	_ = dispatcher.DeliverEvent(ctx, delivered)
+	_ = dispatcher.DeliverEvent(ctx, pending)
+	if deliveries, _ = dispatcher.Deliveries(ctx, webhook.ID, 10); len(deliveries) != 2 {
+		t.Errorf("Expected the event enqueued again once, got %d deliveries", len(deliveries))
+	}
+}
+
+func TestWebhookRegisterRejectsInvalidURL(t *testing.T) {
+	dispatcher := NewWebhookDispatcher(NewDefaultLogger(), NewMemoryWebhookStore(), Webhooks{})
+	for _, url := range []string{"", "ftp://example.com", "/hook", "http://"} {
+		if _, err := dispatcher.Register(context.Background(), entity.Webhook{URL: url}); err != ErrWebhookInvalidURL {
+			t.Errorf("Expected ErrWebhookInvalidURL for %q, got %v", url, err)
+		}
+	}
+}
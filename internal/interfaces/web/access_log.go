@@ -0,0 +1,52 @@
+package web
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// redactedQueryParams are the credentials passed in the query, they're kept out of the access log.
+var redactedQueryParams = []string{"ticket"}
+
+// AccessLogFormatter is the access log line of gin without the credentials of the query.
+func AccessLogFormatter(param gin.LogFormatterParams) string {
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		redactPath(param.Path),
+		param.ErrorMessage,
+	)
+}
+
+// redactPath replaces the values of the redacted params of the query.
+func redactPath(path string) string {
+	base, rawQuery, found := strings.Cut(path, "?")
+	if !found {
+		return path
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// A query which can't be parsed isn't logged at all
+		return base + "?REDACTED"
+	}
+
+	var redacted bool
+	for _, param := range redactedQueryParams {
+		if query.Has(param) {
+			query.Set(param, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return path
+	}
+
+	return base + "?" + query.Encode()
+}
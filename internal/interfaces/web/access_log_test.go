@@ -0,0 +1,30 @@
+package web
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAccessLogRedactsTicket(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{path: "/voting/subscribe?ticket=secret.sig&voting_id=1", expected: "/voting/subscribe?ticket=REDACTED&voting_id=1"},
+		{path: "/voting/events?tag=a", expected: "/voting/events?tag=a"},
+		{path: "/voting", expected: "/voting"},
+		{path: "/voting/events?ticket=%zz", expected: "/voting/events?REDACTED"},
+	}
+	for _, tt := range tests {
+		if got := redactPath(tt.path); got != tt.expected {
+			t.Errorf("Expected %s, got %s", tt.expected, got)
+		}
+	}
+
+	line := AccessLogFormatter(gin.LogFormatterParams{Path: "/voting/subscribe?ticket=secret.sig"})
+	if strings.Contains(line, "secret") {
+		t.Errorf("Expected the ticket to be redacted, got %s", line)
+	}
+}
@@ -0,0 +1,44 @@
+package web
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type UnlockLoginRequest struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+}
+
+func (v *VotingHandler) UnlockLogin(c *gin.Context) {
+	var request UnlockLoginRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if request.Username == "" && request.IP == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username or ip is required"})
+		return
+	}
+
+	if err := v.loginGuard.Unlock(c.Request.Context(), request.Username, request.IP); err != nil {
+		v.log.Error("unlock login", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "login unlocked"})
+}
+
+type SubscribersResponse struct {
+	Subscribers int `json:"subscribers"`
+}
+
+func (v *VotingHandler) Subscribers(c *gin.Context) {
+	c.JSON(http.StatusOK, SubscribersResponse{
+		Subscribers: v.subscription.ClientsCount(),
+	})
+}
@@ -0,0 +1,102 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+type contextKey string
+
+const (
+	userIDKey   contextKey = "userID"
+	usernameKey contextKey = "username"
+)
+
+func (v *VotingHandler) authMiddleware(c *gin.Context) {
+	identity, ok := v.authenticate(c)
+	if !ok {
+		c.Abort()
+		return
+	}
+
+	c.Request = c.Request.WithContext(withIdentity(c.Request.Context(), identity))
+
+	c.Next()
+}
+
+// withIdentity stores the userID and username in the context, the reads of the request are made by the user.
+func withIdentity(ctx context.Context, identity entity.Identity) context.Context {
+	ctx = infrastructure.WithReadUser(ctx, identity.UserID)
+	ctx = context.WithValue(ctx, userIDKey, identity.UserID)
+	return context.WithValue(ctx, usernameKey, identity.Username)
+}
+
+// authenticate checks the Basic credentials of the request, the error response is written when it fails.
+func (v *VotingHandler) authenticate(c *gin.Context) (entity.Identity, bool) {
+	login, password, err := infrastructure.ExtractBasicAuthValid(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return entity.Identity{}, false
+	}
+
+	ctx := c.Request.Context()
+	ip := c.ClientIP()
+
+	// Throttle brute-force before the credentials are checked
+	check, err := v.loginGuard.Allow(ctx, login, ip)
+	if err != nil {
+		v.log.Error("check login guard", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return entity.Identity{}, false
+	}
+	if check.Wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(check.Wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": infrastructure.ErrAuthTooManyAttempts.Error()})
+		return entity.Identity{}, false
+	}
+
+	// Check login and password with auth service
+	if err := v.authService.CheckLoginPassword(ctx, login, password); err != nil {
+		if err := v.loginGuard.Failure(ctx, login, ip); err != nil {
+			v.log.Error("register login failure", slog.Any("error", err))
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return entity.Identity{}, false
+	}
+
+	if err := v.loginGuard.Success(ctx, check, login, ip); err != nil {
+		v.log.Error("register login success", slog.Any("error", err))
+	}
+
+	// Request userID from auth service
+	userID, err := v.authService.UserIDByLoginPassword(ctx, login, password)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return entity.Identity{}, false
+	}
+
+	return entity.Identity{
+		UserID:   userID,
+		Username: login,
+	}, true
+}
+
+// adminMiddleware must be used after authMiddleware.
+func (v *VotingHandler) adminMiddleware(c *gin.Context) {
+	ctx := c.Request.Context()
+	username, _ := ctx.Value(usernameKey).(string)
+	if !v.authService.IsAdmin(ctx, username) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
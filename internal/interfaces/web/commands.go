@@ -0,0 +1,127 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+const (
+	commandActionVote      = "vote"
+	commandActionList      = "list"
+	commandActionGetVoting = "get_voting"
+)
+
+// Codes of the command errors, clients branch on them instead of the messages.
+const (
+	CommandErrorInvalidCommand  = "invalid_command"
+	CommandErrorUnknownAction   = "unknown_action"
+	CommandErrorInvalidArgument = "invalid_argument"
+	CommandErrorNotFound        = "not_found"
+	CommandErrorAlreadyVoted    = "already_voted"
+	CommandErrorVotingFinished  = "voting_finished"
+	CommandErrorRateLimited     = "rate_limited"
+	CommandErrorInternal        = "internal"
+)
+
+// commandListLimit bounds the list command like the HTTP list.
+const commandListLimit = 100
+
+// handleVotingCommand runs the vote, list and get_voting commands with the same
+// VotingService calls and rate limits as their HTTP routes.
+func (v *VotingHandler) handleVotingCommand(ctx context.Context, rateLimitKeys []string, command SubscriptionCommand) SubscriptionReply {
+	switch command.Action {
+	case commandActionVote:
+		if command.InvarianceID == uuid.Nil {
+			return commandError(CommandErrorInvalidArgument, "invariance_id is required")
+		}
+
+		userID, _ := ctx.Value(userIDKey).(uuid.UUID)
+		invarianceVoting := func(ctx context.Context) (uuid.UUID, error) {
+			return v.invarianceVoting(ctx, command.InvarianceID)
+		}
+		if reply, limited := v.commandRateLimited(ctx, infrastructure.RateLimitScopeChoice, rateLimitKeys, invarianceVoting); limited {
+			return reply
+		}
+
+		if err := v.votingService.MakeChoice(ctx, &MakeChoiceRequest{
+			InvarianceID: command.InvarianceID,
+			UserID:       userID,
+		}); err != nil {
+			return v.commandServiceError(err)
+		}
+
+		return SubscriptionReply{Type: replyTypeResult}
+	case commandActionList:
+		limit := command.Limit
+		if limit <= 0 {
+			limit = 10
+		}
+		if command.Offset < 0 {
+			return commandError(CommandErrorInvalidArgument, "invalid offset")
+		}
+
+		result, err := v.votingService.List(ctx, &ListVotingRequest{
+			Limit:  min(limit, commandListLimit),
+			Offset: command.Offset,
+		})
+		if err != nil {
+			return v.commandServiceError(err)
+		}
+
+		return SubscriptionReply{Type: replyTypeResult, Result: result}
+	case commandActionGetVoting:
+		if command.VotingID == uuid.Nil {
+			return commandError(CommandErrorInvalidArgument, "voting_id is required")
+		}
+
+		item, err := v.votingService.GetVoting(ctx, &GetVotingRequest{
+			ID: command.VotingID,
+		})
+		if err != nil {
+			return v.commandServiceError(err)
+		}
+
+		return SubscriptionReply{Type: replyTypeResult, Result: item}
+	default:
+		return commandError(CommandErrorUnknownAction, "unknown action")
+	}
+}
+
+func (v *VotingHandler) commandRateLimited(ctx context.Context, scope string, keys []string, resolve votingResolver) (SubscriptionReply, bool) {
+	wait, err := v.allowRate(ctx, scope, keys, resolve)
+	if err != nil {
+		v.log.Error("check rate limit", slog.Any("error", err))
+		return commandError(CommandErrorInternal, "internal error"), true
+	}
+
+	if wait > 0 {
+		reply := commandError(CommandErrorRateLimited, "rate limit exceeded")
+		reply.RetryAfter = retryAfterSeconds(wait)
+		return reply, true
+	}
+
+	return SubscriptionReply{}, false
+}
+
+// commandServiceError maps the domain errors to the typed errors.
+func (v *VotingHandler) commandServiceError(err error) SubscriptionReply {
+	switch {
+	case errors.Is(err, infrastructure.ErrObjectNotFound), errors.Is(err, infrastructure.ErrInvarianceNotFound):
+		return commandError(CommandErrorNotFound, err.Error())
+	case errors.Is(err, infrastructure.ErrAlreadyVoted):
+		return commandError(CommandErrorAlreadyVoted, err.Error())
+	case errors.Is(err, infrastructure.ErrVotingFinished):
+		return commandError(CommandErrorVotingFinished, err.Error())
+	default:
+		v.log.Error("run subscription command", slog.Any("error", err))
+		return commandError(CommandErrorInternal, "internal error")
+	}
+}
+
+func commandError(code, message string) SubscriptionReply {
+	return SubscriptionReply{Type: replyTypeError, Code: code, Error: message}
+}
@@ -0,0 +1,109 @@
+package web
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+// commandVotingService lets every user vote once.
+type commandVotingService struct {
+	VotingService
+
+	mu    sync.Mutex
+	votes map[uuid.UUID]uuid.UUID
+}
+
+func (s *commandVotingService) MakeChoice(_ context.Context, r *MakeChoiceRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.votes[r.UserID]; ok {
+		return infrastructure.ErrAlreadyVoted
+	}
+	s.votes[r.UserID] = r.InvarianceID
+	return nil
+}
+
+func (s *commandVotingService) GetVoting(_ context.Context, r *GetVotingRequest) (*VotingItem, error) {
+	return nil, infrastructure.ErrObjectNotFound
+}
+
+func (s *commandVotingService) InvarianceVoting(_ context.Context, invarianceID uuid.UUID) (uuid.UUID, error) {
+	return invarianceID, nil
+}
+
+type allowAllRateLimiter struct{}
+
+func (allowAllRateLimiter) Enabled() bool {
+	return true
+}
+
+func (allowAllRateLimiter) AllowKeys(context.Context, ...infrastructure.RateLimitKey) (time.Duration, error) {
+	return 0, nil
+}
+
+func sendCommand(t *testing.T, conn *websocket.Conn, command SubscriptionCommand) SubscriptionReply {
+	t.Helper()
+	if err := conn.WriteJSON(command); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var reply SubscriptionReply
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return reply
+}
+
+func TestVotingCommands(t *testing.T) {
+	service := &commandVotingService{votes: make(map[uuid.UUID]uuid.UUID)}
+	_, _, url := newSubscribeServerWith(t, infrastructure.WebSocket{}, service, allowAllRateLimiter{})
+
+	// Subscribed to a tag nobody publishes to, so only replies are read
+	conn, _, err := websocket.DefaultDialer.Dial(url+"&tag=nobody", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	invarianceID := uuid.New()
+	reply := sendCommand(t, conn, SubscriptionCommand{Action: commandActionVote, ID: "1", InvarianceID: invarianceID})
+	if reply.Type != replyTypeResult || reply.ID != "1" || reply.Action != commandActionVote {
+		t.Errorf("Expected the result of command 1, got %+v", reply)
+	}
+
+	service.mu.Lock()
+	votes := len(service.votes)
+	for userID, id := range service.votes {
+		if userID == uuid.Nil || id != invarianceID {
+			t.Errorf("Expected the vote of the subscriber for %s, got %s by %s", invarianceID, id, userID)
+		}
+	}
+	service.mu.Unlock()
+	if votes != 1 {
+		t.Fatalf("Expected 1 vote, got %d", votes)
+	}
+
+	tests := []struct {
+		command SubscriptionCommand
+		code    string
+	}{
+		{SubscriptionCommand{Action: commandActionVote, ID: "2", InvarianceID: invarianceID}, CommandErrorAlreadyVoted},
+		{SubscriptionCommand{Action: commandActionVote, ID: "3"}, CommandErrorInvalidArgument},
+		{SubscriptionCommand{Action: commandActionGetVoting, ID: "4", VotingID: uuid.New()}, CommandErrorNotFound},
+		{SubscriptionCommand{Action: "drop_tables", ID: "5"}, CommandErrorUnknownAction},
+	}
+	for _, tt := range tests {
+		reply = sendCommand(t, conn, tt.command)
+		if reply.Type != replyTypeError || reply.Code != tt.code || reply.ID != tt.command.ID {
+			t.Errorf("Expected %s error of command %s, got %+v", tt.code, tt.command.ID, reply)
+		}
+	}
+}
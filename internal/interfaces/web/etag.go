@@ -0,0 +1,55 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writeJSONWithETag writes the body with a strong ETag of its bytes, the request with a matching
+// If-None-Match gets 304 without the body.
+func (v *VotingHandler) writeJSONWithETag(c *gin.Context, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", v.cacheControl())
+
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
+
+func (v *VotingHandler) cacheControl() string {
+	if v.cacheConfig.MaxAge <= 0 {
+		return "private, no-cache"
+	}
+
+	return fmt.Sprintf("private, max-age=%d", int(v.cacheConfig.MaxAge.Seconds()))
+}
+
+// etagMatches checks the If-None-Match header, a list of tags or "*". Weak tags match by their value.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
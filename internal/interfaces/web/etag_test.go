@@ -0,0 +1,91 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+type etagVotingService struct {
+	VotingService
+
+	name string
+}
+
+func (s *etagVotingService) GetVoting(_ context.Context, r *GetVotingRequest) (*VotingItem, error) {
+	return &VotingItem{ID: r.ID, Name: s.name}, nil
+}
+
+func getVoting(router *gin.Engine, id uuid.UUID, ifNoneMatch string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/voting/"+id.String(), nil)
+	if ifNoneMatch != "" {
+		r.Header.Set("If-None-Match", ifNoneMatch)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestGetVotingConditional(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	logger := infrastructure.NewDefaultLogger()
+	wsConfig := infrastructure.WebSocket{}
+	service := &etagVotingService{name: "first"}
+	handler := NewVotingHandler(logger, service, nil, infrastructure.NewSubscription(logger, wsConfig), nil, nil, nil, nil,
+		wsConfig, infrastructure.Cache{MaxAge: 30 * time.Second})
+	// Without the auth middleware
+	router := gin.New()
+	router.GET("/voting/:id", handler.GetVoting)
+
+	id := uuid.New()
+	first := getVoting(router, id, "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Expected 200 with ETag, got %d and %q", first.Code, etag)
+	}
+	if cacheControl := first.Header().Get("Cache-Control"); cacheControl != "private, max-age=30" {
+		t.Errorf("Expected Cache-Control private, max-age=30, got %q", cacheControl)
+	}
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		code        int
+	}{
+		{name: "same tag", ifNoneMatch: etag, code: http.StatusNotModified},
+		{name: "list of tags", ifNoneMatch: `"other", ` + etag, code: http.StatusNotModified},
+		{name: "weak tag", ifNoneMatch: "W/" + etag, code: http.StatusNotModified},
+		{name: "any", ifNoneMatch: "*", code: http.StatusNotModified},
+		{name: "other tag", ifNoneMatch: `"other"`, code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := getVoting(router, id, tt.ifNoneMatch)
+			if w.Code != tt.code {
+				t.Errorf("Expected status %d, got %d", tt.code, w.Code)
+			}
+			if w.Code == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("Expected no body with 304, got %q", w.Body.String())
+			}
+			if got := w.Header().Get("ETag"); got != etag {
+				t.Errorf("Expected ETag %s, got %s", etag, got)
+			}
+		})
+	}
+
+	// The changed voting gets a new tag
+	service.name = "second"
+	changed := getVoting(router, id, etag)
+	if changed.Code != http.StatusOK || changed.Header().Get("ETag") == etag {
+		t.Errorf("Expected 200 with a new ETag, got %d and %s", changed.Code, changed.Header().Get("ETag"))
+	}
+}
@@ -0,0 +1,171 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+var errSSEClosed = errors.New("event stream closed")
+
+// sseConn adapts a Server-Sent Events stream to infrastructure.ClientConn,
+// so the stream is served by the same hub as websocket subscribers.
+type sseConn struct {
+	mu         sync.Mutex
+	w          gin.ResponseWriter
+	controller *http.ResponseController
+	closed     bool
+	done       chan struct{}
+}
+
+func newSSEConn(w gin.ResponseWriter) *sseConn {
+	return &sseConn{
+		w:          w,
+		controller: http.NewResponseController(w),
+		done:       make(chan struct{}),
+	}
+}
+
+// sseEventHeader is the part of entity.Event used for the id and event fields.
+type sseEventHeader struct {
+	Type     string `json:"type"`
+	Epoch    string `json:"epoch"`
+	Sequence uint64 `json:"sequence"`
+}
+
+func (s *sseConn) WriteMessage(_ int, data []byte) error {
+	var header sseEventHeader
+	_ = json.Unmarshal(data, &header)
+
+	var buf bytes.Buffer
+	if header.Sequence > 0 {
+		fmt.Fprintf(&buf, "id: %s\n", infrastructure.Cursor{Epoch: header.Epoch, Sequence: header.Sequence})
+	}
+	if header.Type != "" {
+		fmt.Fprintf(&buf, "event: %s\n", header.Type)
+	}
+	fmt.Fprintf(&buf, "data: %s\n\n", data)
+
+	return s.write(buf.Bytes())
+}
+
+// WriteControl turns pings into comments, they keep proxies from closing an idle stream.
+func (s *sseConn) WriteControl(messageType int, _ []byte, _ time.Time) error {
+	if messageType != websocket.PingMessage {
+		return nil
+	}
+
+	return s.write([]byte(": ping\n\n"))
+}
+
+func (s *sseConn) write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errSSEClosed
+	}
+
+	if _, err := s.w.Write(data); err != nil {
+		return err
+	}
+	s.w.Flush()
+
+	return nil
+}
+
+func (s *sseConn) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errSSEClosed
+	}
+
+	// Not every writer supports deadlines, the write then just waits
+	if err := s.controller.SetWriteDeadline(t); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	return nil
+}
+
+// Close ends the stream, nothing is written after it returns.
+func (s *sseConn) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+
+	return nil
+}
+
+// sseRetry is how long the browser waits before it reconnects.
+const sseRetry = 3 * time.Second
+
+// Events streams the same events as Subscribe over Server-Sent Events. The stream accepts
+// the voting_id and tag filters, a reconnecting client (Last-Event-ID or from) gets the missed
+// events or a snapshot when they are too old.
+func (v *VotingHandler) Events(c *gin.Context) {
+	identity, ok := v.subscriberIdentity(c)
+	if !ok {
+		return
+	}
+
+	topics, err := topicsFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	from, err := cursorFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if lastEventID := c.GetHeader("Last-Event-ID"); lastEventID != "" {
+		cursor, err := infrastructure.ParseCursor(lastEventID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid Last-Event-ID"})
+			return
+		}
+		from = &cursor
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	conn := newSSEConn(c.Writer)
+	defer conn.Close()
+	if err = conn.write([]byte("retry: " + strconv.FormatInt(sseRetry.Milliseconds(), 10) + "\n\n")); err != nil {
+		return
+	}
+
+	v.subscription.AddClient(conn, identity, infrastructure.EncodingJSON)
+	defer v.subscription.RemoveClient(conn)
+	v.subscribe(c.Request.Context(), conn, topics, from)
+
+	if c.Query("snapshot") == "true" {
+		v.sendSnapshot(c.Request.Context(), conn)
+	}
+
+	select {
+	case <-c.Request.Context().Done():
+	case <-conn.done:
+	}
+}
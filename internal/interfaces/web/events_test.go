@@ -0,0 +1,65 @@
+package web
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+func TestEventsStreamsFilteredEvents(t *testing.T) {
+	server, subscription, url := newSubscribeServer(t, infrastructure.WebSocket{})
+
+	votingID := uuid.New()
+	query := url[strings.Index(url, "?"):]
+	resp, err := http.Get(server.URL + "/voting/events" + query + "&voting_id=" + votingID.String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, got %s", contentType)
+	}
+	waitForClients(t, subscription, 1)
+
+	other, _ := entity.NewEvent(entity.EventVotingUpdated, uuid.New(), nil, nil)
+	subscription.PublishEvent(other)
+	event, _ := entity.NewEvent(entity.EventVotingUpdated, votingID, nil, nil)
+	subscription.PublishEvent(event)
+
+	// The first event is filtered out, so the second one is delivered with sequence 2
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "retry:") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	if expected := "id: " + subscription.Cursor().Epoch + ":2"; lines[0] != expected {
+		t.Errorf("Expected %s, got %s", expected, lines[0])
+	}
+	if lines[1] != "event: "+string(entity.EventVotingUpdated) {
+		t.Errorf("Expected event: %s, got %s", entity.EventVotingUpdated, lines[1])
+	}
+	if !strings.Contains(lines[2], votingID.String()) {
+		t.Errorf("Expected data of voting %s, got %s", votingID, lines[2])
+	}
+
+	resp.Body.Close()
+	waitForClients(t, subscription, 0)
+}
@@ -0,0 +1,138 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// rateLimitTarget resolves the voting of the id param of the route, uuid.Nil skips the bucket of the voting.
+type rateLimitTarget func(ctx context.Context, id string) (uuid.UUID, error)
+
+// rateLimitMiddleware must be used after authMiddleware, requests are limited by user, API key and IP.
+// With target the voting of the route is limited as well.
+func (v *VotingHandler) rateLimitMiddleware(scope string, target rateLimitTarget) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		var resolve votingResolver
+		if target != nil {
+			resolve = func(ctx context.Context) (uuid.UUID, error) {
+				return target(ctx, c.Param("id"))
+			}
+		}
+
+		wait, err := v.allowRate(ctx, scope, rateLimitKeys(c), resolve)
+		if err != nil {
+			v.log.Error("check rate limit", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			c.Abort()
+			return
+		}
+
+		if wait > 0 {
+			c.Header("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// rateLimitKeys identify the caller of an authenticated request.
+func rateLimitKeys(c *gin.Context) []string {
+	keys := []string{"ip:" + c.ClientIP()}
+	if userID, ok := c.Request.Context().Value(userIDKey).(uuid.UUID); ok {
+		keys = append(keys, "user:"+userID.String())
+	}
+	if apiKey := c.GetHeader(apiKeyHeader); apiKey != "" {
+		// Don't keep the secret itself in the store
+		sum := sha256.Sum256([]byte(apiKey))
+		keys = append(keys, "apikey:"+hex.EncodeToString(sum[:8]))
+	}
+
+	return keys
+}
+
+// votingTarget is the voting of the id param.
+func (v *VotingHandler) votingTarget(_ context.Context, id string) (uuid.UUID, error) {
+	// An invalid id is rejected by the handler, it's charged to the caller only
+	votingID, _ := uuid.Parse(id)
+
+	return votingID, nil
+}
+
+// invarianceTarget is the voting of the invariance of the id param, so every invariance of a voting
+// shares the bucket of the voting.
+func (v *VotingHandler) invarianceTarget(ctx context.Context, id string) (uuid.UUID, error) {
+	invarianceID, err := uuid.Parse(id)
+	if err != nil {
+		return uuid.Nil, nil
+	}
+
+	return v.invarianceVoting(ctx, invarianceID)
+}
+
+// invarianceVoting is the voting of the invariance, unknown invariance are rejected by the vote itself.
+func (v *VotingHandler) invarianceVoting(ctx context.Context, invarianceID uuid.UUID) (uuid.UUID, error) {
+	votingID, err := v.votingService.InvarianceVoting(ctx, invarianceID)
+	if errors.Is(err, infrastructure.ErrInvarianceNotFound) {
+		return uuid.Nil, nil
+	}
+
+	return votingID, err
+}
+
+// votingResolver returns the voting charged for the request, uuid.Nil skips the bucket of the voting.
+type votingResolver func(ctx context.Context) (uuid.UUID, error)
+
+// allowRate checks the buckets of the caller, then the bucket of the voting of resolve, when it's set.
+// The voting is resolved only for the requests the caller may make, so a flood of a caller is rejected
+// without a lookup. A request rejected by the bucket of the voting has taken the tokens of the caller.
+func (v *VotingHandler) allowRate(ctx context.Context, scope string, keys []string, resolve votingResolver) (time.Duration, error) {
+	if !v.rateLimiter.Enabled() {
+		return 0, nil
+	}
+
+	scoped := make([]infrastructure.RateLimitKey, 0, len(keys))
+	for _, key := range keys {
+		scoped = append(scoped, infrastructure.RateLimitKey{Scope: scope, Key: key})
+	}
+
+	wait, err := v.rateLimiter.AllowKeys(ctx, scoped...)
+	if err != nil || wait > 0 || resolve == nil {
+		return wait, err
+	}
+
+	votingID, err := resolve(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("resolve rate limit target: %w", err)
+	}
+	if votingID == uuid.Nil {
+		return 0, nil
+	}
+
+	return v.rateLimiter.AllowKeys(ctx, infrastructure.RateLimitKey{
+		Scope: infrastructure.RateLimitScopePerVoting,
+		Key:   votingID.String(),
+	})
+}
+
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
@@ -0,0 +1,74 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+// lookupVotingService counts the lookups of the voting of an invariance.
+type lookupVotingService struct {
+	VotingService
+	lookups int
+}
+
+func (s *lookupVotingService) InvarianceVoting(_ context.Context, invarianceID uuid.UUID) (uuid.UUID, error) {
+	s.lookups++
+	return invarianceID, nil
+}
+
+func TestRateLimitResolvesVotingAfterCaller(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     infrastructure.RateLimit
+		codes   []int
+		lookups int
+	}{
+		{
+			name:    "disabled",
+			cfg:     infrastructure.RateLimit{},
+			codes:   []int{http.StatusOK, http.StatusOK},
+			lookups: 0,
+		},
+		{
+			name: "caller exhausted",
+			cfg: infrastructure.RateLimit{
+				Enabled:   true,
+				Choice:    infrastructure.TokenBucket{Rate: 0.001, Burst: 1},
+				PerVoting: infrastructure.TokenBucket{Rate: 0.001, Burst: 10},
+			},
+			codes:   []int{http.StatusOK, http.StatusTooManyRequests},
+			lookups: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &lookupVotingService{}
+			limiter := infrastructure.NewRateLimiter(infrastructure.NewDefaultLogger(), infrastructure.NewMemoryRateLimitStore(), tt.cfg)
+			handler := NewVotingHandler(infrastructure.NewDefaultLogger(), service, nil, nil, nil, limiter, nil, nil,
+				infrastructure.WebSocket{}, infrastructure.Cache{})
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/choice/:id", handler.rateLimitMiddleware(infrastructure.RateLimitScopeChoice, handler.invarianceTarget), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			for i, code := range tt.codes {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/choice/"+uuid.NewString(), nil))
+				if w.Code != code {
+					t.Errorf("Request %d: expected status %d, got %d", i+1, code, w.Code)
+				}
+			}
+			if service.lookups != tt.lookups {
+				t.Errorf("Expected %d lookups of the voting, got %d", tt.lookups, service.lookups)
+			}
+		})
+	}
+}
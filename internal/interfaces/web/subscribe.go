@@ -0,0 +1,396 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+const allOrigins = "*"
+
+// newUpgrader allows the same origin, handshakes without Origin header (not a browser) and the allowed origins.
+func newUpgrader(allowedOrigins []string) websocket.Upgrader {
+	return websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" || slices.Contains(allowedOrigins, allOrigins) {
+				return true
+			}
+
+			u, err := url.Parse(origin)
+			if err != nil {
+				return false
+			}
+
+			if strings.EqualFold(u.Host, r.Host) {
+				return true
+			}
+
+			return slices.ContainsFunc(allowedOrigins, func(allowed string) bool {
+				return strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin)
+			})
+		},
+	}
+}
+
+// Subprotocols of the subscription, they select the encoding of events. Commands and replies are always JSON text frames.
+const (
+	SubprotocolJSON     = "voting.v1.json"
+	SubprotocolMsgPack  = "voting.v1.msgpack"
+	SubprotocolProtobuf = "voting.v1.protobuf"
+)
+
+var subprotocolEncodings = map[string]infrastructure.Encoding{
+	SubprotocolJSON:     infrastructure.EncodingJSON,
+	SubprotocolMsgPack:  infrastructure.EncodingMsgPack,
+	SubprotocolProtobuf: infrastructure.EncodingProtobuf,
+}
+
+// negotiateEncoding picks the first subprotocol requested by the client which is supported,
+// a client requesting none of them gets JSON without a subprotocol.
+func negotiateEncoding(r *http.Request) (string, infrastructure.Encoding) {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if encoding, ok := subprotocolEncodings[protocol]; ok {
+			return protocol, encoding
+		}
+	}
+
+	return "", infrastructure.EncodingJSON
+}
+
+type SubscribeTicketResponse struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (v *VotingHandler) SubscribeTicket(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, _ := ctx.Value(userIDKey).(uuid.UUID)
+	username, _ := ctx.Value(usernameKey).(string)
+
+	ticket, expiresAt, err := v.tickets.Issue(entity.Identity{
+		UserID:   userID,
+		Username: username,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, SubscribeTicketResponse{
+		Ticket:    ticket,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// subscriberIdentity authenticates the subscriber either with a ticket or with Basic credentials,
+// the error response is written when it fails.
+func (v *VotingHandler) subscriberIdentity(c *gin.Context) (entity.Identity, bool) {
+	ticket := c.Query("ticket")
+	if ticket == "" {
+		return v.authenticate(c)
+	}
+
+	identity, err := v.tickets.Verify(ticket)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return entity.Identity{}, false
+	}
+
+	return identity, true
+}
+
+func (v *VotingHandler) Subscribe(c *gin.Context) {
+	// A ticket is single-use, a handshake refused for its origin doesn't spend it
+	if !v.upgrader.CheckOrigin(c.Request) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "origin not allowed"})
+		return
+	}
+
+	identity, ok := v.subscriberIdentity(c)
+	if !ok {
+		return
+	}
+	// Commands see the same context as the HTTP routes behind authMiddleware
+	c.Request = c.Request.WithContext(withIdentity(c.Request.Context(), identity))
+
+	topics, err := topicsFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	from, err := cursorFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Upgrade writes the error response itself
+	protocol, encoding := negotiateEncoding(c.Request)
+	var responseHeader http.Header
+	if protocol != "" {
+		responseHeader = http.Header{"Sec-Websocket-Protocol": {protocol}}
+	}
+	ws, err := v.upgrader.Upgrade(c.Writer, c.Request, responseHeader)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	// The hub pings the client, a client which doesn't answer in time is dropped by the read deadline
+	ws.SetReadLimit(maxCommandSize)
+	_ = ws.SetReadDeadline(time.Now().Add(v.wsConfig.PongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(v.wsConfig.PongWait))
+	})
+
+	v.subscription.AddClient(ws, identity, encoding)
+	defer v.subscription.RemoveClient(ws)
+	v.subscribe(c.Request.Context(), ws, topics, from)
+
+	if c.Query("snapshot") == "true" {
+		v.sendSnapshot(c.Request.Context(), ws)
+	}
+
+	v.readCommands(c.Request.Context(), ws, identity, rateLimitKeys(c))
+}
+
+// maxCommandSize bounds the messages read from subscribers, only commands are expected.
+const maxCommandSize = 4096
+
+// readCommands reads the socket until the client disconnects. Close frames are answered by
+// the default close handler and pongs extend the read deadline, so a peer which vanished
+// without closing is detected within PongWait. Evicted clients are closed by the hub,
+// which ends the loop as well.
+func (v *VotingHandler) readCommands(ctx context.Context, ws *websocket.Conn, identity entity.Identity, rateLimitKeys []string) {
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				v.log.Info("subscriber disconnected", slog.String("user", identity.Username), slog.Any("error", err))
+			}
+			return
+		}
+
+		v.handleSubscriptionCommand(ctx, ws, rateLimitKeys, data)
+	}
+}
+
+// topicsFromQuery reads the voting_id and tag query params, without them the client is subscribed to everything.
+func topicsFromQuery(c *gin.Context) (infrastructure.Topics, error) {
+	var topics infrastructure.Topics
+	for _, idStr := range c.QueryArray("voting_id") {
+		id, err := uuid.Parse(idStr)
+		if err != nil {
+			return infrastructure.Topics{}, fmt.Errorf("invalid voting_id: %s", idStr)
+		}
+		topics.VotingIDs = append(topics.VotingIDs, id)
+	}
+	topics.Tags = c.QueryArray("tag")
+
+	if len(topics.VotingIDs) == 0 && len(topics.Tags) == 0 {
+		topics.All = true
+	}
+
+	return topics, nil
+}
+
+// cursorFromQuery reads the from and epoch query params, the sequence and the epoch of the last event the client has seen.
+func cursorFromQuery(c *gin.Context) (*infrastructure.Cursor, error) {
+	fromStr := c.Query("from")
+	if fromStr == "" {
+		return nil, nil
+	}
+
+	from, err := strconv.ParseUint(fromStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from: %s", fromStr)
+	}
+
+	return &infrastructure.Cursor{Epoch: c.Query("epoch"), Sequence: from}, nil
+}
+
+// subscribe adds the topics to the client. With the from cursor the events the client missed
+// are replayed, when they are not in the history anymore or the cursor is of another instance
+// the client gets a snapshot instead.
+func (v *VotingHandler) subscribe(ctx context.Context, client infrastructure.ClientConn, topics infrastructure.Topics, from *infrastructure.Cursor) infrastructure.Topics {
+	if from == nil {
+		return v.subscription.Subscribe(client, topics)
+	}
+
+	result, ok := v.subscription.SubscribeFrom(client, topics, *from)
+	if !ok {
+		v.sendSnapshot(ctx, client)
+	}
+
+	return result
+}
+
+const (
+	subscriptionActionSubscribe   = "subscribe"
+	subscriptionActionUnsubscribe = "unsubscribe"
+	subscriptionActionSnapshot    = "snapshot"
+)
+
+// SubscriptionCommand is sent by the client over the socket, e.g.
+// {"action": "subscribe", "voting_ids": ["..."], "tags": ["team-a"]}, {"action": "unsubscribe", "all": true}
+// or {"action": "snapshot"}. Subscribe with "from" and "epoch" replays the events after that sequence.
+// The voting commands are {"action": "vote", "invariance_id": "..."}, {"action": "list", "limit": 10}
+// and {"action": "get_voting", "voting_id": "..."}, the reply carries the ID of the command.
+type SubscriptionCommand struct {
+	Action string  `json:"action"`
+	ID     string  `json:"id,omitempty"`
+	From   *uint64 `json:"from,omitempty"`
+	Epoch  string  `json:"epoch,omitempty"`
+	infrastructure.Topics
+
+	InvarianceID uuid.UUID `json:"invariance_id"`
+	VotingID     uuid.UUID `json:"voting_id"`
+	Limit        int64     `json:"limit,omitempty"`
+	Offset       int64     `json:"offset,omitempty"`
+}
+
+const (
+	replyTypeResult = "result"
+	replyTypeError  = "error"
+)
+
+// SubscriptionReply answers the command: subscribe and unsubscribe are confirmed with all the topics
+// of the client, voting commands get a result or an error with one of the CommandError codes.
+type SubscriptionReply struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id,omitempty"`
+	Action     string                 `json:"action,omitempty"`
+	Topics     *infrastructure.Topics `json:"topics,omitempty"`
+	Result     any                    `json:"result,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+	Code       string                 `json:"code,omitempty"`
+	RetryAfter int                    `json:"retry_after,omitempty"` // seconds, when rate limited
+}
+
+func (v *VotingHandler) handleSubscriptionCommand(ctx context.Context, ws infrastructure.ClientConn, rateLimitKeys []string, data []byte) {
+	var (
+		command SubscriptionCommand
+		reply   SubscriptionReply
+	)
+	if err := json.Unmarshal(data, &command); err != nil {
+		reply = commandError(CommandErrorInvalidCommand, "invalid command")
+	} else {
+		switch command.Action {
+		case subscriptionActionSubscribe:
+			var from *infrastructure.Cursor
+			if command.From != nil {
+				from = &infrastructure.Cursor{Epoch: command.Epoch, Sequence: *command.From}
+			}
+			topics := v.subscribe(ctx, ws, command.Topics, from)
+			reply = SubscriptionReply{Type: "subscribed", Topics: &topics}
+		case subscriptionActionUnsubscribe:
+			topics := v.subscription.Unsubscribe(ws, command.Topics)
+			reply = SubscriptionReply{Type: "unsubscribed", Topics: &topics}
+		case subscriptionActionSnapshot:
+			v.sendSnapshot(ctx, ws)
+			return
+		default:
+			reply = v.handleVotingCommand(ctx, rateLimitKeys, command)
+		}
+		reply.ID = command.ID
+		reply.Action = command.Action
+	}
+
+	payload, err := json.Marshal(reply)
+	if err != nil {
+		v.log.Error("marshal subscription reply", slog.Any("error", err))
+		return
+	}
+
+	v.subscription.Send(ws, payload)
+}
+
+// snapshotLimit bounds the votings of a snapshot of all votings or tags, specific votings are always included.
+const snapshotLimit = 100
+
+// SnapshotPayload is the payload of the snapshot event.
+type SnapshotPayload struct {
+	Items []VotingItem `json:"items"`
+}
+
+// sendSnapshot sends the actual state of the votings the client is subscribed to.
+func (v *VotingHandler) sendSnapshot(ctx context.Context, ws infrastructure.ClientConn) {
+	// Taken before the state is read, a later sequence could skip the events published meanwhile
+	cursor := v.subscription.Cursor()
+
+	items, err := v.snapshotItems(ctx, v.subscription.Topics(ws))
+	if err != nil {
+		v.log.Error("build snapshot", slog.Any("error", err))
+		return
+	}
+
+	event, err := entity.NewEvent(entity.EventSnapshot, uuid.Nil, nil, SnapshotPayload{
+		Items: items,
+	})
+	if err != nil {
+		v.log.Error("create snapshot event", slog.Any("error", err))
+		return
+	}
+	event.Epoch, event.Sequence = cursor.Epoch, cursor.Sequence
+
+	v.subscription.SendEvent(ws, event)
+}
+
+func (v *VotingHandler) snapshotItems(ctx context.Context, topics infrastructure.Topics) ([]VotingItem, error) {
+	items := make([]VotingItem, 0)
+	included := make(map[uuid.UUID]struct{})
+
+	if topics.All || len(topics.Tags) > 0 {
+		list, err := v.votingService.List(ctx, &ListVotingRequest{
+			Limit: snapshotLimit,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range list.Items {
+			if topics.All || slices.ContainsFunc(item.Tags, func(tag string) bool {
+				return slices.Contains(topics.Tags, tag)
+			}) {
+				items = append(items, item)
+				included[item.ID] = struct{}{}
+			}
+		}
+	}
+
+	for _, id := range topics.VotingIDs {
+		if _, ok := included[id]; ok {
+			continue
+		}
+
+		item, err := v.votingService.GetVoting(ctx, &GetVotingRequest{
+			ID: id,
+		})
+		if errors.Is(err, infrastructure.ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, *item)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,168 @@
+package web
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+func newSubscribeServer(t *testing.T, wsConfig infrastructure.WebSocket) (*httptest.Server, *infrastructure.Subscription, string) {
+	t.Helper()
+	return newSubscribeServerWith(t, wsConfig, nil, nil)
+}
+
+func newSubscribeServerWith(t *testing.T, wsConfig infrastructure.WebSocket, votingService VotingService, rateLimiter RateLimiter) (*httptest.Server, *infrastructure.Subscription, string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	logger := infrastructure.NewDefaultLogger()
+	subscription := infrastructure.NewSubscription(logger, wsConfig)
+	tickets, err := infrastructure.NewSubscribeTickets(wsConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	handler := NewVotingHandler(logger, votingService, nil, subscription, nil, rateLimiter, tickets, nil, wsConfig, infrastructure.Cache{})
+	router := gin.New()
+	handler.RegisterHandlers(router)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	ticket, _, err := tickets.Issue(entity.Identity{UserID: uuid.New(), Username: "user1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/voting/subscribe?ticket=" + ticket
+
+	return server, subscription, url
+}
+
+func waitForClients(t *testing.T, subscription *infrastructure.Subscription, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for subscription.ClientsCount() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d clients, got %d", want, subscription.ClientsCount())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSubscribeRemovesClosedClient(t *testing.T) {
+	_, subscription, url := newSubscribeServer(t, infrastructure.WebSocket{})
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	waitForClients(t, subscription, 1)
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye")
+	if err = conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	waitForClients(t, subscription, 0)
+	conn.Close()
+}
+
+func TestSubscribeRemovesSilentClient(t *testing.T) {
+	_, subscription, url := newSubscribeServer(t, infrastructure.WebSocket{
+		PongWait:   100 * time.Millisecond,
+		PingPeriod: time.Hour,
+	})
+
+	// The client never reads, so pings are never answered
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	waitForClients(t, subscription, 1)
+	waitForClients(t, subscription, 0)
+}
+
+func TestSubscribeRejectsForeignOrigin(t *testing.T) {
+	_, subscription, url := newSubscribeServer(t, infrastructure.WebSocket{
+		AllowedOrigins: []string{"https://dashboard.example.com"},
+	})
+
+	header := map[string][]string{"Origin": {"https://evil.example.com"}}
+	if _, _, err := websocket.DefaultDialer.Dial(url, header); err == nil {
+		t.Fatalf("Expected handshake from a foreign origin to fail")
+	}
+
+	header = map[string][]string{"Origin": {"https://dashboard.example.com"}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	waitForClients(t, subscription, 1)
+}
+
+func TestSubscribeReplaysFromSequence(t *testing.T) {
+	_, subscription, url := newSubscribeServer(t, infrastructure.WebSocket{})
+
+	for i := 0; i < 3; i++ {
+		event, _ := entity.NewEvent(entity.EventVotingCreated, uuid.New(), nil, nil)
+		subscription.PublishEvent(event)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"&from=1&epoch="+subscription.Cursor().Epoch, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	for _, expected := range []uint64{2, 3} {
+		var event entity.Event
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err = conn.ReadJSON(&event); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if event.Sequence != expected {
+			t.Errorf("Expected sequence %d, got %d", expected, event.Sequence)
+		}
+	}
+}
+
+func TestSubscribeNegotiatesBinaryEncoding(t *testing.T) {
+	_, subscription, url := newSubscribeServer(t, infrastructure.WebSocket{})
+
+	dialer := websocket.Dialer{Subprotocols: []string{"voting.v2.cbor", SubprotocolProtobuf, SubprotocolMsgPack}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	if conn.Subprotocol() != SubprotocolProtobuf {
+		t.Fatalf("Expected subprotocol %s, got %q", SubprotocolProtobuf, conn.Subprotocol())
+	}
+	waitForClients(t, subscription, 1)
+
+	event, _ := entity.NewEvent(entity.EventVotingDeleted, uuid.New(), nil, nil)
+	subscription.PublishEvent(event)
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if messageType != websocket.BinaryMessage {
+		t.Errorf("Expected a binary frame, got %d", messageType)
+	}
+	if !strings.Contains(string(data), event.ID.String()) {
+		t.Errorf("Expected the event %s in the frame", event.ID)
+	}
+}
@@ -2,6 +2,8 @@ package web
 
 import (
 	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"time"
@@ -9,83 +11,134 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
 	"github.com/yvv4git/task-voting/internal/infrastructure"
 )
 
-type contextKey string
-
-const userIDKey contextKey = "userID"
-
 type VotingService interface {
 	List(ctx context.Context, r *ListVotingRequest) (*ListVotingResponse, error)
 	CreateVoting(ctx context.Context, r *CreateVotingRequest) (*CreateVotingResponse, error)
 	UpdateVoting(ctx context.Context, r *UpdateVotingRequest) error
 	DeleteVoting(ctx context.Context, r *DeleteVotingRequest) error
 	MakeChoice(ctx context.Context, r *MakeChoiceRequest) error
+	GetVoting(ctx context.Context, r *GetVotingRequest) (*VotingItem, error)
+	InvarianceVoting(ctx context.Context, invarianceID uuid.UUID) (uuid.UUID, error)
 }
 
 type AuthService interface {
 	CheckLoginPassword(ctx context.Context, login string, password string) error
 	UserIDByLoginPassword(ctx context.Context, username, password string) (uuid.UUID, error)
+	IsAdmin(ctx context.Context, username string) bool
+}
+
+type LoginGuard interface {
+	Allow(ctx context.Context, username, ip string) (infrastructure.LoginCheck, error)
+	Failure(ctx context.Context, username, ip string) error
+	Success(ctx context.Context, check infrastructure.LoginCheck, username, ip string) error
+	Unlock(ctx context.Context, username, ip string) error
+}
+
+type RateLimiter interface {
+	Enabled() bool
+	AllowKeys(ctx context.Context, keys ...infrastructure.RateLimitKey) (time.Duration, error)
 }
 
 type SubscriptionProcessor interface {
-	AddClient(client infrastructure.ClientConn)
+	AddClient(client infrastructure.ClientConn, identity entity.Identity, encoding infrastructure.Encoding)
+	RemoveClient(client infrastructure.ClientConn)
+	Subscribe(client infrastructure.ClientConn, topics infrastructure.Topics) infrastructure.Topics
+	SubscribeFrom(client infrastructure.ClientConn, topics infrastructure.Topics, from infrastructure.Cursor) (infrastructure.Topics, bool)
+	Unsubscribe(client infrastructure.ClientConn, topics infrastructure.Topics) infrastructure.Topics
+	Send(client infrastructure.ClientConn, message []byte)
+	SendEvent(client infrastructure.ClientConn, event entity.Event)
+	Cursor() infrastructure.Cursor
+	Topics(client infrastructure.ClientConn) infrastructure.Topics
+	ClientsCount() int
+	Viewers(topic infrastructure.Topic) int
+}
+
+type SubscribeTickets interface {
+	Issue(identity entity.Identity) (string, time.Time, error)
+	Verify(ticket string) (entity.Identity, error)
+}
+
+type WebhookService interface {
+	Register(ctx context.Context, webhook entity.Webhook) (entity.Webhook, error)
+	List(ctx context.Context) ([]entity.Webhook, error)
+	Delete(ctx context.Context, id uuid.UUID) error
+	Deliveries(ctx context.Context, webhookID uuid.UUID, limit int) ([]entity.WebhookDelivery, error)
+	Redeliver(ctx context.Context, deliveryID uuid.UUID) error
 }
 
 type VotingHandler struct {
 	votingService VotingService
 	authService   AuthService
 	subscription  SubscriptionProcessor
+	loginGuard    LoginGuard
+	rateLimiter   RateLimiter
+	tickets       SubscribeTickets
+	webhooks      WebhookService
+	upgrader      websocket.Upgrader
+	wsConfig      infrastructure.WebSocket
+	cacheConfig   infrastructure.Cache
+	log           *slog.Logger
 }
 
-func NewVotingHandler(votingService VotingService, authService AuthService, subscription SubscriptionProcessor) *VotingHandler {
+func NewVotingHandler(
+	log *slog.Logger,
+	votingService VotingService,
+	authService AuthService,
+	subscription SubscriptionProcessor,
+	loginGuard LoginGuard,
+	rateLimiter RateLimiter,
+	tickets SubscribeTickets,
+	webhooks WebhookService,
+	wsConfig infrastructure.WebSocket,
+	cacheConfig infrastructure.Cache,
+) *VotingHandler {
 	return &VotingHandler{
 		votingService: votingService,
 		authService:   authService,
 		subscription:  subscription,
+		loginGuard:    loginGuard,
+		rateLimiter:   rateLimiter,
+		tickets:       tickets,
+		webhooks:      webhooks,
+		upgrader:      newUpgrader(wsConfig.AllowedOrigins),
+		wsConfig:      wsConfig.WithDefaults(),
+		cacheConfig:   cacheConfig.WithDefaults(),
+		log:           log,
 	}
 }
 
 func (v *VotingHandler) RegisterHandlers(router *gin.Engine) {
-	authMiddleware := func(c *gin.Context) {
-		login, password, err := infrastructure.ExtractBasicAuthValid(c)
-		if err != nil {
-			c.JSON(401, gin.H{"error": "Unauthorized"})
-			c.Abort()
-			return
-		}
-
-		// Check login and password with auth service
-		if err := v.authService.CheckLoginPassword(c.Request.Context(), login, password); err != nil {
-			c.JSON(401, gin.H{"error": "Unauthorized"})
-			c.Abort()
-			return
-		}
-
-		// Request userID from auth service
-		userID, err := v.authService.UserIDByLoginPassword(c.Request.Context(), login, password)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-
-		// Store the userID in the context
-		ctx := context.WithValue(c.Request.Context(), userIDKey, userID)
-		c.Request = c.Request.WithContext(ctx)
-
-		c.Next()
-	}
-
 	votingGroup := router.Group("/voting")
-	votingGroup.Use(authMiddleware)
+	votingGroup.Use(v.authMiddleware)
 	{
 		votingGroup.GET("", v.ListVoting)
-		votingGroup.POST("", v.CreateVoting)
-		votingGroup.PUT("/:id", v.UpdateVoting)
+		votingGroup.GET("/:id", v.GetVoting)
+		votingGroup.POST("", v.rateLimitMiddleware(infrastructure.RateLimitScopeWrite, nil), v.CreateVoting)
+		votingGroup.PUT("/:id", v.rateLimitMiddleware(infrastructure.RateLimitScopeWrite, v.votingTarget), v.UpdateVoting)
 		votingGroup.DELETE("/:id", v.DeleteVoting)
-		votingGroup.POST("/choice/:id", v.MakeChoice)
-		votingGroup.GET("/subscribe", v.Subscribe)
+		votingGroup.POST("/choice/:id", v.rateLimitMiddleware(infrastructure.RateLimitScopeChoice, v.invarianceTarget), v.MakeChoice)
+		votingGroup.POST("/subscribe/ticket", v.SubscribeTicket)
+	}
+
+	// Browsers can't send the Authorization header on the handshake, so the subscription
+	// authenticates itself either with a ticket or with Basic credentials.
+	router.GET("/voting/subscribe", v.Subscribe)
+	router.GET("/voting/events", v.Events)
+
+	adminGroup := router.Group("/admin")
+	adminGroup.Use(v.authMiddleware, v.adminMiddleware)
+	{
+		adminGroup.POST("/auth/unlock", v.UnlockLogin)
+		adminGroup.GET("/subscribers", v.Subscribers)
+		adminGroup.POST("/webhooks", v.CreateWebhook)
+		adminGroup.GET("/webhooks", v.ListWebhooks)
+		adminGroup.DELETE("/webhooks/:id", v.DeleteWebhook)
+		adminGroup.GET("/webhooks/:id/deliveries", v.WebhookDeliveries)
+		adminGroup.POST("/webhooks/deliveries/:id/redeliver", v.RedeliverWebhook)
 	}
 }
 
@@ -105,10 +158,13 @@ type (
 		ID          uuid.UUID         `json:"id"`
 		Name        string            `json:"name"`
 		Description string            `json:"description"`
+		Tags        []string          `json:"tags"`
 		CreatedAt   time.Time         `json:"created_at"`
 		StartAt     time.Time         `json:"startAt"`
 		EndAt       time.Time         `json:"endAt"`
 		Invariance  []InvarianceScore `json:"invariance"`
+		// Turnout is the number of votes, every user votes once
+		Turnout int64 `json:"turnout"`
 	}
 
 	ListVotingResponse struct {
@@ -141,13 +197,14 @@ func (v *VotingHandler) ListVoting(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"votings": result})
+	v.writeJSONWithETag(c, gin.H{"votings": result})
 }
 
 type (
 	CreateVotingRequest struct {
 		Name        string    `json:"name"`
 		Description string    `json:"description"`
+		Tags        []string  `json:"tags"`
 		StartAt     time.Time `json:"startAt"`
 		EndAt       time.Time `json:"endAt"`
 		Invariance  []string  `json:"invariance"`
@@ -168,6 +225,7 @@ func (v *VotingHandler) CreateVoting(c *gin.Context) {
 	result, err := v.votingService.CreateVoting(c.Request.Context(), &request)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
 	response := CreateVotingResponse{
@@ -181,6 +239,7 @@ type UpdateVotingRequest struct {
 	ID          uuid.UUID  `json:"id"`
 	Name        *string    `json:"name"`
 	Description *string    `json:"description"`
+	Tags        []string   `json:"tags"`
 	StartAt     *time.Time `json:"startAt"`
 	EndAt       *time.Time `json:"endAt"`
 	Invariance  []string   `json:"invariance"`
@@ -204,6 +263,7 @@ func (v *VotingHandler) UpdateVoting(c *gin.Context) {
 		ID:          id,
 		Name:        request.Name,
 		Description: request.Description,
+		Tags:        request.Tags,
 		StartAt:     request.StartAt,
 		EndAt:       request.EndAt,
 		Invariance:  request.Invariance,
@@ -237,6 +297,42 @@ func (v *VotingHandler) DeleteVoting(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "voting deleted"})
 }
 
+type GetVotingRequest struct {
+	ID uuid.UUID `json:"id"`
+}
+
+// VotingDetailsResponse is the voting with its live presence next to the turnout.
+type VotingDetailsResponse struct {
+	VotingItem
+	// Viewers is the number of users receiving the events of the voting on this instance
+	Viewers int `json:"viewers"`
+}
+
+func (v *VotingHandler) GetVoting(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	item, err := v.votingService.GetVoting(c.Request.Context(), &GetVotingRequest{
+		ID: id,
+	})
+	if errors.Is(err, infrastructure.ErrObjectNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "voting not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	v.writeJSONWithETag(c, VotingDetailsResponse{
+		VotingItem: *item,
+		Viewers:    v.subscription.Viewers(infrastructure.Topic{VotingID: id, Tags: item.Tags}),
+	})
+}
+
 type MakeChoiceRequest struct {
 	InvarianceID uuid.UUID
 	UserID       uuid.UUID
@@ -262,25 +358,24 @@ func (v *VotingHandler) MakeChoice(c *gin.Context) {
 		InvarianceID: invarianceID,
 		UserID:       userID,
 	}); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		v.makeChoiceError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "successfully voted"})
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
-func (v *VotingHandler) Subscribe(c *gin.Context) {
-	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to upgrade to websocket"})
-		return
+// makeChoiceError answers the rejected vote with 4xx, the failures are logged and answered with 5xx.
+func (v *VotingHandler) makeChoiceError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, infrastructure.ErrInvarianceNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, infrastructure.ErrAlreadyVoted), errors.Is(err, infrastructure.ErrVotingFinished):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, infrastructure.ErrIngestStopped):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		v.log.Error("make choice", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
 	}
-
-	v.subscription.AddClient(ws)
 }
@@ -0,0 +1,225 @@
+package web_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/repository"
+	"github.com/yvv4git/task-voting/internal/domain/service"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+	"github.com/yvv4git/task-voting/internal/interfaces/web"
+)
+
+// newMemoryRouter serves the handlers with the service on the memory storage, no database is needed.
+func newMemoryRouter(t *testing.T, rateLimit infrastructure.RateLimit) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	logger := infrastructure.NewDefaultLogger()
+	outbox := infrastructure.NewMemoryOutboxStore()
+	wsConfig := infrastructure.WebSocket{}
+	subscription := infrastructure.NewSubscription(logger, wsConfig)
+	tickets, err := infrastructure.NewSubscribeTickets(wsConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	votingService := service.NewVoting(logger, repository.NewMemoryVoting(outbox), subscription,
+		infrastructure.NewOutboxRelay(logger, outbox, infrastructure.Outbox{}), infrastructure.Ingest{}, nil)
+	handler := web.NewVotingHandler(
+		logger,
+		votingService,
+		infrastructure.NewAuthStub(nil),
+		subscription,
+		infrastructure.NewLoginGuard(logger, infrastructure.NewMemoryLoginAttemptStore(), infrastructure.Lockout{}),
+		infrastructure.NewRateLimiter(logger, infrastructure.NewMemoryRateLimitStore(), rateLimit),
+		tickets,
+		nil,
+		wsConfig,
+		infrastructure.Cache{},
+	)
+
+	router := gin.New()
+	handler.RegisterHandlers(router)
+
+	return router
+}
+
+func serve(t *testing.T, router *gin.Engine, method, path, user string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reader bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reader).Encode(body); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	r := httptest.NewRequest(method, path, &reader)
+	r.SetBasicAuth(user, map[string]string{"user1": "secret1", "user2": "secret2"}[user])
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	return w
+}
+
+// createVoting creates the voting by user1 and returns it with its invariance ordered by name.
+func createVoting(t *testing.T, router *gin.Engine, invariance ...string) web.VotingDetailsResponse {
+	t.Helper()
+
+	created := serve(t, router, http.MethodPost, "/voting", "user1", gin.H{
+		"name":       "Voting",
+		"startAt":    "2024-01-01T00:00:00Z",
+		"endAt":      "2999-01-01T00:00:00Z",
+		"invariance": invariance,
+	})
+	var createResponse web.CreateVotingResponse
+	if err := json.Unmarshal(created.Body.Bytes(), &createResponse); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var voting web.VotingDetailsResponse
+	got := serve(t, router, http.MethodGet, "/voting/"+createResponse.ID.String(), "user1", nil)
+	if err := json.Unmarshal(got.Body.Bytes(), &voting); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	return voting
+}
+
+func TestRateLimitPerVotingSharedByInvariance(t *testing.T) {
+	router := newMemoryRouter(t, infrastructure.RateLimit{
+		Enabled:   true,
+		Choice:    infrastructure.TokenBucket{Rate: 0.001, Burst: 10},
+		Write:     infrastructure.TokenBucket{Rate: 0.001, Burst: 10},
+		PerVoting: infrastructure.TokenBucket{Rate: 0.001, Burst: 1},
+	})
+	voting := createVoting(t, router, "Option-a", "Option-b")
+	other := createVoting(t, router, "Option-a")
+
+	// The second invariance of the voting is charged to the bucket of the voting as well
+	if w := serve(t, router, http.MethodPost, "/voting/choice/"+voting.Invariance[0].ID.String(), "user1", gin.H{}); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if w := serve(t, router, http.MethodPost, "/voting/choice/"+voting.Invariance[1].ID.String(), "user2", gin.H{}); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d, got %d: %s", http.StatusTooManyRequests, w.Code, w.Body)
+	}
+
+	// The caller is checked before the voting, the rejected vote took a token of the shared IP as well
+	for i := 0; i < 7; i++ {
+		serve(t, router, http.MethodPost, "/voting/choice/"+uuid.NewString(), "user2", gin.H{})
+	}
+	if w := serve(t, router, http.MethodPost, "/voting/choice/"+other.Invariance[0].ID.String(), "user2", gin.H{}); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	// An exhausted caller is rejected before the voting is looked up
+	if w := serve(t, router, http.MethodPost, "/voting/choice/"+other.Invariance[0].ID.String(), "user2", gin.H{}); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d, got %d: %s", http.StatusTooManyRequests, w.Code, w.Body)
+	}
+}
+
+func TestVotingHandlersOnMemoryStorage(t *testing.T) {
+	router := newMemoryRouter(t, infrastructure.RateLimit{})
+
+	created := serve(t, router, http.MethodPost, "/voting", "user1", gin.H{
+		"name":       "Voting-1",
+		"startAt":    "2024-01-01T00:00:00Z",
+		"endAt":      "2999-01-01T00:00:00Z",
+		"invariance": []string{"Option-b", "Option-a"},
+	})
+	if created.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, created.Code, created.Body)
+	}
+	var createResponse web.CreateVotingResponse
+	if err := json.Unmarshal(created.Body.Bytes(), &createResponse); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	got := serve(t, router, http.MethodGet, "/voting/"+createResponse.ID.String(), "user1", nil)
+	var voting web.VotingDetailsResponse
+	if err := json.Unmarshal(got.Body.Bytes(), &voting); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got.Code != http.StatusOK || len(voting.Invariance) != 2 || voting.Invariance[0].Name != "Option-a" {
+		t.Fatalf("Expected the voting with ordered invariance, got %d: %s", got.Code, got.Body)
+	}
+	choicePath := "/voting/choice/" + voting.Invariance[0].ID.String()
+
+	tests := []struct {
+		name string
+		user string
+		code int
+	}{
+		{name: "first vote", user: "user1", code: http.StatusOK},
+		{name: "second vote of the user", user: "user1", code: http.StatusConflict},
+		{name: "vote of another user", user: "user2", code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(t, router, http.MethodPost, choicePath, tt.user, gin.H{}); w.Code != tt.code {
+				t.Errorf("Expected status %d, got %d: %s", tt.code, w.Code, w.Body)
+			}
+		})
+	}
+
+	got = serve(t, router, http.MethodGet, "/voting/"+createResponse.ID.String(), "user1", nil)
+	if err := json.Unmarshal(got.Body.Bytes(), &voting); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if voting.Turnout != 2 || voting.Invariance[0].Score != 2 {
+		t.Errorf("Expected 2 votes for Option-a, got %+v", voting.VotingItem)
+	}
+
+	if w := serve(t, router, http.MethodDelete, "/voting/"+createResponse.ID.String(), "user1", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if w := serve(t, router, http.MethodGet, "/voting/"+createResponse.ID.String(), "user1", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestMakeChoiceStatus(t *testing.T) {
+	router := newMemoryRouter(t, infrastructure.RateLimit{})
+	open := createVoting(t, router, "yes")
+
+	created := serve(t, router, http.MethodPost, "/voting", "user1", gin.H{
+		"name":       "Finished",
+		"startAt":    "2024-01-01T00:00:00Z",
+		"endAt":      "2024-01-02T00:00:00Z",
+		"invariance": []string{"yes"},
+	})
+	var createResponse web.CreateVotingResponse
+	if err := json.Unmarshal(created.Body.Bytes(), &createResponse); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var finished web.VotingDetailsResponse
+	got := serve(t, router, http.MethodGet, "/voting/"+createResponse.ID.String(), "user1", nil)
+	if err := json.Unmarshal(got.Body.Bytes(), &finished); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		code int
+	}{
+		{name: "vote", path: "/voting/choice/" + open.Invariance[0].ID.String(), code: http.StatusOK},
+		{name: "already voted", path: "/voting/choice/" + open.Invariance[0].ID.String(), code: http.StatusConflict},
+		{name: "finished voting", path: "/voting/choice/" + finished.Invariance[0].ID.String(), code: http.StatusConflict},
+		{name: "unknown invariance", path: "/voting/choice/" + uuid.NewString(), code: http.StatusNotFound},
+		{name: "invalid id", path: "/voting/choice/invalid", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(t, router, http.MethodPost, tt.path, "user1", gin.H{}); w.Code != tt.code {
+				t.Errorf("Expected status %d, got %d: %s", tt.code, w.Code, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package web
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/yvv4git/task-voting/internal/domain/entity"
+	"github.com/yvv4git/task-voting/internal/infrastructure"
+)
+
+const (
+	defaultDeliveriesLimit = 50
+	maxDeliveriesLimit     = 500
+)
+
+type CreateWebhookRequest struct {
+	URL string `json:"url"`
+	// Secret signs the deliveries, it's generated when empty
+	Secret string `json:"secret"`
+	// VotingID is empty for a global webhook
+	VotingID   *uuid.UUID         `json:"voting_id"`
+	EventTypes []entity.EventType `json:"event_types"`
+}
+
+// CreateWebhook registers the webhook, the response is the only place the secret is returned.
+func (v *VotingHandler) CreateWebhook(c *gin.Context) {
+	var request CreateWebhookRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, eventType := range request.EventTypes {
+		if !eventType.Valid() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown event type: " + string(eventType)})
+			return
+		}
+	}
+
+	webhook, err := v.webhooks.Register(c.Request.Context(), entity.Webhook{
+		URL:        request.URL,
+		Secret:     request.Secret,
+		VotingID:   request.VotingID,
+		EventTypes: request.EventTypes,
+	})
+	if errors.Is(err, infrastructure.ErrWebhookInvalidURL) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		v.log.Error("register webhook", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, webhook)
+}
+
+func (v *VotingHandler) ListWebhooks(c *gin.Context) {
+	webhooks, err := v.webhooks.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhooks": webhooks})
+}
+
+func (v *VotingHandler) DeleteWebhook(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	err = v.webhooks.Delete(c.Request.Context(), id)
+	if errors.Is(err, infrastructure.ErrObjectNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "webhook deleted"})
+}
+
+// WebhookDeliveries is the delivery log of the webhook, newest first.
+func (v *VotingHandler) WebhookDeliveries(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultDeliveriesLimit)))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+		return
+	}
+
+	deliveries, err := v.webhooks.Deliveries(c.Request.Context(), id, min(limit, maxDeliveriesLimit))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+// RedeliverWebhook sends the delivery again, e.g. from the dead letter.
+func (v *VotingHandler) RedeliverWebhook(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	err = v.webhooks.Redeliver(c.Request.Context(), id)
+	if errors.Is(err, infrastructure.ErrObjectNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "delivery not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "delivery scheduled"})
+}
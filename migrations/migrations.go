@@ -0,0 +1,10 @@
+// Package migrations embeds the migrations which are applied by the service itself.
+// The migrations of Postgres are applied by goose, see the Makefile.
+package migrations
+
+import "embed"
+
+// SQLite are the migrations of the sqlite storage, they're applied on start.
+//
+//go:embed sqlite/*.sql
+var SQLite embed.FS
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+-- SQLite has no UUID and array types, ids are TEXT in the canonical form, tags are a JSON array.
+-- Times are written by the repository in UTC, so they compare as text.
+CREATE TABLE voting
+(
+    id          TEXT PRIMARY KEY,
+    name        VARCHAR(255) NOT NULL,
+    description TEXT,
+    created_at  TIMESTAMP NOT NULL,
+    updated_at  TIMESTAMP,
+    started_at  TIMESTAMP,
+    ended_at    TIMESTAMP,
+    deleted_at  TIMESTAMP
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS voting;
+-- +goose StatementEnd
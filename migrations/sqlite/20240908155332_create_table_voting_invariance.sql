@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The unique (id, voting_id) is the key of votes, SQLite can't add it to the table later
+CREATE TABLE voting_invariance
+(
+    id          TEXT PRIMARY KEY,
+    voting_id   TEXT NOT NULL REFERENCES voting(id) ON DELETE CASCADE,
+    name        VARCHAR(255) NOT NULL,
+    UNIQUE (id, voting_id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS voting_invariance;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The table has the shape of voting_results after 20240920120000_add_voting_results_voting_id of Postgres,
+-- SQLite can't change constraints of a table. Votes aren't partitioned, there is nothing to archive.
+CREATE TABLE voting_results
+(
+    id           TEXT PRIMARY KEY,
+    user_id      TEXT NOT NULL, -- stored in auth system
+    invariant_id TEXT NOT NULL,
+    voting_id    TEXT NOT NULL,
+    created_at   TIMESTAMP NOT NULL,
+    FOREIGN KEY (invariant_id, voting_id) REFERENCES voting_invariance (id, voting_id) ON DELETE CASCADE,
+    UNIQUE (voting_id, user_id) -- a user votes once per voting
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS voting_results;
+-- +goose StatementEnd
@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE voting ADD COLUMN tags TEXT NOT NULL DEFAULT '[]';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE voting DROP COLUMN tags;
+-- +goose StatementEnd
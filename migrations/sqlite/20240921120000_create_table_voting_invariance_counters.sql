@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Number of votes of every invariance, kept in the transaction of the vote
+CREATE TABLE voting_invariance_counters
+(
+    invariance_id TEXT PRIMARY KEY REFERENCES voting_invariance(id) ON DELETE CASCADE,
+    voting_id     TEXT NOT NULL,
+    score         BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX voting_invariance_counters_voting_id_idx ON voting_invariance_counters (voting_id);
+
+-- Votes of an invariance are deleted by the cascade
+CREATE INDEX voting_results_invariant_id_idx ON voting_results (invariant_id);
+CREATE INDEX voting_invariance_voting_id_idx ON voting_invariance (voting_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS voting_invariance_voting_id_idx;
+DROP INDEX IF EXISTS voting_results_invariant_id_idx;
+DROP TABLE IF EXISTS voting_invariance_counters;
+-- +goose StatementEnd
@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+-- End of the last interval checked by the closer, the votings which ended after it are not announced yet
+CREATE TABLE voting_closer
+(
+    id         BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    checked_at TIMESTAMP NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS voting_closer;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Events written in the transaction of the change, delivered by the outbox relay of the instance
+CREATE TABLE voting_events_outbox
+(
+    position     INTEGER PRIMARY KEY AUTOINCREMENT,
+    id           TEXT NOT NULL UNIQUE, -- entity.Event ID, consumers deduplicate by it
+    event        TEXT NOT NULL,
+    created_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP
+);
+
+CREATE INDEX voting_events_outbox_pending_idx ON voting_events_outbox (position) WHERE delivered_at IS NULL;
+CREATE INDEX voting_events_outbox_delivered_at_idx ON voting_events_outbox (delivered_at) WHERE delivered_at IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS voting_events_outbox;
+-- +goose StatementEnd
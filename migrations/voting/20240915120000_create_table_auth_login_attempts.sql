@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE auth_login_attempts
+(
+    key             VARCHAR(320) PRIMARY KEY,
+    failures        INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMPTZ NOT NULL,
+    blocked_until   TIMESTAMPTZ NOT NULL DEFAULT 'epoch'
+);
+
+COMMENT ON COLUMN auth_login_attempts.key IS 'user:<username> or ip:<client ip>';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS auth_login_attempts;
+-- +goose StatementEnd
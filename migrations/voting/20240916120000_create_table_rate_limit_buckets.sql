@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE UNLOGGED TABLE rate_limit_buckets
+(
+    key        VARCHAR(512) PRIMARY KEY,
+    tokens     DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+COMMENT ON TABLE rate_limit_buckets IS 'token buckets of the rate limiter, losing them on crash is fine';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS rate_limit_buckets;
+-- +goose StatementEnd
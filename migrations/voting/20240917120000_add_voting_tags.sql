@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE voting ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX idx_voting_tags ON voting USING GIN (tags);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_voting_tags;
+
+ALTER TABLE voting DROP COLUMN IF EXISTS tags;
+-- +goose StatementEnd
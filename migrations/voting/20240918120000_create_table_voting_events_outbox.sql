@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE voting_events_outbox
+(
+    position     BIGSERIAL PRIMARY KEY,
+    id           UUID NOT NULL UNIQUE,
+    event        JSONB NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMPTZ
+);
+
+CREATE INDEX voting_events_outbox_pending_idx ON voting_events_outbox (position) WHERE delivered_at IS NULL;
+CREATE INDEX voting_events_outbox_delivered_at_idx ON voting_events_outbox (delivered_at) WHERE delivered_at IS NOT NULL;
+
+COMMENT ON TABLE voting_events_outbox IS 'events written in the transaction of the change, delivered by the outbox relay';
+COMMENT ON COLUMN voting_events_outbox.id IS 'entity.Event ID, consumers deduplicate by it';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS voting_events_outbox;
+-- +goose StatementEnd
@@ -0,0 +1,49 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE webhooks
+(
+    id          UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    url         TEXT NOT NULL,
+    secret      TEXT NOT NULL,
+    voting_id   UUID,
+    event_types TEXT[] NOT NULL DEFAULT '{}',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    disabled_at TIMESTAMPTZ
+);
+
+CREATE INDEX webhooks_voting_id_idx ON webhooks (voting_id);
+
+-- The webhooks of a voting outlive it to get its voting.deleted, so there is no foreign key to cascade
+COMMENT ON COLUMN webhooks.voting_id IS 'NULL for a global webhook, the voting may be deleted already';
+COMMENT ON COLUMN webhooks.disabled_at IS 'set when voting.deleted of its voting is enqueued, a disabled webhook gets no more events';
+COMMENT ON COLUMN webhooks.event_types IS 'empty for every event type';
+
+CREATE TABLE webhook_deliveries
+(
+    id              UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    webhook_id      UUID NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event_id        UUID NOT NULL,
+    event_type      TEXT NOT NULL,
+    event           JSONB NOT NULL,
+    status          TEXT NOT NULL DEFAULT 'pending',
+    attempts        INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error      TEXT NOT NULL DEFAULT '',
+    response_code   INT NOT NULL DEFAULT 0,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at    TIMESTAMPTZ,
+    UNIQUE (webhook_id, event_id)
+);
+
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, created_at DESC);
+CREATE INDEX webhook_deliveries_delivered_at_idx ON webhook_deliveries (delivered_at) WHERE status = 'delivered';
+
+COMMENT ON COLUMN webhook_deliveries.status IS 'pending, delivered or dead (dead letter)';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+-- +goose StatementEnd
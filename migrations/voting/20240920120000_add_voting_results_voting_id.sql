@@ -0,0 +1,80 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE voting_invariance ADD CONSTRAINT voting_invariance_id_voting_id_key UNIQUE (id, voting_id);
+
+ALTER TABLE voting_results ADD COLUMN voting_id UUID;
+
+UPDATE voting_results r
+SET voting_id = i.voting_id
+FROM voting_invariance i
+WHERE i.id = r.invariant_id;
+
+-- Double votes which passed the check under concurrency before are moved to the quarantine for review,
+-- the first vote of the user is kept and counted. Nothing is deleted for good.
+CREATE TABLE voting_results_quarantine
+(
+    id             UUID PRIMARY KEY,
+    user_id        UUID NOT NULL,
+    invariant_id   UUID NOT NULL,
+    created_at     TIMESTAMP NOT NULL,
+    voting_id      UUID NOT NULL,
+    kept_id        UUID NOT NULL,
+    quarantined_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON TABLE voting_results_quarantine IS 'double votes found by the migration to the unique vote per voting';
+COMMENT ON COLUMN voting_results_quarantine.kept_id IS 'the first vote of the user, kept in voting_results';
+
+WITH ranked AS (
+    SELECT id, first_value(id) OVER (PARTITION BY voting_id, user_id ORDER BY created_at, id) AS kept_id
+    FROM voting_results
+), moved AS (
+    DELETE FROM voting_results r
+    USING ranked
+    WHERE ranked.id = r.id
+      AND ranked.kept_id <> r.id
+    RETURNING r.id, r.user_id, r.invariant_id, r.created_at, r.voting_id, ranked.kept_id
+)
+INSERT INTO voting_results_quarantine (id, user_id, invariant_id, created_at, voting_id, kept_id)
+SELECT id, user_id, invariant_id, created_at, voting_id, kept_id
+FROM moved;
+
+DO $$
+DECLARE
+    quarantined BIGINT;
+BEGIN
+    SELECT count(*) INTO quarantined FROM voting_results_quarantine;
+    IF quarantined > 0 THEN
+        RAISE WARNING '% double votes moved to voting_results_quarantine, the counters exclude them', quarantined;
+    END IF;
+END $$;
+
+ALTER TABLE voting_results ALTER COLUMN voting_id SET NOT NULL;
+
+-- The vote belongs to the voting of its invariance
+ALTER TABLE voting_results DROP CONSTRAINT voting_results_invariant_id_fkey;
+ALTER TABLE voting_results ADD CONSTRAINT voting_results_invariance_fkey
+    FOREIGN KEY (invariant_id, voting_id) REFERENCES voting_invariance (id, voting_id) ON DELETE CASCADE;
+
+ALTER TABLE voting_results ADD CONSTRAINT voting_results_voting_id_user_id_key UNIQUE (voting_id, user_id);
+
+COMMENT ON CONSTRAINT voting_results_voting_id_user_id_key ON voting_results IS 'a user votes once per voting';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE voting_results DROP CONSTRAINT voting_results_voting_id_user_id_key;
+ALTER TABLE voting_results DROP CONSTRAINT voting_results_invariance_fkey;
+ALTER TABLE voting_results ADD CONSTRAINT voting_results_invariant_id_fkey
+    FOREIGN KEY (invariant_id) REFERENCES voting_invariance (id) ON DELETE CASCADE;
+
+-- The quarantined votes come back unless their invariance is gone
+INSERT INTO voting_results (id, user_id, invariant_id, created_at, voting_id)
+SELECT q.id, q.user_id, q.invariant_id, q.created_at, q.voting_id
+FROM voting_results_quarantine q
+WHERE EXISTS (SELECT FROM voting_invariance i WHERE i.id = q.invariant_id);
+DROP TABLE voting_results_quarantine;
+
+ALTER TABLE voting_results DROP COLUMN voting_id;
+ALTER TABLE voting_invariance DROP CONSTRAINT voting_invariance_id_voting_id_key;
+-- +goose StatementEnd
@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE voting_invariance_counters
+(
+    invariance_id UUID PRIMARY KEY REFERENCES voting_invariance(id) ON DELETE CASCADE,
+    voting_id     UUID NOT NULL,
+    score         BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX voting_invariance_counters_voting_id_idx ON voting_invariance_counters (voting_id);
+
+COMMENT ON TABLE voting_invariance_counters IS 'number of votes of every invariance, kept in the transaction of the vote, rebuilt by the recount command';
+
+INSERT INTO voting_invariance_counters (invariance_id, voting_id, score)
+SELECT i.id, i.voting_id, count(r.id)
+FROM voting_invariance i
+LEFT JOIN voting_results r ON r.invariant_id = i.id
+GROUP BY i.id;
+
+-- Votes of an invariance are counted by recount and deleted by the cascade
+CREATE INDEX voting_results_invariant_id_idx ON voting_results (invariant_id);
+CREATE INDEX voting_invariance_voting_id_idx ON voting_invariance (voting_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS voting_invariance_voting_id_idx;
+DROP INDEX IF EXISTS voting_results_invariant_id_idx;
+DROP TABLE IF EXISTS voting_invariance_counters;
+-- +goose StatementEnd
@@ -0,0 +1,107 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Votes are partitioned by voting, a partition per voting named voting_results_<voting id without dashes>.
+-- The repository creates the partition with the voting, the archive command detaches it concurrently
+-- and attaches it to voting_results_archive. There is no default partition, it would forbid detaching concurrently.
+CREATE TABLE voting_results_partitioned
+(
+    id           UUID NOT NULL DEFAULT gen_random_uuid(),
+    user_id      UUID NOT NULL,
+    invariant_id UUID NOT NULL,
+    created_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    voting_id    UUID NOT NULL
+) PARTITION BY LIST (voting_id);
+
+DO $$
+DECLARE
+    voting_id UUID;
+BEGIN
+    FOR voting_id IN SELECT id FROM voting LOOP
+        EXECUTE format('CREATE TABLE %I PARTITION OF voting_results_partitioned FOR VALUES IN (%L)',
+            'voting_results_' || replace(voting_id::text, '-', ''), voting_id);
+    END LOOP;
+END $$;
+
+INSERT INTO voting_results_partitioned (id, user_id, invariant_id, created_at, voting_id)
+SELECT id, user_id, invariant_id, created_at, voting_id
+FROM voting_results;
+
+DROP TABLE voting_results;
+ALTER TABLE voting_results_partitioned RENAME TO voting_results;
+
+-- Keys of a partitioned table include the partition key, the unique (voting_id, user_id) stays as it was
+ALTER TABLE voting_results ADD CONSTRAINT voting_results_pkey PRIMARY KEY (voting_id, id);
+ALTER TABLE voting_results ADD CONSTRAINT voting_results_voting_id_user_id_key UNIQUE (voting_id, user_id);
+ALTER TABLE voting_results ADD CONSTRAINT voting_results_invariance_fkey
+    FOREIGN KEY (invariant_id, voting_id) REFERENCES voting_invariance (id, voting_id) ON DELETE CASCADE;
+CREATE INDEX voting_results_invariant_id_idx ON voting_results (invariant_id);
+
+COMMENT ON COLUMN voting_results.user_id IS 'stored in auth system';
+COMMENT ON CONSTRAINT voting_results_voting_id_user_id_key ON voting_results IS 'a user votes once per voting';
+
+-- The detached partitions keep their keys and foreign key, so the archive needs none of its own
+CREATE TABLE voting_results_archive
+(
+    id           UUID NOT NULL DEFAULT gen_random_uuid(),
+    user_id      UUID NOT NULL,
+    invariant_id UUID NOT NULL,
+    created_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    voting_id    UUID NOT NULL
+) PARTITION BY LIST (voting_id);
+
+COMMENT ON TABLE voting_results_archive IS 'votes of archived votings, a partition per voting moved from voting_results';
+
+ALTER TABLE voting ADD COLUMN archived_at TIMESTAMP;
+
+COMMENT ON COLUMN voting.archived_at IS 'the voting is closed and its votes partition is moved to voting_results_archive, the results are kept by the counters';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE TABLE voting_results_unpartitioned
+(
+    id           UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id      UUID NOT NULL,
+    invariant_id UUID NOT NULL,
+    created_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    voting_id    UUID NOT NULL
+);
+
+INSERT INTO voting_results_unpartitioned (id, user_id, invariant_id, created_at, voting_id)
+SELECT id, user_id, invariant_id, created_at, voting_id
+FROM voting_results;
+
+INSERT INTO voting_results_unpartitioned (id, user_id, invariant_id, created_at, voting_id)
+SELECT id, user_id, invariant_id, created_at, voting_id
+FROM voting_results_archive;
+
+-- Votes of archives interrupted between detaching and attaching come back from their tables
+DO $$
+DECLARE
+    detached TEXT;
+BEGIN
+    FOR detached IN SELECT 'voting_results_' || replace(id::text, '-', '') FROM voting WHERE archived_at IS NOT NULL LOOP
+        IF to_regclass(detached) IS NOT NULL
+            AND NOT EXISTS (SELECT FROM pg_inherits WHERE inhrelid = to_regclass(detached)) THEN
+            EXECUTE format('INSERT INTO voting_results_unpartitioned (id, user_id, invariant_id, created_at, voting_id)
+                SELECT id, user_id, invariant_id, created_at, voting_id FROM %I', detached);
+            EXECUTE format('DROP TABLE %I', detached);
+        END IF;
+    END LOOP;
+END $$;
+
+DROP TABLE voting_results_archive;
+DROP TABLE voting_results;
+ALTER TABLE voting_results_unpartitioned RENAME TO voting_results;
+ALTER INDEX voting_results_unpartitioned_pkey RENAME TO voting_results_pkey;
+
+ALTER TABLE voting_results ADD CONSTRAINT voting_results_voting_id_user_id_key UNIQUE (voting_id, user_id);
+ALTER TABLE voting_results ADD CONSTRAINT voting_results_invariance_fkey
+    FOREIGN KEY (invariant_id, voting_id) REFERENCES voting_invariance (id, voting_id) ON DELETE CASCADE;
+CREATE INDEX voting_results_invariant_id_idx ON voting_results (invariant_id);
+
+COMMENT ON COLUMN voting_results.user_id IS 'stored in auth system';
+COMMENT ON CONSTRAINT voting_results_voting_id_user_id_key ON voting_results IS 'a user votes once per voting';
+
+ALTER TABLE voting DROP COLUMN archived_at;
+-- +goose StatementEnd
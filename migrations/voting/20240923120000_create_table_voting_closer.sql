@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE voting_closer
+(
+    id         BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    checked_at TIMESTAMPTZ NOT NULL
+);
+
+COMMENT ON TABLE voting_closer IS 'end of the last interval checked by the closer, the votings which ended after it are not announced yet';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS voting_closer;
+-- +goose StatementEnd